@@ -1,6 +1,8 @@
 package config
 
 import (
+	"testing"
+
 	"github.com/spf13/viper"
 )
 
@@ -8,10 +10,35 @@ type Config struct {
 	ProjectName               string `mapstructure:"PROJECT_NAME"`
 	Debug                     bool   `mapstructure:"DEBUG"`
 	EmailOtpExpireSeconds     int64  `mapstructure:"EMAIL_OTP_EXPIRE_SECONDS"`
+	OtpMaxAttempts            int    `mapstructure:"OTP_MAX_ATTEMPTS"`
+	OtpLockoutMinutes         int    `mapstructure:"OTP_LOCKOUT_MINUTES"`
 	AccessTokenExpireMinutes  int    `mapstructure:"ACCESS_TOKEN_EXPIRE_MINUTES"`
 	RefreshTokenExpireMinutes int    `mapstructure:"REFRESH_TOKEN_EXPIRE_MINUTES"`
 	Port                      string `mapstructure:"PORT"`
 	JWTSecretKey              string `mapstructure:"JWT_SECRET_KEY"`
+	JWTAlgorithm              string `mapstructure:"JWT_ALGORITHM"`
+	JWTPrivateKeyFile         string `mapstructure:"JWT_PRIVATE_KEY_FILE"`
+	JWTPreviousSecretKeys     string `mapstructure:"JWT_PREVIOUS_SECRET_KEYS"`
+	JWTPreviousKeyFiles       string `mapstructure:"JWT_PREVIOUS_KEY_FILES"`
+	JWTPreviousKeysExpireAt   string `mapstructure:"JWT_PREVIOUS_KEYS_EXPIRE_AT"`
+	MfaChallengeExpireMinutes int    `mapstructure:"MFA_CHALLENGE_EXPIRE_MINUTES"`
+	FrontendURL               string `mapstructure:"FRONTEND_URL"`
+	LoginFreeAttempts         int    `mapstructure:"LOGIN_FREE_ATTEMPTS"`
+	LoginBackoffBaseSeconds   int    `mapstructure:"LOGIN_BACKOFF_BASE_SECONDS"`
+	LoginBackoffMaxSeconds    int    `mapstructure:"LOGIN_BACKOFF_MAX_SECONDS"`
+	LoginLockoutThreshold     int    `mapstructure:"LOGIN_LOCKOUT_THRESHOLD"`
+	LoginIPLockoutThreshold   int    `mapstructure:"LOGIN_IP_LOCKOUT_THRESHOLD"`
+	LoginLockoutMinutes       int    `mapstructure:"LOGIN_LOCKOUT_MINUTES"`
+	LoginFailureWindowMinutes int    `mapstructure:"LOGIN_FAILURE_WINDOW_MINUTES"`
+	OidcIssuer                string `mapstructure:"OIDC_ISSUER"`
+	OidcClientID              string `mapstructure:"OIDC_CLIENT_ID"`
+	OidcClientSecret          string `mapstructure:"OIDC_CLIENT_SECRET"`
+	OidcRedirectURL           string `mapstructure:"OIDC_REDIRECT_URL"`
+	OidcLoginExpireMinutes    int    `mapstructure:"OIDC_LOGIN_EXPIRE_MINUTES"`
+	PasswordMinLength         int    `mapstructure:"PASSWORD_MIN_LENGTH"`
+	SocketFanoutBackend       string `mapstructure:"SOCKET_FANOUT_BACKEND"`
+	PasswordBreachedListFile  string `mapstructure:"PASSWORD_BREACHED_LIST_FILE"`
+	PasswordHistoryCount      int    `mapstructure:"PASSWORD_HISTORY_COUNT"`
 	PostgresUser              string `mapstructure:"POSTGRES_USER"`
 	PostgresPassword          string `mapstructure:"POSTGRES_PASSWORD"`
 	PostgresServer            string `mapstructure:"POSTGRES_SERVER"`
@@ -24,7 +51,6 @@ type Config struct {
 	CloudinaryCloudName       string `mapstructure:"CLOUDINARY_CLOUD_NAME"`
 	CloudinaryAPIKey          string `mapstructure:"CLOUDINARY_API_KEY"`
 	CloudinaryAPISecret       string `mapstructure:"CLOUDINARY_API_SECRET"`
-	SocketSecretKey           string `mapstructure:"SOCKET_SECRET_KEY"`
 }
 
 func GetConfig(testOpts ...bool) (config Config) {
@@ -33,9 +59,28 @@ func GetConfig(testOpts ...bool) (config Config) {
 	viper.SetConfigType("env")
 	viper.AutomaticEnv()
 
+	// Defaults for optional settings
+	viper.SetDefault("MFA_CHALLENGE_EXPIRE_MINUTES", 5)
+	viper.SetDefault("OTP_MAX_ATTEMPTS", 5)
+	viper.SetDefault("OTP_LOCKOUT_MINUTES", 15)
+	viper.SetDefault("PASSWORD_MIN_LENGTH", 8)
+	viper.SetDefault("PASSWORD_HISTORY_COUNT", 5)
+	viper.SetDefault("OIDC_LOGIN_EXPIRE_MINUTES", 10)
+	viper.SetDefault("LOGIN_FREE_ATTEMPTS", 3)
+	viper.SetDefault("LOGIN_BACKOFF_BASE_SECONDS", 2)
+	viper.SetDefault("LOGIN_BACKOFF_MAX_SECONDS", 300)
+	viper.SetDefault("LOGIN_LOCKOUT_THRESHOLD", 10)
+	viper.SetDefault("LOGIN_IP_LOCKOUT_THRESHOLD", 50)
+	viper.SetDefault("LOGIN_LOCKOUT_MINUTES", 30)
+	viper.SetDefault("LOGIN_FAILURE_WINDOW_MINUTES", 60)
+	viper.SetDefault("SOCKET_FANOUT_BACKEND", "memory")
+
 	var err error
 	if err = viper.ReadInConfig(); err != nil {
-		panic(err)
+		// Tests run on the defaults & environment when there's no .env
+		if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound || !testing.Testing() {
+			panic(err)
+		}
 	}
 	viper.Unmarshal(&config)
 	return
@@ -16,12 +16,20 @@ func Models() []interface{} {
 	return []interface{}{
 		// general
 		&models.File{},
+		&models.FanoutPayload{},
 
 		// accounts
 		&models.Country{},
 		&models.Region{},
 		&models.City{},
 		&models.User{},
+		&models.Session{},
+		&models.RecoveryCode{},
+		&models.UsedMfaChallenge{},
+		&models.PasswordHistory{},
+		&models.UserIdentity{},
+		&models.OidcLoginRequest{},
+		&models.ThrottleCounter{},
 		&models.Otp{},
 
 		// feed
@@ -29,14 +37,30 @@ func Models() []interface{} {
 		&models.Comment{},
 		&models.Reply{},
 		&models.Reaction{},
+		&models.HomeFeedSnapshot{},
+		&models.HomeFeedSnapshotPost{},
 
 		// profiles
 		&models.Friend{},
+		&models.Follow{},
+		&models.Block{},
+		&models.Mute{},
 		&models.Notification{},
 
 		// chat
 		&models.Chat{},
+		&models.ChatUser{},
 		&models.Message{},
+		&models.ChatReadCursor{},
+		&models.ChatInvite{},
+		&models.ChatJoinRequest{},
+	}
+}
+
+// Custom join tables, which must be set up on a connection before using the associations
+func SetupJoinTables(db *gorm.DB) {
+	if err := db.SetupJoinTable(&models.Chat{}, "UserObjs", &models.ChatUser{}); err != nil {
+		log.Fatal("failed to set up join tables: " + err.Error())
 	}
 }
 
@@ -46,6 +70,28 @@ func MakeMigrations(db *gorm.DB) {
 		db.AutoMigrate(model)
 	}
 	db.Exec("CREATE UNIQUE INDEX unique_requester_requestee ON friends(LEAST(requester_id, requestee_id), GREATEST(requester_id, requestee_id))")
+	// Message history is paginated by (created_at, id) within a chat
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_messages_chat_created_at_id ON messages(chat_id, created_at, id)")
+
+	// Full-text search, on generated columns kept up to date by Postgres
+	for _, search := range searchDocuments {
+		db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (%s) STORED", search.Table, search.Document))
+		db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_search_vector ON %s USING GIN (search_vector)", search.Table, search.Table))
+	}
+}
+
+// What each searchable table's search_vector is made of. Names & usernames aren't stemmed,
+// and they rank above the bio.
+var searchDocuments = []struct {
+	Table    string
+	Document string
+}{
+	{"posts", "to_tsvector('english', coalesce(text, ''))"},
+	{"comments", "to_tsvector('english', coalesce(text, ''))"},
+	{"replies", "to_tsvector('english', coalesce(text, ''))"},
+	{"messages", "to_tsvector('english', coalesce(text, ''))"},
+	{"users", "setweight(to_tsvector('simple', first_name || ' ' || last_name || ' ' || username), 'A') || " +
+		"setweight(to_tsvector('simple', coalesce(bio, '')), 'B')"},
 }
 
 func CreateTables(db *gorm.DB) {
@@ -84,6 +130,7 @@ func ConnectDb(cfg config.Config, logs ...bool) *gorm.DB {
 		os.Exit(2)
 	}
 	log.Println("Connected to the database successfully")
+	SetupJoinTables(db)
 
 	if len(logs) == 0 {
 		// When extra parameter is passed, don't do the following (from sockets)
@@ -0,0 +1,116 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/models/choices"
+	"github.com/pborman/uuid"
+)
+
+// Something that happened in the app which other parts (like the websockets) may react to
+type Event interface {
+	EventName() string
+}
+
+// ----------------------------------
+// NOTIFICATION EVENTS
+// --------------------------------
+type NotificationCreated struct {
+	Notification models.Notification
+	ReceiverIDs  []uuid.UUID
+}
+
+func (e NotificationCreated) EventName() string { return "notification.created" }
+
+// The notification is usually deleted by the time this is published, hence the receivers are included
+type NotificationDeleted struct {
+	Notification models.Notification
+	CommentSlug  *string
+	ReplySlug    *string
+	ReceiverIDs  []uuid.UUID
+}
+
+func (e NotificationDeleted) EventName() string { return "notification.deleted" }
+
+// ----------------------------------
+// MESSAGE EVENTS
+// --------------------------------
+type MessageCreated struct {
+	Message   models.Message
+	MemberIDs []uuid.UUID // members of the message's chat
+}
+
+func (e MessageCreated) EventName() string { return "message.created" }
+
+type MessageUpdated struct {
+	Message   models.Message
+	MemberIDs []uuid.UUID // members of the message's chat
+}
+
+func (e MessageUpdated) EventName() string { return "message.updated" }
+
+type MessageDeleted struct {
+	ChatID    uuid.UUID
+	MessageID uuid.UUID
+	MemberIDs []uuid.UUID // members of the message's chat (before a deleted DM goes with it)
+}
+
+func (e MessageDeleted) EventName() string { return "message.deleted" }
+
+// A member added, changed or removed their reaction to a message
+type MessageReactionUpdated struct {
+	Message models.Message // with its reaction counts after the change
+	User    models.User
+	Rtype   choices.ReactionChoice
+	Removed bool
+}
+
+func (e MessageReactionUpdated) EventName() string { return "message.reaction_updated" }
+
+// The member's read cursor moved forward
+type ChatRead struct {
+	Cursor    models.ChatReadCursor
+	MemberIDs []uuid.UUID
+}
+
+func (e ChatRead) EventName() string { return "chat.read" }
+
+// The users aren't members of the chat anymore (they left, were removed or a block ended their DM), so they must stop receiving it
+type ChatMembershipEnded struct {
+	ChatID  uuid.UUID
+	UserIDs []uuid.UUID
+}
+
+func (e ChatMembershipEnded) EventName() string { return "chat.membership_ended" }
+
+// ----------------------------------
+// BUS
+// --------------------------------
+type Handler func(event Event)
+
+// An in-process publish/subscribe bus. Handlers run synchronously in the publisher's
+// goroutine, so they should only do quick work (like queueing socket messages).
+type Bus struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+func (b *Bus) Subscribe(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *Bus) Publish(event Event) {
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
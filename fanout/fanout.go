@@ -0,0 +1,46 @@
+package fanout
+
+import (
+	"fmt"
+
+	"github.com/acatalepsy17/pigeon/config"
+	"gorm.io/gorm"
+)
+
+// A broadcast to the clients in a room, or in several rooms at once
+type Message struct {
+	Room         string   `json:"room,omitempty"`
+	Rooms        []string `json:"rooms,omitempty"` // extra rooms, so the same data is published once for all of them
+	Data         []byte   `json:"-"`
+	ExceptUserID string   `json:"except_user_id,omitempty"` // the clients of this user skip it (e.g. the sender's)
+	EvictUserIDs []string `json:"evict_user_ids,omitempty"` // the clients of these users are dropped from the rooms instead
+}
+
+// Every room the message goes to
+func (msg Message) AllRooms() []string {
+	if msg.Room == "" {
+		return msg.Rooms
+	}
+	return append([]string{msg.Room}, msg.Rooms...)
+}
+
+// Called with every broadcast published by any instance (including this one)
+type Handler func(msg Message)
+
+// Carries socket broadcasts to every running instance, so a client gets a room's
+// messages whichever instance it is connected to.
+type Backend interface {
+	Publish(msg Message) error
+	Subscribe(handler Handler)
+}
+
+// Returns the backend chosen with SOCKET_FANOUT_BACKEND
+func New(cfg config.Config, db *gorm.DB) (Backend, error) {
+	switch cfg.SocketFanoutBackend {
+	case "", "memory":
+		return NewMemory(), nil
+	case "postgres":
+		return NewPostgres(db)
+	}
+	return nil, fmt.Errorf("unknown socket fanout backend %q", cfg.SocketFanoutBackend)
+}
@@ -0,0 +1,29 @@
+package fanout
+
+import "sync"
+
+// Delivers broadcasts within this process only. Enough when a single instance is running.
+type Memory struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Publish(msg Message) error {
+	m.mu.RLock()
+	handlers := m.handlers
+	m.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(handler Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
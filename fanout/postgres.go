@@ -0,0 +1,141 @@
+package fanout
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/models"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	postgresChannel         = "pigeon_socket_fanout"
+	postgresMaxPayload      = 7900 // NOTIFY payloads are capped at 8000 bytes
+	postgresPayloadLifetime = time.Minute
+	postgresMaxRetryWait    = 30 * time.Second
+)
+
+type postgresNotification struct {
+	Message
+	Data json.RawMessage `json:"data,omitempty"`
+	Ref  string          `json:"ref,omitempty"` // id of a FanoutPayload holding an oversized broadcast
+}
+
+// Shares broadcasts between instances with Postgres LISTEN/NOTIFY, one notification per broadcast
+// however many rooms it goes to. Each instance keeps one connection from the pool listening. Broadcasts published while that connection is being
+// re-established are missed by this instance.
+type Postgres struct {
+	db       *gorm.DB
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewPostgres(db *gorm.DB) (*Postgres, error) {
+	if _, err := db.DB(); err != nil {
+		return nil, err
+	}
+	p := &Postgres{db: db}
+	go p.listen()
+	return p, nil
+}
+
+func (p *Postgres) Publish(msg Message) error {
+	payload, err := json.Marshal(postgresNotification{Message: msg, Data: msg.Data})
+	if err != nil || len(payload) > postgresMaxPayload {
+		// Too large (or not JSON), so listeners fetch it from the table instead
+		stored := models.FanoutPayload{Room: msg.Room, Rooms: msg.Rooms, Data: msg.Data, ExceptUserID: msg.ExceptUserID, EvictUserIDs: msg.EvictUserIDs}
+		if err := p.db.Create(&stored).Error; err != nil {
+			return err
+		}
+		p.db.Where("created_at < ?", time.Now().Add(-postgresPayloadLifetime)).Delete(&models.FanoutPayload{})
+		payload, _ = json.Marshal(postgresNotification{Ref: stored.ID.String()})
+	}
+	return p.db.Exec("SELECT pg_notify(?, ?)", postgresChannel, string(payload)).Error
+}
+
+func (p *Postgres) Subscribe(handler Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers = append(p.handlers, handler)
+}
+
+// Keeps a listening connection open, reconnecting with a growing delay when it drops
+func (p *Postgres) listen() {
+	wait := time.Second
+	for {
+		listening, err := p.listenOnce()
+		if listening {
+			wait = time.Second
+		}
+		log.Printf("fanout: postgres listener stopped (%v), retrying in %s", err, wait)
+		time.Sleep(wait)
+		wait = min(wait*2, postgresMaxRetryWait)
+	}
+}
+
+func (p *Postgres) listenOnce() (bool, error) {
+	sqlDb, err := p.db.DB()
+	if err != nil {
+		return false, err
+	}
+	ctx := context.Background()
+	conn, err := sqlDb.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	listening := false
+	err = conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("database driver isn't pgx")
+		}
+		pgxConn := stdlibConn.Conn()
+		if _, err := pgxConn.Exec(ctx, "LISTEN "+postgresChannel); err != nil {
+			return err
+		}
+		listening = true
+		for {
+			notification, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				// Don't hand a listening connection back to the pool
+				return errors.Join(err, driver.ErrBadConn)
+			}
+			p.dispatch(notification.Payload)
+		}
+	})
+	return listening, err
+}
+
+func (p *Postgres) dispatch(payload string) {
+	notification := postgresNotification{}
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		log.Println("fanout: invalid notification:", err)
+		return
+	}
+	msg := notification.Message
+	msg.Data = notification.Data
+	if notification.Ref != "" {
+		stored := models.FanoutPayload{}
+		if err := p.db.Take(&stored, "id = ?", uuid.Parse(notification.Ref)).Error; err != nil {
+			log.Println("fanout: missing payload", notification.Ref)
+			return
+		}
+		msg = Message{Room: stored.Room, Rooms: stored.Rooms, Data: stored.Data, ExceptUserID: stored.ExceptUserID, EvictUserIDs: stored.EvictUserIDs}
+	}
+
+	p.mu.RLock()
+	handlers := p.handlers
+	p.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
@@ -0,0 +1,550 @@
+package managers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/config"
+	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/models/choices"
+	"github.com/acatalepsy17/pigeon/utils"
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var cfg = config.GetConfig()
+
+// ----------------------------------
+// OTP MANAGEMENT
+// --------------------------------
+type OtpManager struct {
+}
+
+func otpLockedErr(otp models.Otp) (*int, *utils.ErrorResponse) {
+	statusCode := 429
+	retryAfter := int(time.Until(*otp.LockedUntil).Seconds()) + 1
+	data := map[string]string{
+		"retry_after": fmt.Sprint(retryAfter),
+	}
+	errData := utils.RequestErr(utils.ERR_TOO_MANY_ATTEMPTS, "Too many failed attempts. Try again later", data)
+	return &statusCode, &errData
+}
+
+// Generate a new otp for the given purpose, replacing any previous one (but keeping its failed attempts).
+// The plaintext code is returned (to be emailed) and only its hash is stored.
+// A target (optional) is the value the otp confirms, like the new email address of an email change.
+func (obj OtpManager) Create(db *gorm.DB, user models.User, purpose choices.OtpPurposeChoice, targetOpts ...string) (*uint32, *int, *utils.ErrorResponse) {
+	otp := models.Otp{}
+	db.Take(&otp, models.Otp{UserId: user.ID, Purpose: purpose})
+	if otp.ID != nil && otp.IsLocked() {
+		errCode, errData := otpLockedErr(otp)
+		return nil, errCode, errData
+	}
+
+	code := utils.GetRandomInt(6)
+	otp.UserId = user.ID
+	otp.Purpose = purpose
+	otp.CodeHash = utils.HashPassword(fmt.Sprint(code))
+	if otp.LockedUntil != nil {
+		// The lockout has passed, so start counting again.
+		// Otherwise failures carry over, so resending can't be used to get more guesses.
+		otp.FailedAttempts = 0
+		otp.LockedUntil = nil
+	}
+	otp.Target = nil
+	if len(targetOpts) > 0 {
+		otp.Target = &targetOpts[0]
+	}
+	db.Omit("User").Save(&otp) // Create or save
+	return &code, nil, nil
+}
+
+// Check an otp for the given purpose. A correct otp is consumed so it cannot be replayed,
+// while too many wrong guesses invalidate it and lock the purpose for a while.
+func (obj OtpManager) Verify(db *gorm.DB, user models.User, purpose choices.OtpPurposeChoice, code uint32) (*models.Otp, *int, *utils.ErrorResponse) {
+	otp := models.Otp{}
+	db.Take(&otp, models.Otp{UserId: user.ID, Purpose: purpose})
+	if otp.ID == nil || (otp.LockedUntil != nil && !otp.IsLocked()) {
+		// No otp, or the previous one was invalidated & its lockout has passed
+		statusCode := 404
+		errData := utils.RequestErr(utils.ERR_INCORRECT_OTP, "Incorrect Otp")
+		return nil, &statusCode, &errData
+	}
+	if otp.IsLocked() {
+		errCode, errData := otpLockedErr(otp)
+		return nil, errCode, errData
+	}
+
+	if !utils.CheckPasswordHash(fmt.Sprint(code), otp.CodeHash) {
+		otp.FailedAttempts += 1
+		db.Model(&otp).UpdateColumn("failed_attempts", gorm.Expr("failed_attempts + 1"))
+		if otp.FailedAttempts >= cfg.OtpMaxAttempts {
+			// Invalidate the code and lock out further attempts
+			lockedUntil := time.Now().UTC().Add(time.Duration(cfg.OtpLockoutMinutes) * time.Minute)
+			otp.LockedUntil = &lockedUntil
+			db.Model(&otp).UpdateColumns(map[string]interface{}{"code_hash": "", "locked_until": lockedUntil})
+			errCode, errData := otpLockedErr(otp)
+			return nil, errCode, errData
+		}
+		statusCode := 404
+		data := map[string]string{
+			"attempts_left": fmt.Sprint(cfg.OtpMaxAttempts - otp.FailedAttempts),
+		}
+		errData := utils.RequestErr(utils.ERR_INCORRECT_OTP, "Incorrect Otp", data)
+		return nil, &statusCode, &errData
+	}
+
+	if otp.CheckExpiration() {
+		db.Delete(&otp)
+		statusCode := 400
+		errData := utils.RequestErr(utils.ERR_EXPIRED_OTP, "Expired Otp")
+		return nil, &statusCode, &errData
+	}
+
+	// Consume the otp. If a concurrent request already did, treat this one as incorrect.
+	result := db.Delete(&otp)
+	if result.RowsAffected == 0 {
+		statusCode := 404
+		errData := utils.RequestErr(utils.ERR_INCORRECT_OTP, "Incorrect Otp")
+		return nil, &statusCode, &errData
+	}
+	return &otp, nil, nil
+}
+
+// Get the pending otp of a purpose (e.g to cancel the action it confirms)
+func (obj OtpManager) Get(db *gorm.DB, user models.User, purpose choices.OtpPurposeChoice) *models.Otp {
+	otp := models.Otp{}
+	db.Take(&otp, models.Otp{UserId: user.ID, Purpose: purpose})
+	if otp.ID == nil {
+		return nil
+	}
+	return &otp
+}
+
+func (obj OtpManager) Delete(db *gorm.DB, otp *models.Otp) {
+	db.Delete(otp)
+}
+
+func (obj OtpManager) DropData(db *gorm.DB) {
+	db.Delete(&models.Otp{})
+}
+
+// ----------------------------------
+// THROTTLE MANAGEMENT
+// --------------------------------
+type ThrottleManager struct {
+}
+
+func throttleKeys(action string, account string, ip string) map[string]int {
+	return map[string]int{
+		action + ":account:" + strings.ToLower(account): cfg.LoginLockoutThreshold,
+		action + ":ip:" + ip:                            cfg.LoginIPLockoutThreshold,
+	}
+}
+
+// Refuse an action while the account or the IP address is backing off or locked out
+func (obj ThrottleManager) Check(db *gorm.DB, action string, account string, ip string) (*int, *utils.ErrorResponse) {
+	keys := []string{}
+	for key := range throttleKeys(action, account, ip) {
+		keys = append(keys, key)
+	}
+	counters := []models.ThrottleCounter{}
+	db.Where("key IN ? AND blocked_until > ?", keys, time.Now().UTC()).Find(&counters)
+
+	var blocking *models.ThrottleCounter
+	for i, counter := range counters {
+		if blocking == nil || counter.BlockedUntil.After(*blocking.BlockedUntil) {
+			blocking = &counters[i]
+		}
+	}
+	if blocking == nil {
+		return nil, nil
+	}
+	statusCode := 429
+	retryAfter := int(time.Until(*blocking.BlockedUntil).Seconds()) + 1
+	data := map[string]string{
+		"retry_after": fmt.Sprint(retryAfter),
+	}
+	errData := utils.RequestErr(utils.ERR_TOO_MANY_ATTEMPTS, "Too many failed attempts. Try again later", data)
+	if blocking.LockedOut {
+		errData = utils.RequestErr(utils.ERR_ACCOUNT_LOCKED, "Too many failed attempts. Access is temporarily locked", data)
+	}
+	return &statusCode, &errData
+}
+
+// Record a failed attempt on the account & IP address. Each failure after the free attempts doubles
+// the wait before the next one, until the threshold locks the key out.
+// Returns true when this failure locked the account out.
+func (obj ThrottleManager) Fail(db *gorm.DB, action string, account string, ip string) bool {
+	accountLockedOut := false
+	for key, threshold := range throttleKeys(action, account, ip) {
+		if obj.fail(db, key, threshold) && strings.Contains(key, ":account:") {
+			accountLockedOut = true
+		}
+	}
+	return accountLockedOut
+}
+
+func (obj ThrottleManager) fail(db *gorm.DB, key string, threshold int) bool {
+	now := time.Now().UTC()
+	windowStart := now.Add(-time.Duration(cfg.LoginFailureWindowMinutes) * time.Minute)
+
+	// Atomically count the failure, forgetting failures older than the window
+	counter := models.ThrottleCounter{Key: key, Failures: 1, LastFailureAt: now}
+	db.Clauses(
+		clause.OnConflict{
+			Columns: []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"failures":        gorm.Expr("CASE WHEN throttle_counters.last_failure_at < ? THEN 1 ELSE throttle_counters.failures + 1 END", windowStart),
+				"locked_out":      gorm.Expr("CASE WHEN throttle_counters.last_failure_at < ? THEN false ELSE throttle_counters.locked_out END", windowStart),
+				"last_failure_at": now,
+				"updated_at":      now,
+			}),
+		},
+		clause.Returning{},
+	).Create(&counter)
+
+	var blockedUntil *time.Time
+	lockedOut := false
+	if counter.Failures >= threshold {
+		until := now.Add(time.Duration(cfg.LoginLockoutMinutes) * time.Minute)
+		blockedUntil, lockedOut = &until, true
+	} else if counter.Failures > cfg.LoginFreeAttempts {
+		delay := cfg.LoginBackoffBaseSeconds << min(counter.Failures-cfg.LoginFreeAttempts-1, 20)
+		until := now.Add(time.Duration(min(delay, cfg.LoginBackoffMaxSeconds)) * time.Second)
+		blockedUntil = &until
+	}
+	if blockedUntil == nil {
+		return false
+	}
+	justLockedOut := lockedOut && !counter.LockedOut
+	db.Model(&counter).UpdateColumns(map[string]interface{}{"blocked_until": *blockedUntil, "locked_out": lockedOut})
+	return justLockedOut
+}
+
+// Clear the account's failures after a successful attempt
+func (obj ThrottleManager) Reset(db *gorm.DB, action string, account string) {
+	db.Where(models.ThrottleCounter{Key: action + ":account:" + strings.ToLower(account)}).Delete(&models.ThrottleCounter{})
+}
+
+// ----------------------------------
+// PASSWORD MANAGEMENT
+// --------------------------------
+type PasswordManager struct {
+}
+
+// Check a new password against the policy and the user's current & previous passwords.
+// Returns the reason it is rejected (if any).
+func (obj PasswordManager) Validate(db *gorm.DB, user models.User, password string) *string {
+	if errMsg := utils.CheckPasswordPolicy(password); errMsg != nil {
+		return errMsg
+	}
+	hashes := []string{}
+	if cfg.PasswordHistoryCount > 0 {
+		db.Model(&models.PasswordHistory{}).Where(models.PasswordHistory{UserID: user.ID}).
+			Order("created_at DESC").Limit(cfg.PasswordHistoryCount).Pluck("password_hash", &hashes)
+	}
+	for _, hash := range append(hashes, user.Password) {
+		if hash != "" && utils.CheckPasswordHash(password, hash) {
+			errMsg := "You can't reuse a recent password"
+			return &errMsg
+		}
+	}
+	return nil
+}
+
+// Set a new password, keeping the old hash in the user's history
+func (obj PasswordManager) SetPassword(db *gorm.DB, user *models.User, password string) {
+	if user.Password != "" && cfg.PasswordHistoryCount > 0 {
+		db.Create(&models.PasswordHistory{UserID: user.ID, PasswordHash: user.Password})
+		// Only the last N are needed
+		staleIDs := []uuid.UUID{}
+		db.Model(&models.PasswordHistory{}).Where(models.PasswordHistory{UserID: user.ID}).
+			Order("created_at DESC").Offset(cfg.PasswordHistoryCount).Pluck("id", &staleIDs)
+		if len(staleIDs) > 0 {
+			db.Delete(&models.PasswordHistory{}, staleIDs)
+		}
+	}
+	user.Password = utils.HashPassword(password)
+	db.Model(user).Select("Password").Updates(user)
+}
+
+// ----------------------------------
+// OIDC (SOCIAL LOGIN) MANAGEMENT
+// --------------------------------
+type OidcManager struct {
+}
+
+// Start a login: the state, nonce & PKCE verifier are kept until the provider redirects back
+func (obj OidcManager) CreateLoginRequest(db *gorm.DB, deviceName *string) models.OidcLoginRequest {
+	now := time.Now().UTC()
+	db.Where("expires_at < ?", now).Delete(&models.OidcLoginRequest{})
+	loginRequest := models.OidcLoginRequest{
+		State:        utils.GetSecureToken(24),
+		Nonce:        utils.GetSecureToken(24),
+		CodeVerifier: utils.GetSecureToken(48),
+		DeviceName:   deviceName,
+		ExpiresAt:    now.Add(time.Duration(cfg.OidcLoginExpireMinutes) * time.Minute),
+	}
+	db.Create(&loginRequest)
+	return loginRequest
+}
+
+// Get and consume a login request by its state, so a callback cannot be replayed
+func (obj OidcManager) PopLoginRequest(db *gorm.DB, state string) *models.OidcLoginRequest {
+	loginRequest := models.OidcLoginRequest{}
+	db.Take(&loginRequest, models.OidcLoginRequest{State: state})
+	if loginRequest.ID == nil {
+		return nil
+	}
+	result := db.Delete(&loginRequest)
+	if result.RowsAffected == 0 || time.Now().UTC().After(loginRequest.ExpiresAt) {
+		return nil
+	}
+	return &loginRequest
+}
+
+// Get the user linked to a provider account. Otherwise link the user with the same (verified) email,
+// or create a new passwordless user.
+// An existing account whose email was never verified may have been registered by someone else,
+// so its password & sessions are dropped when linking and only the provider can sign in to it.
+func (obj OidcManager) GetOrCreateUser(db *gorm.DB, issuer string, subject string, email string, emailVerified bool, firstName string, lastName string) (*models.User, *int, *utils.ErrorResponse) {
+	user := models.User{}
+	identity := models.UserIdentity{}
+	db.Take(&identity, models.UserIdentity{Issuer: issuer, Subject: subject})
+	if identity.ID != nil {
+		db.Take(&user, models.User{BaseModel: models.BaseModel{ID: identity.UserID}})
+		return &user, nil, nil
+	}
+
+	if email == "" || !emailVerified {
+		statusCode := 401
+		errData := utils.RequestErr(utils.ERR_UNVERIFIED_USER, "Your identity provider didn't verify your email")
+		return nil, &statusCode, &errData
+	}
+	email = strings.ToLower(email)
+	db.Take(&user, models.User{Email: email})
+	if user.ID == nil {
+		user = models.User{FirstName: firstName, LastName: lastName, Email: email, IsEmailVerified: true}
+		db.Create(&user)
+	} else if !user.IsEmailVerified {
+		// The provider has verified the address for us
+		user.IsEmailVerified = true
+		user.Password = ""
+		db.Transaction(func(tx *gorm.DB) error {
+			tx.Model(&user).Select("IsEmailVerified", "Password").Updates(&user)
+			tx.Where(models.Otp{UserId: user.ID}).Delete(&models.Otp{})
+			SessionManager{}.RevokeAll(tx, user)
+			return nil
+		})
+	}
+	db.Create(&models.UserIdentity{UserID: user.ID, Issuer: issuer, Subject: subject, Email: email})
+	return &user, nil, nil
+}
+
+// ----------------------------------
+// SESSION MANAGEMENT
+// --------------------------------
+type SessionManager struct {
+}
+
+func (obj SessionManager) Create(db *gorm.DB, id uuid.UUID, user models.User, deviceName *string, userAgent string, ipAddress string, refresh string) models.Session {
+	session := models.Session{
+		BaseModel:   models.BaseModel{ID: id},
+		UserID:      user.ID,
+		DeviceName:  deviceName,
+		UserAgent:   userAgent,
+		IPAddress:   ipAddress,
+		LastSeenAt:  time.Now().UTC(),
+		RefreshHash: utils.HashToken(refresh),
+	}
+	db.Create(&session)
+	return session
+}
+
+func (obj SessionManager) GetByID(db *gorm.DB, id uuid.UUID) *models.Session {
+	session := models.Session{}
+	db.Take(&session, models.Session{BaseModel: models.BaseModel{ID: id}})
+	if session.ID == nil {
+		return nil
+	}
+	return &session
+}
+
+func (obj SessionManager) GetUserSession(db *gorm.DB, user models.User, id uuid.UUID) *models.Session {
+	session := models.Session{}
+	db.Where(models.Session{UserID: user.ID}).Take(&session, models.Session{BaseModel: models.BaseModel{ID: id}})
+	if session.ID == nil {
+		return nil
+	}
+	return &session
+}
+
+func (obj SessionManager) GetUserSessions(db *gorm.DB, user models.User) []models.Session {
+	sessions := []models.Session{}
+	db.Where(models.Session{UserID: user.ID}).Order("last_seen_at DESC").Find(&sessions)
+	return sessions
+}
+
+// Replace the session's refresh token with a new one (rotation), only if it's still the old one.
+// Returns false if another request rotated it first, so a token can't be used twice concurrently.
+func (obj SessionManager) Rotate(db *gorm.DB, session *models.Session, oldRefresh string, refresh string, userAgent string, ipAddress string) bool {
+	values := map[string]interface{}{
+		"refresh_hash": utils.HashToken(refresh),
+		"user_agent":   userAgent,
+		"ip_address":   ipAddress,
+		"last_seen_at": time.Now().UTC(),
+	}
+	result := db.Model(&models.Session{}).
+		Where("id = ? AND refresh_hash = ?", session.ID, utils.HashToken(oldRefresh)).
+		Updates(values)
+	return result.RowsAffected > 0
+}
+
+// Update the last seen time, at most once a minute to avoid a write per request
+func (obj SessionManager) Touch(db *gorm.DB, session *models.Session) {
+	now := time.Now().UTC()
+	if now.Sub(session.LastSeenAt) < time.Minute {
+		return
+	}
+	session.LastSeenAt = now
+	db.Model(session).UpdateColumn("last_seen_at", now)
+}
+
+func (obj SessionManager) Revoke(db *gorm.DB, session *models.Session) {
+	db.Delete(session)
+}
+
+// Revoke every session of the user except the one with the given ID (if any)
+func (obj SessionManager) RevokeAll(db *gorm.DB, user models.User, exceptOpts ...uuid.UUID) {
+	q := db.Where(models.Session{UserID: user.ID})
+	if len(exceptOpts) > 0 && exceptOpts[0] != nil {
+		q = q.Not("id = ?", exceptOpts[0])
+	}
+	q.Delete(&models.Session{})
+}
+
+func (obj SessionManager) DropData(db *gorm.DB) {
+	db.Delete(&models.Session{})
+}
+
+// ----------------------------------
+// MFA (TOTP) MANAGEMENT
+// --------------------------------
+type MfaManager struct {
+}
+
+// Set a new (unconfirmed) TOTP secret on the user
+func (obj MfaManager) StartTotpEnrollment(db *gorm.DB, user *models.User) string {
+	secret := utils.GenerateTotpSecret()
+	user.TotpSecret = &secret
+	user.TotpEnabled = false
+	user.TotpLastUsedStep = 0
+	db.Model(user).Select("TotpSecret", "TotpEnabled", "TotpLastUsedStep").Updates(user)
+	return secret
+}
+
+// Validate a TOTP code, consuming its time step so that it cannot be replayed
+func (obj MfaManager) VerifyTotp(db *gorm.DB, user *models.User, code string) bool {
+	if user.TotpSecret == nil {
+		return false
+	}
+	step, valid := utils.ValidateTotpCode(*user.TotpSecret, code, time.Now().UTC(), user.TotpLastUsedStep)
+	if !valid {
+		return false
+	}
+	// Conditional update guards against the same code being used concurrently
+	result := db.Model(&models.User{}).
+		Where("id = ? AND totp_last_used_step < ?", user.ID, step).
+		UpdateColumn("totp_last_used_step", step)
+	if result.RowsAffected == 0 {
+		return false
+	}
+	user.TotpLastUsedStep = step
+	return true
+}
+
+// Enable TOTP and issue a fresh set of recovery codes (plaintext codes are only returned here)
+func (obj MfaManager) EnableTotp(db *gorm.DB, user *models.User) []string {
+	user.TotpEnabled = true
+	db.Model(user).Select("TotpEnabled").Updates(user)
+	return obj.RegenerateRecoveryCodes(db, user)
+}
+
+func (obj MfaManager) DisableTotp(db *gorm.DB, user *models.User) {
+	user.TotpSecret = nil
+	user.TotpEnabled = false
+	user.TotpLastUsedStep = 0
+	db.Model(user).Select("TotpSecret", "TotpEnabled", "TotpLastUsedStep").Updates(user)
+	db.Where(models.RecoveryCode{UserID: user.ID}).Delete(&models.RecoveryCode{})
+}
+
+func (obj MfaManager) RegenerateRecoveryCodes(db *gorm.DB, user *models.User) []string {
+	db.Where(models.RecoveryCode{UserID: user.ID}).Delete(&models.RecoveryCode{})
+	codes := utils.GenerateRecoveryCodes(10)
+	recoveryCodes := []models.RecoveryCode{}
+	for _, code := range codes {
+		recoveryCodes = append(recoveryCodes, models.RecoveryCode{UserID: user.ID, Lookup: recoveryCodeLookup(code), CodeHash: utils.HashPassword(code)})
+	}
+	db.Create(&recoveryCodes)
+	return codes
+}
+
+func recoveryCodeLookup(code string) string {
+	if len(code) > 5 {
+		return code[:5]
+	}
+	return code
+}
+
+// Validate and consume a recovery code
+func (obj MfaManager) UseRecoveryCode(db *gorm.DB, user *models.User, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	recoveryCodes := []models.RecoveryCode{}
+	db.Where(models.RecoveryCode{UserID: user.ID, Lookup: recoveryCodeLookup(code)}).Where("used_at IS NULL").Find(&recoveryCodes)
+	for _, recoveryCode := range recoveryCodes {
+		if utils.CheckPasswordHash(code, recoveryCode.CodeHash) {
+			result := db.Model(&recoveryCode).Where("used_at IS NULL").UpdateColumn("used_at", time.Now().UTC())
+			return result.RowsAffected == 1
+		}
+	}
+	return false
+}
+
+// Mark a challenge token as used. Returns false if it was already used
+func (obj MfaManager) ConsumeChallenge(db *gorm.DB, jti string, expiresAt time.Time) bool {
+	db.Where("expires_at < ?", time.Now().UTC()).Delete(&models.UsedMfaChallenge{})
+	challenge := models.UsedMfaChallenge{Jti: jti, ExpiresAt: expiresAt}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&challenge).RowsAffected > 0
+}
+
+// Exchange a challenge token's use for a second factor. Both happen in one transaction, so a challenge that was
+// already used leaves the second factor untouched and a wrong code leaves the challenge usable.
+// Returns whether the challenge was unused and whether the second factor was valid.
+func (obj MfaManager) CompleteChallenge(db *gorm.DB, user *models.User, jti string, expiresAt time.Time, code *string, recoveryCode *string) (bool, bool) {
+	unused, verified := false, false
+	db.Transaction(func(tx *gorm.DB) error {
+		if unused = obj.ConsumeChallenge(tx, jti, expiresAt); !unused {
+			return nil
+		}
+		if verified = obj.VerifySecondFactor(tx, user, code, recoveryCode); !verified {
+			return errors.New("incorrect second factor") // rolls the challenge's use back
+		}
+		return nil
+	})
+	return unused, verified
+}
+
+// Accepts either a TOTP code or a recovery code
+func (obj MfaManager) VerifySecondFactor(db *gorm.DB, user *models.User, code *string, recoveryCode *string) bool {
+	if code != nil {
+		return obj.VerifyTotp(db, user, *code)
+	}
+	if recoveryCode != nil {
+		return obj.UseRecoveryCode(db, user, *recoveryCode)
+	}
+	return false
+}
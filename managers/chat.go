@@ -1,12 +1,19 @@
 package managers
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/acatalepsy17/pigeon/models"
 	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/schemas"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/pborman/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // ----------------------------------
@@ -20,23 +27,37 @@ func MessageSenderFileScope(db *gorm.DB) *gorm.DB {
 	return db.Joins("SenderObj").Joins("SenderObj.AvatarObj").Joins("FileObj")
 }
 
-func ChatPreloadMessagesScope(db *gorm.DB) *gorm.DB {
+// Only the latest message of each chat
+func ChatPreloadLatestMessageScope(db *gorm.DB) *gorm.DB {
 	return db.Preload("Messages", func(tx *gorm.DB) *gorm.DB {
-		return tx.Scopes(MessageSenderFileScope).Order("messages.created_at DESC")
+		return tx.Scopes(MessageSenderFileScope).Where(
+			"(messages.created_at, messages.id) = (SELECT m.created_at, m.id FROM messages m WHERE m.chat_id = messages.chat_id ORDER BY m.created_at DESC, m.id DESC LIMIT 1)",
+		)
 	})
 }
 
+const MaxGroupMembers = 99 // besides the owner
+
 type ChatManager struct {
 }
 
-func (obj ChatManager) GetUserChats(db *gorm.DB, user models.User) []models.Chat {
-	chats := []models.Chat{}
-	db.Model(&models.Chat{}).
-		Where(models.Chat{OwnerID: user.ID}).
-		Or("chats.id IN (?)", db.Table("chat_users").Select("chat_id").Where("user_id = ?", user.ID)).
-		Scopes(ChatOwnerImageScope, ChatPreloadMessagesScope).
-		Find(&chats)
-	return chats
+// The user's chats, for pagination with ChatPreloadLatestMessageScope. Their unread counts are set with SetUnreadCounts.
+func (obj ChatManager) GetUserChats(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.Chat{}).
+		Where(db.Where(models.Chat{OwnerID: user.ID}).
+			Or("chats.id IN (?)", db.Table("chat_users").Select("chat_id").Where("user_id = ?", user.ID))).
+		Scopes(ChatOwnerImageScope)
+}
+
+func (obj ChatManager) SetUnreadCounts(db *gorm.DB, user models.User, chats []models.Chat) {
+	chatIDs := []uuid.UUID{}
+	for _, chat := range chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
+	unreadCounts := obj.GetUnreadCounts(db, user, chatIDs)
+	for i := range chats {
+		chats[i].UnreadCount = unreadCounts[chats[i].ID.String()]
+	}
 }
 
 func (obj ChatManager) GetByID(db *gorm.DB, id uuid.UUID) models.Chat {
@@ -54,12 +75,47 @@ func (obj ChatManager) UserIsMember(chat models.Chat, targetUser models.User) bo
 	return false
 }
 
+// IDs of the chat's owner & members
+func (obj ChatManager) GetMemberIDs(db *gorm.DB, chatID uuid.UUID) []uuid.UUID {
+	memberIDs := []uuid.UUID{}
+	db.Table("chat_users").Where("chat_id = ?", chatID).Pluck("user_id", &memberIDs)
+	chat := models.Chat{}
+	db.Select("owner_id").Take(&chat, models.Chat{BaseModel: models.BaseModel{ID: chatID}})
+	if chat.OwnerID != nil {
+		memberIDs = append(memberIDs, chat.OwnerID)
+	}
+	return memberIDs
+}
+
+// IDs of everyone who shares a chat with the user
+func (obj ChatManager) GetChatPartnerIDs(db *gorm.DB, user models.User) []uuid.UUID {
+	userChats := db.Model(&models.Chat{}).Select("id").
+		Where("owner_id = ? OR id IN (?)", user.ID, db.Table("chat_users").Select("chat_id").Where("user_id = ?", user.ID))
+	partnerIDs := []uuid.UUID{}
+	db.Table("chat_users").Distinct().Where("chat_id IN (?) AND user_id <> ?", userChats, user.ID).Pluck("user_id", &partnerIDs)
+	ownerIDs := []uuid.UUID{}
+	db.Model(&models.Chat{}).Distinct().Where("id IN (?) AND owner_id <> ?", userChats, user.ID).Pluck("owner_id", &ownerIDs)
+	return append(partnerIDs, ownerIDs...)
+}
+
 func (obj ChatManager) GetDMChat(db *gorm.DB, user models.User, recipientUser models.User) models.Chat {
 	chat := models.Chat{Ctype: choices.CDM}
 	db.Where(models.Chat{OwnerID: user.ID, UserObjs: []models.User{recipientUser}}).Or(models.Chat{OwnerID: recipientUser.ID, UserObjs: []models.User{user}}).Take(&chat, chat)
 	return chat
 }
 
+// The DM between the users, whichever of them started it
+func (obj ChatManager) GetDMBetween(db *gorm.DB, user models.User, otherUser models.User) models.Chat {
+	chat := models.Chat{}
+	memberOf := func(member models.User) *gorm.DB {
+		return db.Table("chat_users").Select("chat_id").Where("user_id = ?", member.ID)
+	}
+	db.Where("ctype = ?", choices.CDM).Where(
+		db.Where("owner_id = ? AND id IN (?)", user.ID, memberOf(otherUser)).Or("owner_id = ? AND id IN (?)", otherUser.ID, memberOf(user)),
+	).Take(&chat)
+	return chat
+}
+
 func (obj ChatManager) Create(db *gorm.DB, owner models.User, ctype choices.ChatTypeChoice, recipientsOpts ...[]models.User) models.Chat {
 	chat := models.Chat{Ctype: ctype, OwnerID: owner.ID, OwnerObj: owner}
 	if len(recipientsOpts) > 0 {
@@ -69,7 +125,8 @@ func (obj ChatManager) Create(db *gorm.DB, owner models.User, ctype choices.Chat
 	return chat
 }
 
-func (obj ChatManager) CreateGroup(db *gorm.DB, owner models.User, usersToAdd []models.User, data schemas.GroupChatCreateSchema) models.Chat {
+// Create a group, along with the system message announcing it
+func (obj ChatManager) CreateGroup(db *gorm.DB, owner models.User, usersToAdd []models.User, data schemas.GroupChatCreateSchema) (models.Chat, models.Message) {
 	chat := models.Chat{
 		OwnerID:     owner.ID,
 		OwnerObj:    owner,
@@ -77,6 +134,10 @@ func (obj ChatManager) CreateGroup(db *gorm.DB, owner models.User, usersToAdd []
 		Description: data.Description,
 		Ctype:       choices.CGROUP,
 		UserObjs:    usersToAdd,
+
+		OnlyAdminsCanPost:     data.OnlyAdminsCanPost,
+		OnlyAdminsCanEditInfo: data.OnlyAdminsCanEditInfo, // nil takes the column default (true)
+		JoinApprovalRequired:  data.JoinApprovalRequired,
 	}
 
 	fileType := data.FileType
@@ -88,24 +149,36 @@ func (obj ChatManager) CreateGroup(db *gorm.DB, owner models.User, usersToAdd []
 		chat.ImageObj = &image
 	}
 	db.Omit("UserObjs.*").Create(&chat)
-	return chat
+	ownerData := models.UserDataSchema{}.Init(owner)
+	message := MessageManager{}.CreateSystem(db, chat, models.SystemMessagePayload{Event: models.SystemEventGroupCreated, Actor: &ownerData, Value: chat.Name})
+	return chat, message
 }
 
-func (obj ChatManager) GetByUsernames(db *gorm.DB, usernames []string, excludeOpts ...uuid.UUID) []models.User {
-	users := []models.User{}
-	usersQ := db.Where("username IN ?", usernames)
-	if len(excludeOpts) > 0 {
-		usersQ = usersQ.Not("id = ?", excludeOpts[0])
+// Add & remove group members. Only the owner & admins can, and only the owner can remove admins.
+// Returns the users added & removed.
+func (obj ChatManager) UsernamesToAddAndRemoveValidations(db *gorm.DB, chat *models.Chat, actor models.User, role choices.ChatRoleChoice, usernamesToAdd *[]string, usernamesToRemove *[]string) ([]models.User, []models.User, *int, *utils.ErrorResponse) {
+	if (usernamesToAdd != nil || usernamesToRemove != nil) && !IsGroupAdmin(role) {
+		data := map[string]string{}
+		if usernamesToAdd != nil {
+			data["usernames_to_add"] = "Only admins can add members"
+		}
+		if usernamesToRemove != nil {
+			data["usernames_to_remove"] = "Only admins can remove members"
+		}
+		statusCode := 403
+		errData := utils.RequestErr(utils.ERR_NOT_ALLOWED, "Not allowed", data)
+		return nil, nil, &statusCode, &errData
 	}
-	usersQ.Find(&users)
-	return users
-}
-
-func (obj ChatManager) UsernamesToAddAndRemoveValidations(db *gorm.DB, chat *models.Chat, usernamesToAdd *[]string, usernamesToRemove *[]string) (*models.Chat, *utils.ErrorResponse) {
 	originalExistingUserIDs := []uuid.UUID{}
 	for _, user := range chat.UserObjs {
 		originalExistingUserIDs = append(originalExistingUserIDs, user.ID)
 	}
+	adminIDs := []uuid.UUID{}
+	for _, member := range chat.MemberObjs {
+		if member.Role == choices.CRADMIN {
+			adminIDs = append(adminIDs, member.UserID)
+		}
+	}
 	expectedUserTotal := len(originalExistingUserIDs)
 	usersToAdd := []models.User{}
 	if usernamesToAdd != nil {
@@ -113,6 +186,14 @@ func (obj ChatManager) UsernamesToAddAndRemoveValidations(db *gorm.DB, chat *mod
 		db.Where("username IN ?", usernamesToAdd).Not(
 			db.Where("users.id = ?", chat.OwnerID).Or("users.id IN ?", originalExistingUserIDs),
 		).Joins("AvatarObj").Find(&usersToAdd)
+		if blockedUsernames := (BlockManager{}).GetBlockedUsernames(db, actor, usersToAdd); len(blockedUsernames) > 0 {
+			data := map[string]string{
+				"usernames_to_add": fmt.Sprintf("You can't add these users: %s", strings.Join(blockedUsernames, ", ")),
+			}
+			statusCode := 422
+			errData := utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data)
+			return nil, nil, &statusCode, &errData
+		}
 		expectedUserTotal += len(usersToAdd)
 	}
 	usersToRemove := []models.User{}
@@ -122,37 +203,99 @@ func (obj ChatManager) UsernamesToAddAndRemoveValidations(db *gorm.DB, chat *mod
 			data := map[string]string{
 				"usernames_to_remove": "No users to remove",
 			}
+			statusCode := 422
 			errData := utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data)
-			return nil, &errData
+			return nil, nil, &statusCode, &errData
+		}
+		db.Where("username IN ?", usernamesToRemove).Where("users.id IN ?", originalExistingUserIDs).Where("users.id <> ?", chat.OwnerID).
+			Joins("AvatarObj").Find(&usersToRemove)
+		if role != choices.CROWNER {
+			adminUsernames := []string{}
+			for _, user := range usersToRemove {
+				for _, adminID := range adminIDs {
+					if user.ID.String() == adminID.String() {
+						adminUsernames = append(adminUsernames, user.Username)
+					}
+				}
+			}
+			if len(adminUsernames) > 0 {
+				data := map[string]string{
+					"usernames_to_remove": fmt.Sprintf("Only the owner can remove admins: %s", strings.Join(adminUsernames, ", ")),
+				}
+				statusCode := 403
+				errData := utils.RequestErr(utils.ERR_NOT_ALLOWED, "Not allowed", data)
+				return nil, nil, &statusCode, &errData
+			}
 		}
-		db.Where("username IN ?", usernamesToRemove).Where("id IN ?", originalExistingUserIDs).Where("id <> ?", chat.OwnerID).Find(&usersToRemove)
 		expectedUserTotal -= len(usersToRemove)
 	}
-	if expectedUserTotal > 99 {
+	if expectedUserTotal > MaxGroupMembers {
 		data := map[string]string{
-			"usernames_to_add": "99 users limit reached",
+			"usernames_to_add": fmt.Sprintf("%d users limit reached", MaxGroupMembers),
 		}
+		statusCode := 422
 		errData := utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data)
-		return nil, &errData
+		return nil, nil, &statusCode, &errData
 	}
 	db.Model(&chat).Omit("UserObjs.*").Association("UserObjs").Append(&usersToAdd)
 	db.Model(&chat).Association("UserObjs").Delete(&usersToRemove)
-	return chat, nil
+	return usersToAdd, usersToRemove, nil, nil
 }
 
-func (obj ChatManager) UpdateGroup(db *gorm.DB, chat *models.Chat, data schemas.GroupChatInputSchema) (*models.Chat, *utils.ErrorResponse) {
+// Update a group as a member with the role given. Returns the system messages describing the changes & the members removed.
+func (obj ChatManager) UpdateGroup(db *gorm.DB, chat *models.Chat, actor models.User, role choices.ChatRoleChoice, data schemas.GroupChatInputSchema) (*models.Chat, []models.Message, []models.User, *int, *utils.ErrorResponse) {
+	changesInfo := data.Name != nil || data.Description != nil || data.FileType != nil
+	if changesInfo && (chat.OnlyAdminsCanEditInfo == nil || *chat.OnlyAdminsCanEditInfo) && !IsGroupAdmin(role) {
+		statusCode := 403
+		errData := utils.RequestErr(utils.ERR_NOT_ALLOWED, "Only admins can change this group's info")
+		return nil, nil, nil, &statusCode, &errData
+	}
+	if data.OnlyAdminsCanPost != nil || data.OnlyAdminsCanEditInfo != nil || data.JoinApprovalRequired != nil {
+		if !IsGroupAdmin(role) {
+			statusCode := 403
+			errData := utils.RequestErr(utils.ERR_NOT_ALLOWED, "Only admins can change this group's settings")
+			return nil, nil, nil, &statusCode, &errData
+		}
+		if data.OnlyAdminsCanPost != nil {
+			chat.OnlyAdminsCanPost = *data.OnlyAdminsCanPost
+		}
+		if data.OnlyAdminsCanEditInfo != nil {
+			chat.OnlyAdminsCanEditInfo = data.OnlyAdminsCanEditInfo
+		}
+		if data.JoinApprovalRequired != nil {
+			chat.JoinApprovalRequired = *data.JoinApprovalRequired
+		}
+	}
+	actorData := models.UserDataSchema{}.Init(actor)
+	events := []models.SystemMessagePayload{}
 	if data.Name != nil {
+		if chat.Name == nil || *chat.Name != *data.Name {
+			events = append(events, models.SystemMessagePayload{Event: models.SystemEventGroupRenamed, Actor: &actorData, Value: data.Name})
+		}
 		chat.Name = data.Name
 	}
 	if data.Description != nil {
+		if chat.Description == nil || *chat.Description != *data.Description {
+			events = append(events, models.SystemMessagePayload{Event: models.SystemEventDescriptionChanged, Actor: &actorData})
+		}
 		chat.Description = data.Description
 	}
+	if data.FileType != nil {
+		events = append(events, models.SystemMessagePayload{Event: models.SystemEventImageChanged, Actor: &actorData})
+	}
 
 	// Handle users upload or remove
-	var errData *utils.ErrorResponse
-	chat, errData = obj.UsernamesToAddAndRemoveValidations(db, chat, data.UsernamesToAdd, data.UsernamesToRemove)
-	if errData != nil {
-		return nil, errData
+	usersAdded, usersRemoved, errCode, errData := obj.UsernamesToAddAndRemoveValidations(db, chat, actor, role, data.UsernamesToAdd, data.UsernamesToRemove)
+	if errCode != nil {
+		return nil, nil, nil, errCode, errData
+	}
+	for _, user := range usersAdded {
+		target := models.UserDataSchema{}.Init(user)
+		events = append(events, models.SystemMessagePayload{Event: models.SystemEventMemberAdded, Actor: &actorData, Target: &target})
+	}
+	for _, user := range usersRemoved {
+		target := models.UserDataSchema{}.Init(user)
+		events = append(events, models.SystemMessagePayload{Event: models.SystemEventMemberRemoved, Actor: &actorData, Target: &target})
 	}
 	// Handle file upload
 	if data.FileType != nil {
@@ -162,7 +305,12 @@ func (obj ChatManager) UpdateGroup(db *gorm.DB, chat *models.Chat, data schemas.
 		chat.ImageObj = &image
 	}
 	db.Omit("UserObjs.*").Save(&chat)
-	return chat, errData
+
+	messages := []models.Message{}
+	for _, payload := range events {
+		messages = append(messages, MessageManager{}.CreateSystem(db, *chat, payload))
+	}
+	return chat, messages, usersRemoved, nil, nil
 }
 
 func (obj ChatManager) GetSingleUserChat(db *gorm.DB, user models.User, id uuid.UUID) models.Chat {
@@ -177,8 +325,9 @@ func (obj ChatManager) GetSingleUserChatFullDetails(db *gorm.DB, user models.Use
 	chat := models.Chat{} // Wahala wa o
 	db.Model(&models.Chat{}).Where("chats.id = ?", id).Where(db.Where(models.Chat{OwnerID: user.ID}).
 		Or("chats.id IN (?)", db.Table("chat_users").Select("chat_id").Where("user_id = ?", user.ID))).
-		Scopes(ChatOwnerImageScope, ChatPreloadMessagesScope).
+		Scopes(ChatOwnerImageScope, ChatPreloadLatestMessageScope).
 		Preload("UserObjs").
+		Preload("MemberObjs").
 		Take(&chat)
 	return chat
 }
@@ -193,6 +342,179 @@ func (obj ChatManager) GetUserGroup(db *gorm.DB, user models.User, id uuid.UUID,
 	return chat
 }
 
+// A group chat the user is the owner or a member of, with the user's role
+func (obj ChatManager) GetMemberGroup(db *gorm.DB, user models.User, id uuid.UUID, detailedOpts ...bool) (models.Chat, choices.ChatRoleChoice) {
+	chat := models.Chat{}
+	q := db.Model(&models.Chat{}).Where("chats.id = ? AND chats.ctype = ?", id, choices.CGROUP).
+		Where(db.Where(models.Chat{OwnerID: user.ID}).
+			Or("chats.id IN (?)", db.Table("chat_users").Select("chat_id").Where("user_id = ?", user.ID))).
+		Preload("MemberObjs")
+	if len(detailedOpts) > 0 {
+		q = q.Scopes(ChatOwnerImageScope).Preload("UserObjs").Preload("UserObjs.AvatarObj")
+	}
+	q.Take(&chat)
+	if chat.ID == nil {
+		return chat, ""
+	}
+	return chat, obj.GetRole(db, chat, user)
+}
+
+// The user's role in a chat. Empty if they aren't a member.
+func (obj ChatManager) GetRole(db *gorm.DB, chat models.Chat, user models.User) choices.ChatRoleChoice {
+	if chat.OwnerID.String() == user.ID.String() {
+		return choices.CROWNER
+	}
+	member := models.ChatUser{}
+	db.Where("chat_id = ? AND user_id = ?", chat.ID, user.ID).Take(&member)
+	return member.Role
+}
+
+func IsGroupAdmin(role choices.ChatRoleChoice) bool {
+	return role == choices.CROWNER || role == choices.CRADMIN
+}
+
+func (obj ChatManager) SetRole(db *gorm.DB, chat models.Chat, member models.User, role choices.ChatRoleChoice) {
+	db.Model(&models.ChatUser{}).Where("chat_id = ? AND user_id = ?", chat.ID, member.ID).Update("role", role)
+}
+
+func (obj ChatManager) Leave(db *gorm.DB, chat models.Chat, user models.User) {
+	db.Where("chat_id = ? AND user_id = ?", chat.ID, user.ID).Delete(&models.ChatUser{})
+}
+
+// Make a member the owner. The previous owner stays on as an admin.
+func (obj ChatManager) TransferOwnership(db *gorm.DB, chat *models.Chat, newOwner models.User) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("chat_id = ? AND user_id = ?", chat.ID, newOwner.ID).Delete(&models.ChatUser{}).Error; err != nil {
+			return err
+		}
+		previousOwner := models.ChatUser{ChatID: chat.ID, UserID: chat.OwnerID, Role: choices.CRADMIN}
+		if err := tx.Create(&previousOwner).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Chat{}).Where("id = ?", chat.ID).Update("owner_id", newOwner.ID).Error
+	})
+	if err == nil {
+		chat.OwnerID = newOwner.ID
+		chat.OwnerObj = newOwner
+	}
+	return err
+}
+
+// Add a member to a group, with the invite they joined by if any. Returns false if they already were one.
+// The chat is locked while its members are counted, so concurrent joins can't go past the limit.
+// The invite's use is only counted along with the join.
+func (obj ChatManager) Join(db *gorm.DB, chat models.Chat, user models.User, inviteOpts ...models.ChatInvite) (bool, *int, *utils.ErrorResponse) {
+	joined := false
+	var statusCode int
+	var errData utils.ErrorResponse
+	db.Transaction(func(tx *gorm.DB) error {
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Take(&models.Chat{}, "id = ?", chat.ID)
+		if obj.GetMembersCount(tx, chat.ID) >= MaxGroupMembers {
+			statusCode = 422
+			errData = utils.RequestErr(utils.ERR_INVALID_ENTRY, "This group is full")
+			return nil
+		}
+		member := models.ChatUser{ChatID: chat.ID, UserID: user.ID, Role: choices.CRMEMBER}
+		joined = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).RowsAffected > 0
+		if joined && len(inviteOpts) > 0 && !obj.UseInvite(tx, inviteOpts[0]) {
+			joined = false
+			statusCode = 404
+			errData = utils.RequestErr(utils.ERR_NON_EXISTENT, "Invalid or expired invite link")
+			return errors.New("invite not usable") // rolls the join back
+		}
+		return nil
+	})
+	if statusCode != 0 {
+		return false, &statusCode, &errData
+	}
+	return joined, nil, nil
+}
+
+// Members of a group besides the owner
+func (obj ChatManager) GetMembersCount(db *gorm.DB, chatID uuid.UUID) int64 {
+	var membersCount int64
+	db.Model(&models.ChatUser{}).Where("chat_id = ?", chatID).Count(&membersCount)
+	return membersCount
+}
+
+func ChatInviteCreatorScope(db *gorm.DB) *gorm.DB {
+	return db.Joins("CreatorObj").Joins("CreatorObj.AvatarObj")
+}
+
+func (obj ChatManager) CreateInvite(db *gorm.DB, chat models.Chat, creator models.User, data schemas.GroupInviteCreateSchema) models.ChatInvite {
+	invite := models.ChatInvite{
+		ChatID:     chat.ID,
+		CreatorID:  creator.ID,
+		CreatorObj: creator,
+		Token:      utils.GetSecureToken(16),
+		ExpiresAt:  data.ExpiresAt,
+		MaxUses:    data.MaxUses,
+	}
+	db.Create(&invite)
+	return invite
+}
+
+// The group's invites that haven't been revoked, newest first
+func (obj ChatManager) GetInvites(db *gorm.DB, chatID uuid.UUID) []models.ChatInvite {
+	invites := []models.ChatInvite{}
+	db.Scopes(ChatInviteCreatorScope).Where("chat_invites.chat_id = ? AND chat_invites.revoked_at IS NULL", chatID).
+		Order("chat_invites.created_at DESC").Find(&invites)
+	return invites
+}
+
+// Returns false if the group has no such invite or it was already revoked
+func (obj ChatManager) RevokeInvite(db *gorm.DB, chatID uuid.UUID, inviteID uuid.UUID) bool {
+	result := db.Model(&models.ChatInvite{}).Where("id = ? AND chat_id = ? AND revoked_at IS NULL", inviteID, chatID).
+		Update("revoked_at", time.Now())
+	return result.RowsAffected > 0
+}
+
+// A usable invite (not revoked, expired or used up) with its group
+func (obj ChatManager) GetUsableInvite(db *gorm.DB, token string) models.ChatInvite {
+	invite := models.ChatInvite{}
+	db.Joins("ChatObj").Where("chat_invites.token = ? AND chat_invites.revoked_at IS NULL", token).
+		Where("chat_invites.max_uses IS NULL OR chat_invites.uses < chat_invites.max_uses").
+		Where("chat_invites.expires_at IS NULL OR chat_invites.expires_at > ?", time.Now()).
+		Take(&invite)
+	return invite
+}
+
+// Count a use of the invite. Returns false if it got revoked, expired or used up in the meantime.
+func (obj ChatManager) UseInvite(db *gorm.DB, invite models.ChatInvite) bool {
+	result := db.Model(&models.ChatInvite{}).Where("id = ? AND revoked_at IS NULL", invite.ID).
+		Where("max_uses IS NULL OR uses < max_uses").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Update("uses", gorm.Expr("uses + 1"))
+	return result.RowsAffected > 0
+}
+
+func ChatJoinRequestUserScope(db *gorm.DB) *gorm.DB {
+	return db.Joins("UserObj").Joins("UserObj.AvatarObj")
+}
+
+func (obj ChatManager) GetJoinRequest(db *gorm.DB, chatID uuid.UUID, user models.User) models.ChatJoinRequest {
+	request := models.ChatJoinRequest{}
+	db.Where("chat_id = ? AND user_id = ?", chatID, user.ID).Take(&request)
+	return request
+}
+
+func (obj ChatManager) CreateJoinRequest(db *gorm.DB, invite models.ChatInvite, user models.User) models.ChatJoinRequest {
+	request := models.ChatJoinRequest{ChatID: invite.ChatID, UserID: user.ID, UserObj: user, InviteID: &invite.ID}
+	db.Create(&request)
+	return request
+}
+
+// The group's pending join requests, for the paginator
+func (obj ChatManager) GetJoinRequestsQueryset(db *gorm.DB, chatID uuid.UUID) *gorm.DB {
+	return db.Model(&models.ChatJoinRequest{}).Scopes(ChatJoinRequestUserScope).Where("chat_join_requests.chat_id = ?", chatID)
+}
+
+func (obj ChatManager) GetJoinRequestByID(db *gorm.DB, chatID uuid.UUID, id uuid.UUID) models.ChatJoinRequest {
+	request := models.ChatJoinRequest{}
+	db.Scopes(ChatJoinRequestUserScope).Where("chat_join_requests.id = ? AND chat_join_requests.chat_id = ?", id, chatID).Take(&request)
+	return request
+}
+
 func (obj ChatManager) GetMessagesCount(db *gorm.DB, chatID uuid.UUID) int64 {
 	var messagesCount int64
 	db.Model(&models.Message{ChatID: chatID}).Count(&messagesCount)
@@ -203,6 +525,119 @@ func (obj ChatManager) DropData(db *gorm.DB) {
 	db.Delete(models.Chat{})
 }
 
+// ----------------------------------
+// READ CURSOR MANAGEMENT
+// --------------------------------
+
+// Number of messages from others the user hasn't read, by chat ID
+func (obj ChatManager) GetUnreadCounts(db *gorm.DB, user models.User, chatIDs []uuid.UUID) map[string]int64 {
+	unreadCounts := map[string]int64{}
+	if len(chatIDs) == 0 {
+		return unreadCounts
+	}
+	rows := []struct {
+		ChatID uuid.UUID
+		Count  int64
+	}{}
+	db.Model(&models.Message{}).
+		Select("messages.chat_id, COUNT(*) AS count").
+		Joins("LEFT JOIN chat_read_cursors ON chat_read_cursors.chat_id = messages.chat_id AND chat_read_cursors.user_id = ?", user.ID).
+		Where("messages.chat_id IN ? AND messages.sender_id <> ?", chatIDs, user.ID).
+		Where("chat_read_cursors.last_read_at IS NULL OR messages.created_at > chat_read_cursors.last_read_at").
+		Group("messages.chat_id").
+		Scan(&rows)
+	for _, row := range rows {
+		unreadCounts[row.ChatID.String()] = row.Count
+	}
+	return unreadCounts
+}
+
+func (obj ChatManager) GetReadCursors(db *gorm.DB, chatID uuid.UUID) []models.ChatReadCursor {
+	cursors := []models.ChatReadCursor{}
+	db.Joins("UserObj").Joins("UserObj.AvatarObj").Where("chat_read_cursors.chat_id = ?", chatID).Find(&cursors)
+	return cursors
+}
+
+// Move the user's read cursor up to the message. Returns false (and the current cursor)
+// if it was already there or past it, as cursors never move back.
+func (obj ChatManager) MarkRead(db *gorm.DB, user models.User, message models.Message) (models.ChatReadCursor, bool) {
+	now := time.Now()
+	readAt := message.CreatedAt
+	cursor := models.ChatReadCursor{ChatID: message.ChatID, UserID: user.ID, LastReadMessageID: &message.ID, LastReadAt: &readAt, LastDeliveredAt: &readAt}
+	result := db.Clauses(
+		clause.OnConflict{
+			Columns: []clause.Column{{Name: "chat_id"}, {Name: "user_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"last_read_message_id": message.ID,
+				"last_read_at":         readAt,
+				"last_delivered_at":    gorm.Expr("GREATEST(chat_read_cursors.last_delivered_at, ?)", readAt),
+				"updated_at":           now,
+			}),
+			Where: clause.Where{Exprs: []clause.Expression{
+				gorm.Expr("chat_read_cursors.last_read_at IS NULL OR chat_read_cursors.last_read_at < ?", readAt),
+			}},
+		},
+		clause.Returning{},
+	).Create(&cursor)
+	if result.RowsAffected == 0 {
+		cursor = models.ChatReadCursor{}
+		db.Take(&cursor, models.ChatReadCursor{ChatID: message.ChatID, UserID: user.ID})
+		return cursor, false
+	}
+	return cursor, true
+}
+
+// Record that the user has received every message so far in the chats
+func (obj ChatManager) MarkDelivered(db *gorm.DB, user models.User, chatIDs []uuid.UUID) {
+	if len(chatIDs) == 0 {
+		return
+	}
+	now := time.Now()
+	cursors := []models.ChatReadCursor{}
+	for _, chatID := range chatIDs {
+		cursors = append(cursors, models.ChatReadCursor{ChatID: chatID, UserID: user.ID, LastDeliveredAt: &now})
+	}
+	db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "chat_id"}, {Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"last_delivered_at": now, "updated_at": now}),
+	}).Create(&cursors)
+}
+
+// Set the status of the user's own messages: read once every other member has read them,
+// delivered once every other member has received them, otherwise sent.
+func (obj ChatManager) SetMessageStatuses(chat models.Chat, user models.User, messages []models.Message, cursors []models.ChatReadCursor) {
+	memberIDs := []string{chat.OwnerID.String()}
+	for _, member := range chat.UserObjs {
+		memberIDs = append(memberIDs, member.ID.String())
+	}
+	cursorsByUser := map[string]models.ChatReadCursor{}
+	for _, cursor := range cursors {
+		cursorsByUser[cursor.UserID.String()] = cursor
+	}
+
+	for i := range messages {
+		if messages[i].SenderID == nil || messages[i].SenderID.String() != user.ID.String() {
+			continue
+		}
+		createdAt := messages[i].CreatedAt
+		status := choices.MSREAD
+		for _, memberID := range memberIDs {
+			if memberID == user.ID.String() {
+				continue
+			}
+			cursor := cursorsByUser[memberID]
+			if cursor.LastDeliveredAt == nil || cursor.LastDeliveredAt.Before(createdAt) {
+				status = choices.MSSENT
+				break
+			}
+			if cursor.LastReadAt == nil || cursor.LastReadAt.Before(createdAt) {
+				status = choices.MSDELIVERED
+			}
+		}
+		messages[i].Status = &status
+	}
+}
+
 // ----------------------------------
 // MESSAGE MANAGEMENT
 // --------------------------------
@@ -211,11 +646,22 @@ func MessageSenderScope(db *gorm.DB) *gorm.DB {
 	return db.Joins("SenderObj").Joins("SenderObj.AvatarObj").Joins("ChatObj").Joins("FileObj")
 }
 
+// The message replied to, for quoting
+func MessageParentScope(db *gorm.DB) *gorm.DB {
+	return db.Preload("ParentObj", func(tx *gorm.DB) *gorm.DB {
+		return tx.Scopes(MessageSenderFileScope)
+	})
+}
+
 type MessageManager struct {
 }
 
-func (obj MessageManager) Create(db *gorm.DB, sender models.User, chat models.Chat, text *string, fileType *string) models.Message {
-	message := models.Message{SenderID: sender.ID, SenderObj: sender, ChatID: chat.ID, ChatObj: chat, Text: text}
+func (obj MessageManager) Create(db *gorm.DB, sender models.User, chat models.Chat, text *string, fileType *string, parent *models.Message) models.Message {
+	message := models.Message{SenderID: &sender.ID, SenderObj: sender, ChatID: chat.ID, ChatObj: chat, Text: text}
+	if parent != nil {
+		message.ParentID = &parent.ID
+		message.ParentObj = parent
+	}
 	if fileType != nil {
 		file := models.File{ResourceType: *fileType}
 		db.Create(&file)
@@ -226,9 +672,18 @@ func (obj MessageManager) Create(db *gorm.DB, sender models.User, chat models.Ch
 	return message
 }
 
+// A message from the app itself about something that happened in the chat
+func (obj MessageManager) CreateSystem(db *gorm.DB, chat models.Chat, payload models.SystemMessagePayload) models.Message {
+	chat.UserObjs = nil // saving the chat after the message shouldn't touch its members
+	message := models.Message{Kind: choices.MKSYSTEM, ChatID: chat.ID, ChatObj: chat, Payload: &payload}
+	db.Create(&message)
+	return message
+}
+
 func (obj MessageManager) GetUserMessage(db *gorm.DB, user models.User, id uuid.UUID) models.Message {
-	message := models.Message{SenderID: user.ID}
-	db.Scopes(MessageSenderScope).Take(&message, models.Message{BaseModel: models.BaseModel{ID: id}})
+	message := models.Message{}
+	db.Scopes(MessageSenderScope, MessageParentScope).Where("messages.sender_id = ?", user.ID).
+		Take(&message, models.Message{BaseModel: models.BaseModel{ID: id}})
 	return message
 }
 
@@ -248,10 +703,137 @@ func (obj MessageManager) Update(db *gorm.DB, message models.Message, text *stri
 
 func (obj MessageManager) GetByID(db *gorm.DB, id uuid.UUID) models.Message {
 	message := models.Message{}
-	db.Scopes(MessageSenderScope).Take(&message, models.Message{BaseModel: models.BaseModel{ID: id}})
+	db.Scopes(MessageSenderScope, MessageParentScope).Take(&message, models.Message{BaseModel: models.BaseModel{ID: id}})
 	return message
 }
 
+// A page of the chat's messages, newest first, using keyset pagination on (created_at, id).
+// With a cursor message, the page has the messages before (older than) it, after (newer than) it,
+// or around it (the cursor included, with about half the page on each side).
+// Also returns whether there are older & newer messages beyond the page.
+func (obj MessageManager) GetChatMessages(db *gorm.DB, chatID uuid.UUID, direction string, cursor *models.Message, limit int) ([]models.Message, bool, bool) {
+	return obj.getPage(db.Where("messages.chat_id = ?", chatID), direction, cursor, limit)
+}
+
+// A page of the replies to a message (its thread), paginated like GetChatMessages
+func (obj MessageManager) GetReplies(db *gorm.DB, parentID uuid.UUID, direction string, cursor *models.Message, limit int) ([]models.Message, bool, bool) {
+	return obj.getPage(db.Where("messages.parent_id = ?", parentID), direction, cursor, limit)
+}
+
+func (obj MessageManager) getPage(filtered *gorm.DB, direction string, cursor *models.Message, limit int) ([]models.Message, bool, bool) {
+	fetch := func(count int, comparison string, order string) ([]models.Message, bool) {
+		messages := []models.Message{}
+		query := filtered.Session(&gorm.Session{}).Scopes(MessageSenderFileScope, MessageParentScope)
+		if cursor != nil {
+			query = query.Where("(messages.created_at, messages.id) "+comparison+" (?, ?)", cursor.CreatedAt, cursor.ID)
+		}
+		query.Order("messages.created_at " + order + ", messages.id " + order).Limit(count + 1).Find(&messages)
+		if len(messages) > count {
+			return messages[:count], true
+		}
+		return messages, false
+	}
+	newestFirst := func(messages []models.Message) []models.Message {
+		slices.Reverse(messages)
+		return messages
+	}
+
+	switch direction {
+	case "before":
+		messages, hasOlder := fetch(limit, "<", "DESC")
+		return messages, hasOlder, true
+	case "after":
+		messages, hasNewer := fetch(limit, ">", "ASC")
+		return newestFirst(messages), true, hasNewer
+	case "around":
+		olderCount := limit / 2
+		newer, hasNewer := fetch(limit-olderCount, ">=", "ASC")
+		older, hasOlder := fetch(olderCount, "<", "DESC")
+		return append(newestFirst(newer), older...), hasOlder, hasNewer
+	}
+	messages, hasOlder := fetch(limit, "", "DESC")
+	return messages, hasOlder, false
+}
+
+// Set the number of replies of each message
+func (obj MessageManager) SetRepliesCounts(db *gorm.DB, messages []models.Message) {
+	messageIDs := []uuid.UUID{}
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+	}
+	if len(messageIDs) == 0 {
+		return
+	}
+	rows := []struct {
+		ParentID uuid.UUID
+		Count    int64
+	}{}
+	db.Model(&models.Message{}).
+		Select("parent_id, COUNT(*) AS count").
+		Where("parent_id IN ?", messageIDs).
+		Group("parent_id").
+		Scan(&rows)
+	repliesCounts := map[string]int64{}
+	for _, row := range rows {
+		repliesCounts[row.ParentID.String()] = row.Count
+	}
+	for i := range messages {
+		messages[i].RepliesCount = repliesCounts[messages[i].ID.String()]
+	}
+}
+
+// Set the count of each reaction type on the messages, and the user's own reactions
+func (obj MessageManager) SetReactions(db *gorm.DB, user models.User, messages []models.Message) {
+	messageIDs := []uuid.UUID{}
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+	}
+	if len(messageIDs) == 0 {
+		return
+	}
+	rows := []struct {
+		MessageID uuid.UUID
+		Rtype     choices.ReactionChoice
+		Count     int64
+		Reacted   bool
+	}{}
+	db.Model(&models.Reaction{}).
+		Select("message_id, rtype, COUNT(*) AS count, BOOL_OR(user_id = ?) AS reacted", user.ID).
+		Where("message_id IN ?", messageIDs).
+		Group("message_id, rtype").
+		Scan(&rows)
+	for i := range messages {
+		messages[i].Reactions = map[choices.ReactionChoice]int64{}
+		messages[i].UserReaction = nil
+		for _, row := range rows {
+			if row.MessageID.String() != messages[i].ID.String() {
+				continue
+			}
+			messages[i].Reactions[row.Rtype] = row.Count
+			if row.Reacted {
+				rtype := row.Rtype
+				messages[i].UserReaction = &rtype
+			}
+		}
+	}
+}
+
+// Add the user's reaction to the message, or change it as there's one per user
+func (obj MessageManager) React(db *gorm.DB, user models.User, message models.Message, rtype choices.ReactionChoice) models.Reaction {
+	reaction := models.Reaction{UserID: user.ID, UserObj: user, MessageID: &message.ID, Rtype: rtype}
+	db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "message_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"rtype": rtype, "updated_at": time.Now()}),
+	}).Create(&reaction)
+	return reaction
+}
+
+// Remove the user's reaction to the message. Returns false if there was none.
+func (obj MessageManager) Unreact(db *gorm.DB, user models.User, message models.Message) bool {
+	result := db.Where("user_id = ? AND message_id = ?", user.ID, message.ID).Delete(&models.Reaction{})
+	return result.RowsAffected > 0
+}
+
 func (obj MessageManager) DropData(db *gorm.DB) {
 	db.Delete(&models.Message{})
 }
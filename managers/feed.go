@@ -2,6 +2,8 @@ package managers
 
 import (
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/acatalepsy17/pigeon/models"
 	"github.com/acatalepsy17/pigeon/models/choices"
@@ -28,25 +30,33 @@ func AuthorReactionScope(db *gorm.DB) *gorm.DB {
 type PostManager struct {
 }
 
-func (obj PostManager) All(db *gorm.DB) []models.Post {
-	posts := []models.Post{}
-	db.Scopes(AuthorReactionScope).Joins("ImageObj").Preload("Comments").Find(&posts).Order("created_at DESC")
-	return posts
+// All posts, for pagination with PostCountsPreloadScope
+func (obj PostManager) All(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.Post{}).Scopes(AuthorAvatarScope).Joins("ImageObj")
+}
+
+// Reactions & comments of posts, which they are counted from
+func PostCountsPreloadScope(db *gorm.DB) *gorm.DB {
+	return db.Preload("Reactions").Preload("Comments")
 }
 
-func (obj PostManager) Create(db *gorm.DB, author models.User, postData schemas.PostInputSchema) models.Post {
+// Creates a post for its audience, or the author's default audience if it has none. The audience users are for a CUSTOM audience.
+func (obj PostManager) Create(db *gorm.DB, author models.User, postData schemas.PostInputSchema, audienceUsers []models.User) models.Post {
 	id := uuid.Parse(uuid.New())
 	// Create slug
 	slug := slug.Make(fmt.Sprintf("%s %s %s", author.FirstName, author.LastName, id))
 	base := models.BaseModel{ID: id}
 	sub_base := models.FeedAbstract{BaseModel: base, Slug: slug, AuthorObj: author, AuthorID: author.ID, Text: postData.Text}
 
-	post := models.Post{FeedAbstract: sub_base}
+	post := models.Post{FeedAbstract: sub_base, Audience: author.DefaultPostAudience, AudienceUsers: audienceUsers}
+	if postData.Audience != nil {
+		post.Audience = *postData.Audience
+	}
 	if postData.FileType != nil {
 		file := models.File{ResourceType: *postData.FileType}
 		post.ImageObj = &file
 	}
-	db.Create(&post)
+	db.Omit("AudienceUsers.*").Create(&post)
 	return post
 }
 
@@ -65,21 +75,197 @@ func (obj PostManager) GetBySlug(db *gorm.DB, slug string, opts ...bool) (*model
 	return &post, nil, nil
 }
 
-func (obj PostManager) Update(db *gorm.DB, post *models.Post, postData schemas.PostInputSchema) *models.Post {
+// Updates a post, and its audience if set. The audience users are for a CUSTOM audience.
+func (obj PostManager) Update(db *gorm.DB, post *models.Post, postData schemas.PostInputSchema, audienceUsers []models.User) *models.Post {
 	if postData.FileType != nil {
 		// Create or Update Image Object
 		image := models.File{ResourceType: *postData.FileType}.UpdateOrCreate(db, post.ImageID)
 		post.ImageObj = &image
 	}
 	post.Text = postData.Text
+	if postData.Audience != nil {
+		post.Audience = *postData.Audience
+	}
 	db.Omit(clause.Associations).Save(&post)
+	if postData.Audience != nil {
+		post.AudienceUsers = audienceUsers
+		db.Model(post).Omit("AudienceUsers.*").Association("AudienceUsers").Replace(audienceUsers)
+	}
 	return post
 }
 
+// The condition of the posts the user can see: their own, PUBLIC posts (of private accounts, only if they
+// follow or are friends with the author), FRIENDS posts of their friends and CUSTOM posts they were chosen for
+func (obj PostManager) audienceCondition(db *gorm.DB, user models.User) *gorm.DB {
+	privateAuthorIDs := db.Model(&models.User{}).Select("id").Where("approve_followers = ?", true)
+	public := db.Where("posts.author_id NOT IN (?)", privateAuthorIDs).
+		Or("posts.author_id IN (?)", FollowManager{}.followeeIDsQuery(db, user)).
+		Or("posts.author_id IN (?)", FriendManager{}.friendIDsQuery(db, user))
+	return db.Where("posts.author_id = ?", user.ID).
+		Or(db.Where("posts.audience = ?", choices.PAPUBLIC).Where(public)).
+		Or("posts.audience = ? AND posts.author_id IN (?)", choices.PAFRIENDS, FriendManager{}.friendIDsQuery(db, user)).
+		Or("posts.audience = ? AND posts.id IN (?)", choices.PACUSTOM, db.Table("post_audience_users").Select("post_id").Where("user_id = ?", user.ID))
+}
+
+// Leaves out the posts the user isn't in the audience of
+func (obj PostManager) ExcludeInvisible(db *gorm.DB, query *gorm.DB, user models.User) *gorm.DB {
+	return query.Where(obj.audienceCondition(db, user))
+}
+
+// IDs of the posts the user can see: those they're in the audience of, by users they didn't block and weren't blocked by
+func (obj PostManager) visibleIDsQuery(db *gorm.DB, user models.User) *gorm.DB {
+	query := db.Model(&models.Post{}).Select("posts.id").Where(obj.audienceCondition(db, user))
+	return BlockManager{}.ExcludeBlocked(db, query, user, "posts.author_id")
+}
+
+// Whether the post, comment or reply is hidden from the user, as if it didn't exist: because they aren't in the
+// audience of the post it's (under), or because of a block between them and its author or the author of what it's under
+func (obj PostManager) IsHidden(db *gorm.DB, user models.User, post *models.Post, comment *models.Comment, reply *models.Reply) bool {
+	authorIDs := []uuid.UUID{}
+	if reply != nil {
+		authorIDs = append(authorIDs, reply.AuthorID)
+		comment = &models.Comment{}
+		db.Select("author_id", "post_id").Where("id = ?", reply.CommentID).Take(comment)
+	}
+	if comment != nil {
+		authorIDs = append(authorIDs, comment.AuthorID)
+		post = &models.Post{}
+		db.Select("id", "author_id").Where("id = ?", comment.PostID).Take(post)
+	}
+	authorIDs = append(authorIDs, post.AuthorID)
+	if (BlockManager{}).IsBlocked(db, user, authorIDs...) {
+		return true
+	}
+	var count int64
+	obj.ExcludeInvisible(db, db.Model(&models.Post{}).Where("posts.id = ?", post.ID), user).Count(&count)
+	return count == 0
+}
+
+// The usernames of a CUSTOM audience, for its author
+func (obj PostManager) GetAudienceUsernames(db *gorm.DB, post models.Post) []string {
+	usernames := []string{}
+	db.Model(&models.User{}).Where("users.id IN (?)", db.Table("post_audience_users").Select("user_id").Where("post_id = ?", post.ID)).
+		Pluck("username", &usernames)
+	return usernames
+}
+
 func (obj PostManager) DropData(db *gorm.DB) {
 	db.Delete(&models.Post{})
 }
 
+const (
+	homeFeedFriendWeight     = 4 // friends', followed users' (and the user's own) posts rank this many times above others as engaging
+	homeFeedRecentDays       = 7 // older posts only show up from friends & followed users
+	homeFeedDecayHours       = 2 // softens the time decay of the newest posts
+	homeFeedDecayPower       = 1.5
+	homeFeedSnapshotSize     = 500 // posts kept in a snapshot, which is as deep as the feed goes
+	homeFeedSnapshotLifetime = 30 * time.Minute
+)
+
+// Where the home feed is at: its snapshot and the score & id of the last post seen
+type HomeFeedCursor struct {
+	SnapshotID uuid.UUID
+	Score      float64
+	ID         uuid.UUID
+}
+
+// Posts of the user's home feed with their score at the snapshot time: engagement (reactions, and
+// comments which count double) decaying with age, boosted for the user's friends, followed users & own posts.
+// Posts by users blocked either way or muted by the user, and those the user isn't in the audience of, are left out.
+// Reactions & comments are counted once for all posts rather than per post.
+func (obj PostManager) homeFeedQuery(db *gorm.DB, user models.User, asOf time.Time) *gorm.DB {
+	authorIDs := db.Model(&models.User{}).Select("users.id").
+		Where("users.id = ? OR users.id IN (?) OR users.id IN (?)", user.ID, FriendManager{}.friendIDsQuery(db, user), FollowManager{}.followeeIDsQuery(db, user))
+	reactionCounts := db.Model(&models.Reaction{}).Select("post_id, COUNT(*) AS count").
+		Where("post_id IS NOT NULL AND created_at <= ?", asOf).Group("post_id")
+	commentCounts := db.Model(&models.Comment{}).Select("post_id, COUNT(*) AS count").
+		Where("created_at <= ?", asOf).Group("post_id")
+	score := fmt.Sprintf(
+		"CAST((CASE WHEN posts.author_id IN (@authors) THEN %d ELSE 1 END) * "+
+			"(1 + COALESCE(reaction_counts.count, 0) + 2 * COALESCE(comment_counts.count, 0)) "+
+			"AS double precision) / power(CAST(EXTRACT(EPOCH FROM (@as_of - posts.created_at)) AS double precision) / 3600 + %d, %v) AS score",
+		homeFeedFriendWeight, homeFeedDecayHours, homeFeedDecayPower,
+	)
+	return db.Model(&models.Post{}).
+		Select("posts.id, "+score, map[string]interface{}{"authors": authorIDs, "as_of": asOf}).
+		Joins("LEFT JOIN (?) AS reaction_counts ON reaction_counts.post_id = posts.id", reactionCounts).
+		Joins("LEFT JOIN (?) AS comment_counts ON comment_counts.post_id = posts.id", commentCounts).
+		Where("posts.created_at <= ?", asOf).
+		Where("posts.author_id IN (?) OR posts.created_at > ?", authorIDs, asOf.AddDate(0, 0, -homeFeedRecentDays)).
+		Where("posts.author_id NOT IN (?)", BlockManager{}.hiddenIDsQuery(db, user)).
+		Where(obj.audienceCondition(db, user))
+}
+
+// Rank the user's home feed as of now and keep its best posts, which its pages are read from
+func (obj PostManager) createHomeFeedSnapshot(db *gorm.DB, user models.User, asOf time.Time) models.HomeFeedSnapshot {
+	db.Where("expires_at < ?", asOf).Delete(&models.HomeFeedSnapshot{})
+	snapshot := models.HomeFeedSnapshot{UserID: user.ID, ExpiresAt: asOf.Add(homeFeedSnapshotLifetime)}
+	db.Create(&snapshot)
+	db.Exec(
+		"INSERT INTO home_feed_snapshot_posts (snapshot_id, post_id, score) "+
+			"SELECT ?, ranked.id, ranked.score FROM (?) AS ranked ORDER BY ranked.score DESC, ranked.id DESC LIMIT ?",
+		snapshot.ID, obj.homeFeedQuery(db, user, asOf), homeFeedSnapshotSize,
+	)
+	return snapshot
+}
+
+// A page of the user's home feed, best first, after the cursor (from a new snapshot if nil).
+// Also returns the cursor of the next page (nil on the last one) and the feed's total.
+// Posts hidden from the user since the snapshot (e.g by a block) are dropped from its pages.
+func (obj PostManager) GetHomeFeed(db *gorm.DB, user models.User, asOf time.Time, cursor *HomeFeedCursor, limit int) ([]models.Post, *HomeFeedCursor, int64, *int, *utils.ErrorResponse) {
+	snapshot := models.HomeFeedSnapshot{}
+	if cursor == nil {
+		snapshot = obj.createHomeFeedSnapshot(db, user, asOf)
+	} else {
+		db.Where("user_id = ? AND expires_at >= ?", user.ID, asOf).Take(&snapshot, "id = ?", cursor.SnapshotID)
+		if snapshot.ID == nil {
+			statusCode := 400
+			errData := utils.RequestErr(utils.ERR_INVALID_VALUE, "This feed has expired. Start again from the first page")
+			return nil, nil, 0, &statusCode, &errData
+		}
+	}
+
+	entries := db.Model(&models.HomeFeedSnapshotPost{}).Where("snapshot_id = ?", snapshot.ID)
+	var total int64
+	entries.Count(&total)
+
+	page := db.Model(&models.HomeFeedSnapshotPost{}).Select("post_id AS id, score").Where("snapshot_id = ?", snapshot.ID)
+	if cursor != nil {
+		page = page.Where("(score, post_id) < (?, ?)", cursor.Score, cursor.ID)
+	}
+	rows := []struct {
+		ID    uuid.UUID
+		Score float64
+	}{}
+	page.Order("score DESC, post_id DESC").Limit(limit + 1).Scan(&rows)
+
+	var next *HomeFeedCursor
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[limit-1]
+		next = &HomeFeedCursor{SnapshotID: snapshot.ID, Score: last.Score, ID: last.ID}
+	}
+	ids := []uuid.UUID{}
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	posts := []models.Post{}
+	if len(ids) > 0 {
+		postsQ := obj.All(db).Scopes(PostCountsPreloadScope).Where("posts.id IN ?", ids)
+		postsQ = BlockManager{}.ExcludeHidden(db, obj.ExcludeInvisible(db, postsQ, user), user, "posts.author_id")
+		postsQ.Find(&posts)
+	}
+	// Back in the feed's order
+	positions := map[string]int{}
+	for i, id := range ids {
+		positions[id.String()] = i
+	}
+	slices.SortFunc(posts, func(a, b models.Post) int {
+		return positions[a.ID.String()] - positions[b.ID.String()]
+	})
+	return posts, next, total, nil, nil
+}
+
 // ----------------------------------
 // COMMENT MANAGEMENT
 // --------------------------------
@@ -101,10 +287,14 @@ func (obj CommentManager) GetBySlug(db *gorm.DB, slug string, opts ...bool) (*mo
 	return &comment, nil, nil
 }
 
-func (obj CommentManager) GetByPostID(db *gorm.DB, postID uuid.UUID) []models.Comment {
-	comments := []models.Comment{}
-	db.Preload("Replies").Scopes(AuthorReactionScope).Where(models.Comment{PostID: postID}).Find(&comments)
-	return comments
+// Comments of a post, for pagination with CommentCountsPreloadScope
+func (obj CommentManager) GetByPostID(db *gorm.DB, postID uuid.UUID) *gorm.DB {
+	return db.Model(&models.Comment{}).Scopes(AuthorAvatarScope).Where("comments.post_id = ?", postID)
+}
+
+// Reactions & replies of comments, which they are counted from
+func CommentCountsPreloadScope(db *gorm.DB) *gorm.DB {
+	return db.Preload("Reactions").Preload("Replies")
 }
 
 func (obj CommentManager) Create(db *gorm.DB, author models.User, post models.Post, text string) models.Comment {
@@ -150,6 +340,15 @@ func (obj ReplyManager) GetBySlug(db *gorm.DB, slug string, opts ...bool) (*mode
 	return &reply, nil, nil
 }
 
+// Replies of a comment, for pagination with ReactionsPreloadScope
+func (obj ReplyManager) GetByCommentID(db *gorm.DB, commentID uuid.UUID) *gorm.DB {
+	return db.Model(&models.Reply{}).Scopes(AuthorAvatarScope).Where("replies.comment_id = ?", commentID)
+}
+
+func ReactionsPreloadScope(db *gorm.DB) *gorm.DB {
+	return db.Preload("Reactions")
+}
+
 func (obj ReplyManager) Create(db *gorm.DB, author models.User, comment models.Comment, text string) models.Reply {
 	id := uuid.Parse(uuid.New())
 	// Create slug
@@ -182,39 +381,56 @@ func UserAvatarReactionScope(db *gorm.DB) *gorm.DB {
 type ReactionManager struct {
 }
 
-func (obj ReactionManager) GetReactionsQueryset(db *gorm.DB, fiberCtx *fiber.Ctx, focus choices.FocusTypeChoice, slug string) ([]models.Reaction, *int, *utils.ErrorResponse) {
-	reactions := []models.Reaction{}
-	q := db.Scopes(UserAvatarReactionScope)
+// The error of a post, comment or reply hidden from the user by a block, the same as if it didn't exist
+func blockedFeedItemErr(name string) (*int, *utils.ErrorResponse) {
+	statusCode := 404
+	errData := utils.RequestErr(utils.ERR_NON_EXISTENT, name+" does not exist")
+	return &statusCode, &errData
+}
+
+func (obj ReactionManager) GetReactionsQueryset(db *gorm.DB, fiberCtx *fiber.Ctx, user models.User, focus choices.FocusTypeChoice, slug string) (*gorm.DB, *int, *utils.ErrorResponse) {
+	q := db.Model(&models.Reaction{}).Scopes(UserAvatarReactionScope)
 	if focus == choices.FTPOST {
 		// Get Post Object and Query reactions for the post
 		post, errCode, errData := PostManager{}.GetBySlug(db, slug)
 		if errCode != nil {
 			return nil, errCode, errData
 		}
-		q = q.Where(models.Reaction{Post: post})
+		if (PostManager{}).IsHidden(db, user, post, nil, nil) {
+			errCode, errData := blockedFeedItemErr("Post")
+			return nil, errCode, errData
+		}
+		q = q.Where("reactions.post_id = ?", post.ID)
 	} else if focus == choices.FTCOMMENT {
 		// Get Comment Object and Query reactions for the comment
 		comment, errCode, errData := CommentManager{}.GetBySlug(db, slug)
 		if errCode != nil {
 			return nil, errCode, errData
 		}
-		q = q.Where(models.Reaction{Comment: comment})
+		if (PostManager{}).IsHidden(db, user, nil, comment, nil) {
+			errCode, errData := blockedFeedItemErr("Comment")
+			return nil, errCode, errData
+		}
+		q = q.Where("reactions.comment_id = ?", comment.ID)
 	} else {
 		// Get Reply Object and Query reactions for the reply
 		reply, errCode, errData := ReplyManager{}.GetBySlug(db, slug)
 		if errCode != nil {
 			return nil, errCode, errData
 		}
-		q = q.Where(models.Reaction{Reply: reply})
+		if (PostManager{}).IsHidden(db, user, nil, nil, reply) {
+			errCode, errData := blockedFeedItemErr("Reply")
+			return nil, errCode, errData
+		}
+		q = q.Where("reactions.reply_id = ?", reply.ID)
 	}
 
 	// Filter by Reaction type if provided (e.g LIKE, LOVE)
 	rtype := choices.ReactionChoice(fiberCtx.Query("reaction_type"))
 	if len(rtype) > 0 {
-		q = q.Where(models.Reaction{Rtype: rtype})
+		q = q.Where("reactions.rtype = ?", rtype)
 	}
-	q.Find(&reactions)
-	return reactions, nil, nil
+	return BlockManager{}.ExcludeBlocked(db, q, user, "reactions.user_id"), nil, nil
 }
 
 func (obj ReactionManager) Update(db *gorm.DB, reaction models.Reaction, focus choices.FocusTypeChoice, post *models.Post, comment *models.Comment, reply *models.Reply, rtype choices.ReactionChoice) models.Reaction {
@@ -264,6 +480,10 @@ func (obj ReactionManager) UpdateOrCreate(db *gorm.DB, user models.User, focus c
 			return nil, nil, errCode, errData
 		}
 		post = postObj
+		if (PostManager{}).IsHidden(db, user, post, nil, nil) {
+			errCode, errData := blockedFeedItemErr("Post")
+			return nil, nil, errCode, errData
+		}
 		q = q.Where(models.Reaction{PostID: &post.ID})
 		targetedObjAuthor = &post.AuthorObj
 	} else if focus == choices.FTCOMMENT {
@@ -273,6 +493,10 @@ func (obj ReactionManager) UpdateOrCreate(db *gorm.DB, user models.User, focus c
 			return nil, nil, errCode, errData
 		}
 		comment = commentObj
+		if (PostManager{}).IsHidden(db, user, nil, comment, nil) {
+			errCode, errData := blockedFeedItemErr("Comment")
+			return nil, nil, errCode, errData
+		}
 		q = q.Where(models.Reaction{CommentID: &comment.ID})
 		targetedObjAuthor = &comment.AuthorObj
 	} else {
@@ -282,6 +506,10 @@ func (obj ReactionManager) UpdateOrCreate(db *gorm.DB, user models.User, focus c
 			return nil, nil, errCode, errData
 		}
 		reply = replyObj
+		if (PostManager{}).IsHidden(db, user, nil, nil, reply) {
+			errCode, errData := blockedFeedItemErr("Reply")
+			return nil, nil, errCode, errData
+		}
 		q = q.Where(models.Reaction{ReplyID: &reply.ID})
 		targetedObjAuthor = &reply.AuthorObj
 	}
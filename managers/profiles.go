@@ -10,49 +10,49 @@ import (
 )
 
 // ----------------------------------
-// FRIEND MANAGEMENT
+// USER MANAGEMENT
 // --------------------------------
-type FriendManager struct {
+type UserManager struct {
 }
 
-func (obj FriendManager) GetFriends(db *gorm.DB, user models.User) []models.User {
-	friends := []models.Friend{}
-	db.Where(
-		models.Friend{Status: choices.FACCEPTED},
-	).Where(
-		models.Friend{RequesterID: user.ID}).Or(models.Friend{RequesteeID: user.ID}).Find(&friends)
-
-	friendIDs := []uuid.UUID{}
-	for i := range friends {
-		requesterID := friends[i].RequesterID
-		requesteeID := friends[i].RequesteeID
-		if user.ID.String() == requesterID.String() {
-			friendIDs = append(friendIDs, requesteeID)
-		} else {
-			friendIDs = append(friendIDs, requesterID)
-		}
-	}
+// The users with the usernames, except the user whose ID is given (if any)
+func (obj UserManager) GetByUsernames(db *gorm.DB, usernames []string, excludeOpts ...uuid.UUID) []models.User {
 	users := []models.User{}
-	if len(friendIDs) > 0 {
-		db.Preload(clause.Associations).Find(&users, friendIDs)
+	usersQ := db.Where("username IN ?", usernames)
+	if len(excludeOpts) > 0 {
+		usersQ = usersQ.Not("id = ?", excludeOpts[0])
 	}
+	usersQ.Find(&users)
 	return users
 }
 
-func (obj FriendManager) GetFriendRequests(db *gorm.DB, user *models.User) []models.User {
-	friendObjects := []models.Friend{}
-	db.Select("requester_id").Where(models.Friend{RequesteeID: user.ID, Status: choices.FPENDING}).Find(&friendObjects)
+// ----------------------------------
+// FRIEND MANAGEMENT
+// --------------------------------
+type FriendManager struct {
+}
 
-	friendIDs := []uuid.UUID{}
-	for i := range friendObjects {
-		friendIDs = append(friendIDs, friendObjects[i].RequesterID)
-	}
+// IDs of the user's friends, whichever side sent the request
+func (obj FriendManager) friendIDsQuery(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.Friend{}).
+		Select("CASE WHEN requester_id = ? THEN requestee_id ELSE requester_id END", user.ID).
+		Where("status = ? AND (requester_id = ? OR requestee_id = ?)", choices.FACCEPTED, user.ID, user.ID)
+}
 
-	friends := []models.User{}
-	if len(friendIDs) > 0 {
-		db.Preload(clause.Associations).Find(&friends, friendIDs)
-	}
-	return friends
+func (obj FriendManager) GetFriendsQueryset(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.User{}).Where("users.id IN (?)", obj.friendIDsQuery(db, user))
+}
+
+func (obj FriendManager) GetFriends(db *gorm.DB, user models.User) []models.User {
+	users := []models.User{}
+	obj.GetFriendsQueryset(db, user).Preload(clause.Associations).Find(&users)
+	return users
+}
+
+// Users with a pending request to the user
+func (obj FriendManager) GetFriendRequestsQueryset(db *gorm.DB, user *models.User) *gorm.DB {
+	requesterIDs := db.Model(&models.Friend{}).Select("requester_id").Where(models.Friend{RequesteeID: user.ID, Status: choices.FPENDING})
+	return db.Model(&models.User{}).Where("users.id IN (?)", requesterIDs)
 }
 
 func (obj FriendManager) GetRequesteeAndFriendObj(db *gorm.DB, user *models.User, username string, statusOpts ...choices.FriendStatusChoice) (*models.User, *models.Friend, *utils.ErrorResponse) {
@@ -76,16 +76,222 @@ func (obj FriendManager) DropData(db *gorm.DB) {
 	db.Delete(&[]models.Friend{})
 }
 
+// ----------------------------------
+// FOLLOW MANAGEMENT
+// --------------------------------
+type FollowManager struct {
+}
+
+// IDs of the users the user follows (accepted follows only)
+func (obj FollowManager) followeeIDsQuery(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.Follow{}).Select("followee_id").Where(models.Follow{FollowerID: user.ID, Status: choices.FLACCEPTED})
+}
+
+// IDs of the user's followers (accepted follows only)
+func (obj FollowManager) followerIDsQuery(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.Follow{}).Select("follower_id").Where(models.Follow{FolloweeID: user.ID, Status: choices.FLACCEPTED})
+}
+
+func (obj FollowManager) GetFollowersQueryset(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.User{}).Where("users.id IN (?)", obj.followerIDsQuery(db, user))
+}
+
+func (obj FollowManager) GetFollowingQueryset(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.User{}).Where("users.id IN (?)", obj.followeeIDsQuery(db, user))
+}
+
+// Users waiting for the user to approve their follow
+func (obj FollowManager) GetFollowRequestsQueryset(db *gorm.DB, user models.User) *gorm.DB {
+	followerIDs := db.Model(&models.Follow{}).Select("follower_id").Where(models.Follow{FolloweeID: user.ID, Status: choices.FLPENDING})
+	return db.Model(&models.User{}).Where("users.id IN (?)", followerIDs)
+}
+
+// The user's followers & following counts
+func (obj FollowManager) GetCounts(db *gorm.DB, user models.User) (int64, int64) {
+	var followersCount, followingCount int64
+	db.Model(&models.Follow{}).Where(models.Follow{FolloweeID: user.ID, Status: choices.FLACCEPTED}).Count(&followersCount)
+	db.Model(&models.Follow{}).Where(models.Follow{FollowerID: user.ID, Status: choices.FLACCEPTED}).Count(&followingCount)
+	return followersCount, followingCount
+}
+
+func (obj FollowManager) Get(db *gorm.DB, followerID uuid.UUID, followeeID uuid.UUID) *models.Follow {
+	follow := models.Follow{}
+	db.Where(models.Follow{FollowerID: followerID, FolloweeID: followeeID}).Take(&follow)
+	if follow.ID == nil {
+		return nil
+	}
+	return &follow
+}
+
+// Follows the followee, pending their approval if they approve their followers
+func (obj FollowManager) Create(db *gorm.DB, follower models.User, followee models.User) models.Follow {
+	status := choices.FLACCEPTED
+	if followee.ApproveFollowers {
+		status = choices.FLPENDING
+	}
+	follow := models.Follow{FollowerID: follower.ID, FolloweeID: followee.ID, Status: status}
+	db.Create(&follow)
+	return follow
+}
+
+// Accepts all the follows waiting for the user's approval
+func (obj FollowManager) AcceptPending(db *gorm.DB, user models.User) {
+	db.Model(&models.Follow{}).Where(models.Follow{FolloweeID: user.ID, Status: choices.FLPENDING}).Update("status", choices.FLACCEPTED)
+	// Their requests' notifications become follow ones
+	db.Model(&models.Notification{}).
+		Where("ntype = ? AND id IN (?)", choices.NFOLLOWREQUEST, db.Table("notification_receivers").Select("notification_id").Where("user_id = ?", user.ID)).
+		Update("ntype", choices.NFOLLOW)
+}
+
+func (obj FollowManager) DropData(db *gorm.DB) {
+	db.Delete(&[]models.Follow{})
+}
+
+// ----------------------------------
+// BLOCK & MUTE MANAGEMENT
+// --------------------------------
+type BlockManager struct {
+}
+
+// IDs of the users the user blocked or was blocked by
+func (obj BlockManager) blockedIDsQuery(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.Block{}).
+		Select("CASE WHEN blocker_id = ? THEN blocked_id ELSE blocker_id END", user.ID).
+		Where("blocker_id = ? OR blocked_id = ?", user.ID, user.ID)
+}
+
+// IDs of the users whose content is hidden from the user: blocked either way, or muted by the user
+func (obj BlockManager) hiddenIDsQuery(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.User{}).Select("users.id").
+		Where("users.id IN (?) OR users.id IN (?)", obj.blockedIDsQuery(db, user), db.Model(&models.Mute{}).Select("muted_id").Where(models.Mute{MuterID: user.ID}))
+}
+
+// Leaves out the rows whose user (in the column) the user blocked or was blocked by. Rows without a user are kept.
+func (obj BlockManager) ExcludeBlocked(db *gorm.DB, query *gorm.DB, user models.User, column string) *gorm.DB {
+	return query.Where("("+column+" IS NULL OR "+column+" NOT IN (?))", obj.blockedIDsQuery(db, user))
+}
+
+// Leaves out the rows whose user (in the column) is blocked either way or muted by the user, for feeds & notifications.
+// Rows without a user (e.g admin notifications) are kept.
+func (obj BlockManager) ExcludeHidden(db *gorm.DB, query *gorm.DB, user models.User, column string) *gorm.DB {
+	return query.Where("("+column+" IS NULL OR "+column+" NOT IN (?))", obj.hiddenIDsQuery(db, user))
+}
+
+// Whether the user blocked, or was blocked by, any of the other users
+func (obj BlockManager) IsBlocked(db *gorm.DB, user models.User, otherIDs ...uuid.UUID) bool {
+	var count int64
+	db.Model(&models.Block{}).
+		Where("(blocker_id = ? AND blocked_id IN ?) OR (blocked_id = ? AND blocker_id IN ?)", user.ID, otherIDs, user.ID, otherIDs).
+		Count(&count)
+	return count > 0
+}
+
+// Usernames of the users the user blocked or was blocked by, among those given
+func (obj BlockManager) GetBlockedUsernames(db *gorm.DB, user models.User, users []models.User) []string {
+	if len(users) == 0 {
+		return []string{}
+	}
+	ids := []uuid.UUID{}
+	for _, other := range users {
+		ids = append(ids, other.ID)
+	}
+	usernames := []string{}
+	db.Model(&models.User{}).Where("users.id IN ? AND users.id IN (?)", ids, obj.blockedIDsQuery(db, user)).
+		Order("username").Pluck("username", &usernames)
+	return usernames
+}
+
+// Whether the chat is a DM with a user the user blocked or was blocked by
+func (obj BlockManager) IsBlockedDM(db *gorm.DB, user models.User, chat models.Chat) bool {
+	return chat.Ctype == choices.CDM && obj.IsBlocked(db, user, ChatManager{}.GetMemberIDs(db, chat.ID)...)
+}
+
+// Leaves out the DM chats with users the user blocked or was blocked by
+func (obj BlockManager) ExcludeBlockedDMs(db *gorm.DB, query *gorm.DB, user models.User) *gorm.DB {
+	blockedIDs := obj.blockedIDsQuery(db, user)
+	return query.Not(
+		db.Where("chats.ctype = ?", choices.CDM).
+			Where("chats.owner_id IN (?) OR chats.id IN (?)", blockedIDs, db.Table("chat_users").Select("chat_id").Where("user_id IN (?)", blockedIDs)),
+	)
+}
+
+func (obj BlockManager) GetBlock(db *gorm.DB, blockerID uuid.UUID, blockedID uuid.UUID) *models.Block {
+	block := models.Block{}
+	db.Where(models.Block{BlockerID: blockerID, BlockedID: blockedID}).Take(&block)
+	if block.ID == nil {
+		return nil
+	}
+	return &block
+}
+
+func (obj BlockManager) IsMuted(db *gorm.DB, muterID uuid.UUID, mutedID uuid.UUID) bool {
+	var count int64
+	db.Model(&models.Mute{}).Where(models.Mute{MuterID: muterID, MutedID: mutedID}).Count(&count)
+	return count > 0
+}
+
+// Users blocked by the user
+func (obj BlockManager) GetBlockedQueryset(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.User{}).Where("users.id IN (?)", db.Model(&models.Block{}).Select("blocked_id").Where(models.Block{BlockerID: user.ID}))
+}
+
+// Users muted by the user
+func (obj BlockManager) GetMutedQueryset(db *gorm.DB, user models.User) *gorm.DB {
+	return db.Model(&models.User{}).Where("users.id IN (?)", db.Model(&models.Mute{}).Select("muted_id").Where(models.Mute{MuterID: user.ID}))
+}
+
+// Blocks the user and ends every friendship, friend request & follow between them.
+// Returns false if they were already blocked.
+func (obj BlockManager) Block(db *gorm.DB, blocker models.User, blocked models.User) bool {
+	var created bool
+	db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Block{BlockerID: blocker.ID, BlockedID: blocked.ID})
+		created = result.RowsAffected > 0
+		tx.Where("(requester_id = ? AND requestee_id = ?) OR (requester_id = ? AND requestee_id = ?)", blocker.ID, blocked.ID, blocked.ID, blocker.ID).
+			Delete(&models.Friend{})
+		tx.Where("(follower_id = ? AND followee_id = ?) OR (follower_id = ? AND followee_id = ?)", blocker.ID, blocked.ID, blocked.ID, blocker.ID).
+			Delete(&models.Follow{})
+		return result.Error
+	})
+	return created
+}
+
+// Returns false if the user wasn't blocked
+func (obj BlockManager) Unblock(db *gorm.DB, blocker models.User, blocked models.User) bool {
+	return db.Where(models.Block{BlockerID: blocker.ID, BlockedID: blocked.ID}).Delete(&models.Block{}).RowsAffected > 0
+}
+
+// Returns false if the user was already muted
+func (obj BlockManager) Mute(db *gorm.DB, muter models.User, muted models.User) bool {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Mute{MuterID: muter.ID, MutedID: muted.ID}).RowsAffected > 0
+}
+
+// Returns false if the user wasn't muted
+func (obj BlockManager) Unmute(db *gorm.DB, muter models.User, muted models.User) bool {
+	return db.Where(models.Mute{MuterID: muter.ID, MutedID: muted.ID}).Delete(&models.Mute{}).RowsAffected > 0
+}
+
+func (obj BlockManager) DropData(db *gorm.DB) {
+	db.Delete(&[]models.Block{})
+	db.Delete(&[]models.Mute{})
+}
+
 // ----------------------------------
 // NOTIFICATION MANAGEMENT
 // --------------------------------
 type NotificationManager struct {
 }
 
-func (obj NotificationManager) GetQueryset(db *gorm.DB, userID uuid.UUID) []models.Notification {
-	notifications := []models.Notification{}
-	db.Preload(clause.Associations).Order("created_at DESC").Find(&notifications)
-	return notifications
+// Notifications received by the user, leaving out those about posts (or their comments & replies) the user can't see anymore
+func (obj NotificationManager) GetQueryset(db *gorm.DB, user models.User) *gorm.DB {
+	visiblePostIDs := PostManager{}.visibleIDsQuery(db, user)
+	visibleCommentIDs := db.Model(&models.Comment{}).Select("comments.id").Where("comments.post_id IN (?)", visiblePostIDs)
+	visibleReplyIDs := db.Model(&models.Reply{}).Select("replies.id").Where("replies.comment_id IN (?)", visibleCommentIDs)
+	return db.Model(&models.Notification{}).
+		Where("notifications.id IN (?)", db.Table("notification_receivers").Select("notification_id").Where("user_id = ?", user.ID)).
+		Where("(notifications.post_id IS NULL OR notifications.post_id IN (?))", visiblePostIDs).
+		Where("(notifications.comment_id IS NULL OR notifications.comment_id IN (?))", visibleCommentIDs).
+		Where("(notifications.reply_id IS NULL OR notifications.reply_id IN (?))", visibleReplyIDs)
 }
 
 func (obj NotificationManager) MarkAsRead(db *gorm.DB, user *models.User) {
@@ -147,22 +353,29 @@ func (obj NotificationManager) Get(db *gorm.DB, sender *models.User, ntype choic
 	return &notification
 }
 
-func (obj NotificationManager) IsAmongReceivers(db *gorm.DB, notificationID uuid.UUID, receiverID uuid.UUID) bool {
+// A notification of one of the types, sent by the sender to the receiver (e.g a follow notification)
+func (obj NotificationManager) GetSentTo(db *gorm.DB, sender models.User, receiver models.User, ntypes ...choices.NotificationChoice) *models.Notification {
 	notification := models.Notification{}
-	db.Preload("Receivers").Take(&notification, notificationID)
+	db.Where("sender_id = ? AND ntype IN ?", sender.ID, ntypes).
+		Where("id IN (?)", db.Table("notification_receivers").Select("notification_id").Where("user_id = ?", receiver.ID)).
+		Take(&notification)
 	if notification.ID == nil {
-		return false
+		return nil
 	}
+	return &notification
+}
 
-	// Check if user in notification receivers
-	found := false
-	for _, item := range notification.Receivers {
-		if item.ID.String() == receiverID.String() {
-			found = true
-			break
-		}
-	}
-	return found
+func (obj NotificationManager) GetReceiverIDs(db *gorm.DB, notificationID uuid.UUID) []uuid.UUID {
+	receiverIDs := []uuid.UUID{}
+	db.Table("notification_receivers").Where("notification_id = ?", notificationID).Pluck("user_id", &receiverIDs)
+	return receiverIDs
+}
+
+// Delete a notification and return the IDs of its receivers (which are gone once it's deleted)
+func (obj NotificationManager) Delete(db *gorm.DB, notification *models.Notification) []uuid.UUID {
+	receiverIDs := obj.GetReceiverIDs(db, notification.ID)
+	db.Delete(notification)
+	return receiverIDs
 }
 
 func (obj NotificationManager) DropData(db *gorm.DB) {
@@ -0,0 +1,115 @@
+package managers
+
+import (
+	"fmt"
+
+	"github.com/acatalepsy17/pigeon/models"
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+)
+
+// ----------------------------------
+// SEARCH MANAGEMENT
+// --------------------------------
+const (
+	SearchPosts    = "posts"
+	SearchComments = "comments"
+	SearchReplies  = "replies"
+	SearchUsers    = "users"
+	SearchMessages = "messages"
+)
+
+var SearchTypes = []string{SearchPosts, SearchComments, SearchReplies, SearchUsers, SearchMessages}
+
+// The text search configuration of each searchable table's search_vector, and the text snippets are taken from
+var searchTables = map[string]struct {
+	config string
+	text   string
+}{
+	SearchPosts:    {"english", "text"},
+	SearchComments: {"english", "text"},
+	SearchReplies:  {"english", "text"},
+	SearchMessages: {"english", "text"},
+	SearchUsers:    {"simple", "concat_ws(' ', first_name, last_name, username, bio)"},
+}
+
+// Orders a table's search results by relevance, for the paginator
+func SearchRankOrder(table string) string {
+	return "ts_rank(" + table + ".search_vector, search_query) DESC"
+}
+
+type SearchManager struct {
+}
+
+// Only the table's rows matching the search, with the search_query it can be ranked by
+func searchScope(table string, search string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Joins(fmt.Sprintf("CROSS JOIN websearch_to_tsquery('%s', ?) AS search_query", searchTables[table].config), search).
+			Where(table + ".search_vector @@ search_query")
+	}
+}
+
+// Like in the feeds, posts the user isn't in the audience of, or by users blocked either way or muted by the user, are left out
+func (obj SearchManager) Posts(db *gorm.DB, search string, user models.User) *gorm.DB {
+	query := PostManager{}.All(db).Scopes(searchScope(SearchPosts, search))
+	return PostManager{}.ExcludeInvisible(db, BlockManager{}.ExcludeHidden(db, query, user, "posts.author_id"), user)
+}
+
+// Comments by users blocked either way or muted by the user, or under posts the user can't see, are left out
+func (obj SearchManager) Comments(db *gorm.DB, search string, user models.User) *gorm.DB {
+	query := db.Model(&models.Comment{}).Scopes(AuthorAvatarScope, searchScope(SearchComments, search)).
+		Where("comments.post_id IN (?)", PostManager{}.visibleIDsQuery(db, user))
+	return BlockManager{}.ExcludeHidden(db, query, user, "comments.author_id")
+}
+
+// Replies by users blocked either way or muted by the user, or under comments by users blocked either way
+// or under posts the user can't see, are left out
+func (obj SearchManager) Replies(db *gorm.DB, search string, user models.User) *gorm.DB {
+	visibleCommentIDs := db.Model(&models.Comment{}).Select("comments.id").
+		Where("comments.post_id IN (?)", PostManager{}.visibleIDsQuery(db, user))
+	visibleCommentIDs = BlockManager{}.ExcludeBlocked(db, visibleCommentIDs, user, "comments.author_id")
+	query := db.Model(&models.Reply{}).Scopes(AuthorAvatarScope, searchScope(SearchReplies, search)).
+		Where("replies.comment_id IN (?)", visibleCommentIDs)
+	return BlockManager{}.ExcludeHidden(db, query, user, "replies.author_id")
+}
+
+// Users other than the current user, and those they blocked or were blocked by
+func (obj SearchManager) Users(db *gorm.DB, search string, user models.User) *gorm.DB {
+	query := db.Model(&models.User{}).Joins("AvatarObj").Joins("CityObj").
+		Where("users.id <> ?", user.ID).Scopes(searchScope(SearchUsers, search))
+	return BlockManager{}.ExcludeBlocked(db, query, user, "users.id")
+}
+
+// Messages in the user's chats only, except those sent by users they blocked or were blocked by
+func (obj SearchManager) Messages(db *gorm.DB, search string, user models.User) *gorm.DB {
+	userChatIDs := db.Model(&models.Chat{}).Select("chats.id").Where(db.Where(models.Chat{OwnerID: user.ID}).
+		Or("chats.id IN (?)", db.Table("chat_users").Select("chat_id").Where("user_id = ?", user.ID)))
+	query := db.Model(&models.Message{}).Scopes(MessageSenderFileScope, searchScope(SearchMessages, search)).
+		Where("messages.chat_id IN (?)", userChatIDs)
+	return BlockManager{}.ExcludeBlocked(db, query, user, "messages.sender_id")
+}
+
+// The parts of each item's text that match the search, with the matching words in <mark> tags, by item id.
+// Only done for a page of results, as it's too slow to do for every match.
+func (obj SearchManager) GetSnippets(db *gorm.DB, table string, search string, ids []uuid.UUID) map[string]string {
+	snippets := map[string]string{}
+	if len(ids) == 0 {
+		return snippets
+	}
+	searchTable := searchTables[table]
+	rows := []struct {
+		ID      uuid.UUID
+		Snippet string
+	}{}
+	db.Table(table).
+		Select(
+			fmt.Sprintf("%s.id, ts_headline('%s', %s, websearch_to_tsquery('%s', ?), ?) AS snippet", table, searchTable.config, searchTable.text, searchTable.config),
+			search, "StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2",
+		).
+		Where(table+".id IN ?", ids).
+		Scan(&rows)
+	for _, row := range rows {
+		snippets[row.ID.String()] = row.Snippet
+	}
+	return snippets
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/acatalepsy17/pigeon/config"
+	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/gosimple/slug"
 	"github.com/pborman/uuid"
@@ -58,15 +59,28 @@ type User struct {
 	AvatarId              *uuid.UUID     `json:"-" gorm:"null"`
 	AvatarObj             *File          `json:"-" gorm:"foreignKey:AvatarId;constraint:OnDelete:SET NULL;null;"`
 	Avatar                *string        `gorm:"-" json:"avatar" example:"https://img.com"`
-	Access                *string        `gorm:"type:varchar(1000);null;" json:"-"`
-	Refresh               *string        `gorm:"type:varchar(1000);null;" json:"-"`
 	Bio                   *string        `gorm:"type:varchar(1000);null;" json:"bio" example:"Software Engineer | Go Fiber Developer"`
 	Dob                   *time.Time     `gorm:"null;" json:"dob"`
 	CityId                *uuid.UUID     `json:"-" gorm:"null"`
 	CityObj               *City          `json:"-" gorm:"foreignKey:CityId;constraint:OnDelete:SET NULL"`
 	City                  *string        `gorm:"-" json:"city" example:"Lekki"`
+	TotpSecret            *string        `gorm:"type:varchar(255);null;" json:"-"`
+	TotpEnabled           bool           `gorm:"default:false" json:"-"`
+	TotpLastUsedStep      int64          `gorm:"default:0" json:"-"`
+	ApproveFollowers      bool           `gorm:"default:false" json:"approve_followers" example:"false"` // a private account: follows need the user's approval and only followers & friends see their public posts
 	NotificationsReceived []Notification `json:"-" gorm:"many2many:notification_receivers;"`
 	NotificationsRead     []Notification `json:"-" gorm:"many2many:notification_read_by;"`
+	Snippet               *string        `gorm:"-" json:"snippet,omitempty" example:"<mark>Donald</mark> Trump"` // the matching text, in search results
+
+	DefaultPostAudience choices.PostAudienceChoice `gorm:"varchar(50);not null;default:PUBLIC" json:"-"` // of the user's posts created without one
+
+	// Set on profiles
+	FollowersCount *int64                      `gorm:"-" json:"followers_count,omitempty" example:"120"`
+	FollowingCount *int64                      `gorm:"-" json:"following_count,omitempty" example:"80"`
+	FollowStatus   *choices.FollowStatusChoice `gorm:"-" json:"follow_status,omitempty" example:"ACCEPTED"` // whether the current user follows them
+
+	// Set on the user's own profile only
+	OwnDefaultPostAudience *choices.PostAudienceChoice `gorm:"-" json:"default_post_audience,omitempty" example:"PUBLIC"`
 }
 
 func (user User) Init() User {
@@ -76,6 +90,13 @@ func (user User) Init() User {
 	return user
 }
 
+// The user's own profile, with the settings only they can see
+func (user User) InitOwn() User {
+	user = user.Init()
+	user.OwnDefaultPostAudience = &user.DefaultPostAudience
+	return user
+}
+
 func (user User) FullName() string {
 	return fmt.Sprintf("%s %s", user.FirstName, user.LastName)
 }
@@ -98,8 +119,10 @@ func (user User) GetAvatarUrl() *string {
 }
 
 func (user *User) BeforeCreate(tx *gorm.DB) (err error) {
-	// Hash password
-	user.Password = utils.HashPassword(user.Password)
+	// Hash password (accounts created through an identity provider have none)
+	if user.Password != "" {
+		user.Password = utils.HashPassword(user.Password)
+	}
 
 	// Create username
 	user.Username = user.GenerateUsername(tx)
@@ -125,17 +148,94 @@ func (user *User) GenerateUsername(tx *gorm.DB) string {
 	return uniqueUsername
 }
 
+type Session struct {
+	BaseModel
+	UserID      uuid.UUID `json:"-" gorm:"not null;index"`
+	UserObj     User      `json:"-" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
+	DeviceName  *string   `json:"device_name" gorm:"type:varchar(255);null" example:"Pixel 8"`
+	UserAgent   string    `json:"user_agent" gorm:"type:varchar(1000)" example:"Mozilla/5.0 (Linux; Android 14)"`
+	IPAddress   string    `json:"ip_address" gorm:"type:varchar(100)" example:"102.89.34.12"`
+	LastSeenAt  time.Time `json:"last_seen_at" gorm:"not null"`
+	RefreshHash string    `json:"-" gorm:"type:varchar(255);not null;index"`
+	IsCurrent   bool      `json:"is_current" gorm:"-" example:"true"`
+}
+
+func (s Session) Init(currentSessionID uuid.UUID) Session {
+	s.IsCurrent = currentSessionID != nil && s.ID.String() == currentSessionID.String()
+	return s
+}
+
+type RecoveryCode struct {
+	BaseModel
+	UserID   uuid.UUID  `gorm:"not null;index"`
+	UserObj  User       `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
+	Lookup   string     `gorm:"type:varchar(5);not null;index"` // first part of the code, so only one hash has to be checked
+	CodeHash string     `gorm:"not null"`
+	UsedAt   *time.Time `gorm:"null"`
+}
+
+// Challenge tokens that have already been exchanged for a session, so they can't be used again
+type UsedMfaChallenge struct {
+	BaseModel
+	Jti       string    `gorm:"type:varchar(100);not null;unique"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// Failed attempts of an action (e.g sign in) for a key, which is an account or an IP address
+type ThrottleCounter struct {
+	BaseModel
+	Key           string     `gorm:"type:varchar(500);not null;unique"`
+	Failures      int        `gorm:"default:0"`
+	LastFailureAt time.Time  `gorm:"not null"`
+	BlockedUntil  *time.Time `gorm:"null"`
+	LockedOut     bool       `gorm:"default:false"` // blocked by a lockout rather than a backoff delay
+}
+
+func (obj ThrottleCounter) IsBlocked() bool {
+	return obj.BlockedUntil != nil && time.Now().UTC().Before(*obj.BlockedUntil)
+}
+
+// Links a user to an account at an external (OpenID Connect) identity provider
+type UserIdentity struct {
+	BaseModel
+	UserID  uuid.UUID `gorm:"not null;index"`
+	UserObj User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
+	Issuer  string    `gorm:"type:varchar(500);not null;index:,unique,composite:issuer_subject"`
+	Subject string    `gorm:"type:varchar(255);not null;index:,unique,composite:issuer_subject"`
+	Email   string    `gorm:"not null"`
+}
+
+// A pending OpenID Connect login, looked up by its state when the provider redirects back
+type OidcLoginRequest struct {
+	BaseModel
+	State        string    `gorm:"type:varchar(100);not null;unique"`
+	Nonce        string    `gorm:"type:varchar(100);not null"`
+	CodeVerifier string    `gorm:"type:varchar(128);not null"`
+	DeviceName   *string   `gorm:"type:varchar(255);null"`
+	ExpiresAt    time.Time `gorm:"not null"`
+}
+
+// Hashes of a user's previous passwords, to prevent reuse
+type PasswordHistory struct {
+	BaseModel
+	UserID       uuid.UUID `gorm:"not null;index"`
+	UserObj      User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
+	PasswordHash string    `gorm:"not null"`
+}
+
 type Otp struct {
 	BaseModel
-	UserId uuid.UUID `json:"user_id" gorm:"unique"`
-	User   User      `gorm:"foreignKey:UserId;constraint:OnDelete:CASCADE"`
-	Code   uint32    `json:"code"`
+	UserId         uuid.UUID                `json:"user_id" gorm:"not null;index:,unique,composite:user_id_purpose"`
+	User           User                     `gorm:"foreignKey:UserId;constraint:OnDelete:CASCADE"`
+	Purpose        choices.OtpPurposeChoice `json:"purpose" gorm:"varchar(50);not null;index:,unique,composite:user_id_purpose"`
+	CodeHash       string                   `json:"-" gorm:"not null"`
+	FailedAttempts int                      `json:"-" gorm:"default:0"`
+	LockedUntil    *time.Time               `json:"-" gorm:"null"`
+	Target         *string                  `json:"-" gorm:"null"` // e.g the new address of an email change
 }
 
-func (otp *Otp) BeforeSave(tx *gorm.DB) (err error) {
-	code := uint32(utils.GetRandomInt(6))
-	otp.Code = code
-	return
+func (obj Otp) IsLocked() bool {
+	return obj.LockedUntil != nil && time.Now().UTC().Before(*obj.LockedUntil)
 }
 
 func (obj Otp) CheckExpiration() bool {
@@ -40,3 +40,14 @@ func (user UserDataSchema) Init(userObj User) UserDataSchema {
 	user.Avatar = userObj.GetAvatarUrl()
 	return user
 }
+
+// A socket broadcast too large for a Postgres NOTIFY payload. Listeners load it by id,
+// and rows are removed shortly after as every instance has received the notification by then.
+type FanoutPayload struct {
+	BaseModel
+	Room         string   `gorm:"not null"`
+	Rooms        []string `gorm:"serializer:json"`
+	Data         []byte   `gorm:"not null"`
+	ExceptUserID string
+	EvictUserIDs []string `gorm:"serializer:json"`
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/pborman/uuid"
@@ -8,27 +12,116 @@ import (
 )
 
 type LatestMessageSchema struct {
-	Sender UserDataSchema `json:"sender"`
-	Text   *string        `json:"text"`
-	File   *string        `json:"file"`
+	Sender  *UserDataSchema           `json:"sender"` // null for system messages
+	Kind    choices.MessageKindChoice `json:"kind" example:"USER"`
+	Text    *string                   `json:"text"`
+	File    *string                   `json:"file"`
+	Payload *SystemMessagePayload     `json:"payload,omitempty"`
+}
+
+// The message a reply quotes, with the start of its text
+type QuotedMessageSchema struct {
+	ID     uuid.UUID       `json:"id" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
+	Sender *UserDataSchema `json:"sender"`
+	Text   *string         `json:"text" example:"Jesus is King"`
+	File   *string         `json:"file" example:"https://img.url"`
+}
+
+// What a system message is about. Users are kept as they were at the time.
+type SystemMessagePayload struct {
+	Event  string          `json:"event" example:"member_added"`
+	Actor  *UserDataSchema `json:"actor,omitempty"`                        // who did it
+	Target *UserDataSchema `json:"target,omitempty"`                       // who it was done to
+	Value  *string         `json:"value,omitempty" example:"Dopest Group"` // the group's new name
+}
+
+const (
+	SystemEventGroupCreated       = "group_created"
+	SystemEventGroupRenamed       = "group_renamed"
+	SystemEventDescriptionChanged = "description_changed"
+	SystemEventImageChanged       = "image_changed"
+	SystemEventMemberAdded        = "member_added"
+	SystemEventMemberRemoved      = "member_removed"
+	SystemEventMemberJoined       = "member_joined"
+	SystemEventMemberLeft         = "member_left"
+)
+
+// A human-readable description of the event, e.g "John Doe added Jane Doe"
+func (p SystemMessagePayload) Text() string {
+	name := func(user *UserDataSchema) string {
+		if user == nil {
+			return "Someone"
+		}
+		return user.Name
+	}
+	actor, target := name(p.Actor), name(p.Target)
+	value := ""
+	if p.Value != nil {
+		value = *p.Value
+	}
+	switch p.Event {
+	case SystemEventGroupCreated:
+		return fmt.Sprintf("%s created the group \"%s\"", actor, value)
+	case SystemEventGroupRenamed:
+		return fmt.Sprintf("%s renamed the group to \"%s\"", actor, value)
+	case SystemEventDescriptionChanged:
+		return actor + " changed the group description"
+	case SystemEventImageChanged:
+		return actor + " changed the group image"
+	case SystemEventMemberAdded:
+		return actor + " added " + target
+	case SystemEventMemberRemoved:
+		return actor + " removed " + target
+	case SystemEventMemberJoined:
+		return actor + " joined the group"
+	case SystemEventMemberLeft:
+		return actor + " left the group"
+	}
+	return ""
+}
+
+// Join & leave messages stored before the actor was named so kept it under "user"
+func (p *SystemMessagePayload) UnmarshalJSON(data []byte) error {
+	type payload SystemMessagePayload
+	decoded := struct {
+		payload
+		User *UserDataSchema `json:"user,omitempty"`
+	}{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*p = SystemMessagePayload(decoded.payload)
+	if p.Actor == nil {
+		p.Actor = decoded.User
+	}
+	return nil
 }
 
+const quotedTextLength = 100 // characters of the parent's text quoted in replies
+
 type Chat struct {
 	BaseModel
-	OwnerID        uuid.UUID              `json:"-"`
-	OwnerObj       User                   `json:"-" gorm:"foreignKey:OwnerID;constraint:OnDelete:CASCADE;<-:false"`
-	Owner          UserDataSchema         `gorm:"-" json:"owner"`
-	Name           *string                `gorm:"varchar(50)" json:"name" example:"My Group"`
-	Ctype          choices.ChatTypeChoice `gorm:"varchar(50);check:(ctype = 'GROUP' AND name IS NOT NULL) OR (ctype = 'DM')" json:"ctype" example:"DM"`
-	Description    *string                `gorm:"varchar(200);check:(ctype = 'DM' AND name IS NULL AND description IS NULL AND image_id IS NULL) OR (ctype = 'GROUP')" json:"description" example:"A nice group for tech enthusiasts"`
-	ImageID        *uuid.UUID             `json:"-"`
-	ImageObj       *File                  `gorm:"foreignKey:ImageID;constraint:OnDelete:SET NULL;<-:false" json:"-"`
-	Image          *string                `gorm:"-" json:"image" example:"https://img.url"`
-	UserObjs       []User                 `json:"-" gorm:"many2many:chat_users;"`
-	Messages       []Message              `json:"-"`
-	LatestMessage  *LatestMessageSchema   `gorm:"-" json:"latest_message"`
-	Users          []UserDataSchema       `gorm:"-" json:"users,omitempty"` // omitempty later to show for groups
-	FileUploadData *utils.SignatureFormat `gorm:"-" json:"file_upload_data,omitempty"`
+	OwnerID               uuid.UUID               `json:"-"`
+	OwnerObj              User                    `json:"-" gorm:"foreignKey:OwnerID;constraint:OnDelete:CASCADE;<-:false"`
+	Owner                 UserDataSchema          `gorm:"-" json:"owner"`
+	Name                  *string                 `gorm:"varchar(50)" json:"name" example:"My Group"`
+	Ctype                 choices.ChatTypeChoice  `gorm:"varchar(50);check:(ctype = 'GROUP' AND name IS NOT NULL) OR (ctype = 'DM')" json:"ctype" example:"DM"`
+	Description           *string                 `gorm:"varchar(200);check:(ctype = 'DM' AND name IS NULL AND description IS NULL AND image_id IS NULL) OR (ctype = 'GROUP')" json:"description" example:"A nice group for tech enthusiasts"`
+	ImageID               *uuid.UUID              `json:"-"`
+	ImageObj              *File                   `gorm:"foreignKey:ImageID;constraint:OnDelete:SET NULL;<-:false" json:"-"`
+	Image                 *string                 `gorm:"-" json:"image" example:"https://img.url"`
+	UserObjs              []User                  `json:"-" gorm:"many2many:chat_users;"`
+	MemberObjs            []ChatUser              `json:"-" gorm:"foreignKey:ChatID;<-:false"` // the chat_users rows, for their roles
+	OnlyAdminsCanPost     bool                    `json:"only_admins_can_post" gorm:"not null;default:false"`
+	OnlyAdminsCanEditInfo *bool                   `json:"only_admins_can_edit_info" gorm:"not null;default:true"`
+	JoinApprovalRequired  bool                    `json:"join_approval_required" gorm:"not null;default:false"` // joining by invite link needs an admin's approval
+	Messages              []Message               `json:"-"`
+	LatestMessage         *LatestMessageSchema    `gorm:"-" json:"latest_message"`
+	Users                 []UserDataSchema        `gorm:"-" json:"users,omitempty"` // omitempty later to show for groups
+	Admins                []UserDataSchema        `gorm:"-" json:"admins,omitempty"`
+	UserRole              *choices.ChatRoleChoice `gorm:"-" json:"user_role,omitempty" example:"ADMIN"` // the current user's role in a group
+	UnreadCount           int64                   `gorm:"-" json:"unread_count" example:"2"`
+	FileUploadData        *utils.SignatureFormat  `gorm:"-" json:"file_upload_data,omitempty"`
 }
 
 func (c *Chat) BeforeDelete(tx *gorm.DB) (err error) {
@@ -47,17 +140,13 @@ func (c Chat) Init() Chat {
 	latestMessages := c.Messages
 	if len(latestMessages) > 0 {
 		latestMessage := latestMessages[0]
-		file := latestMessage.FileObj
-		var fileUrl *string
-		if file != nil {
-			url := utils.GenerateFileUrl(file.ID.String(), "messages", file.ResourceType)
-			fileUrl = &url
-		}
 		lm := LatestMessageSchema{
-			Text: latestMessage.Text,
-			File: fileUrl,
+			Sender:  latestMessage.GetSender(),
+			Kind:    latestMessage.Kind,
+			Text:    latestMessage.GetText(),
+			File:    latestMessage.GetFileUrl(),
+			Payload: latestMessage.Payload,
 		}
-		lm.Sender = lm.Sender.Init(latestMessage.SenderObj)
 		c.LatestMessage = &lm
 	}
 	return c
@@ -66,13 +155,24 @@ func (c Chat) Init() Chat {
 func (c Chat) InitG() Chat {
 	// Init Group Chat
 	c = c.Init()
-	// Set Users Details for groups.
+	// Set Users & Admins Details for groups.
+	adminIDs := map[string]bool{}
+	for _, member := range c.MemberObjs {
+		if member.Role == choices.CRADMIN {
+			adminIDs[member.UserID.String()] = true
+		}
+	}
 	users := []UserDataSchema{}
+	admins := []UserDataSchema{}
 	for _, user := range c.UserObjs {
 		userData := UserDataSchema{}.Init(user)
 		users = append(users, userData)
+		if adminIDs[user.ID.String()] {
+			admins = append(admins, userData)
+		}
 	}
 	c.Users = users
+	c.Admins = admins
 	return c
 }
 
@@ -96,18 +196,36 @@ func (c Chat) InitC(fileType *string) Chat {
 	return c
 }
 
+// A member of a chat (the join table of Chat.UserObjs). The owner has no row, as Chat.OwnerID makes them a member.
+type ChatUser struct {
+	ChatID    uuid.UUID              `gorm:"primaryKey"`
+	UserID    uuid.UUID              `gorm:"primaryKey"`
+	Role      choices.ChatRoleChoice `gorm:"varchar(50);not null;default:MEMBER"`
+	CreatedAt time.Time
+}
+
 type Message struct {
 	BaseModel
-	SenderID       uuid.UUID              `json:"-"`
-	SenderObj      User                   `json:"-" gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE;<-:false;"`
-	Sender         UserDataSchema         `gorm:"-" json:"sender"`
-	ChatID         uuid.UUID              `json:"chat_id"`
-	ChatObj        Chat                   `json:"-" gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE;<-:false"`
-	Text           *string                `gorm:"varchar(1000000)" json:"text" example:"Jesus is King"`
-	FileID         *uuid.UUID             `json:"-"`
-	FileObj        *File                  `gorm:"foreignKey:FileID;constraint:OnDelete:SET NULL;<-:false" json:"-"`
-	File           *string                `gorm:"-" json:"file" example:"https://img.url"`
-	FileUploadData *utils.SignatureFormat `gorm:"-" json:"file_upload_data,omitempty"`
+	SenderID       *uuid.UUID                       `json:"-"` // null for system messages
+	SenderObj      User                             `json:"-" gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE;<-:false;"`
+	Sender         *UserDataSchema                  `gorm:"-" json:"sender"` // null for system messages
+	Kind           choices.MessageKindChoice        `gorm:"varchar(50);not null;default:USER" json:"kind" example:"USER"`
+	Payload        *SystemMessagePayload            `gorm:"serializer:json;type:jsonb" json:"payload,omitempty"` // what a system message is about
+	ChatID         uuid.UUID                        `json:"chat_id"`
+	ChatObj        Chat                             `json:"-" gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE;<-:false"`
+	Text           *string                          `gorm:"varchar(1000000)" json:"text" example:"Jesus is King"`
+	FileID         *uuid.UUID                       `json:"-"`
+	FileObj        *File                            `gorm:"foreignKey:FileID;constraint:OnDelete:SET NULL;<-:false" json:"-"`
+	File           *string                          `gorm:"-" json:"file" example:"https://img.url"`
+	Status         *choices.MessageStatusChoice     `gorm:"-" json:"status,omitempty" example:"READ"` // only set on the current user's messages
+	ParentID       *uuid.UUID                       `json:"-" gorm:"index"`
+	ParentObj      *Message                         `json:"-" gorm:"foreignKey:ParentID;constraint:OnDelete:SET NULL;<-:false"`
+	Parent         *QuotedMessageSchema             `gorm:"-" json:"parent"` // the message replied to, if it still exists
+	RepliesCount   int64                            `gorm:"-" json:"replies_count" example:"3"`
+	Reactions      map[choices.ReactionChoice]int64 `gorm:"-" json:"reactions"`                              // count of each reaction type
+	UserReaction   *choices.ReactionChoice          `gorm:"-" json:"user_reaction,omitempty" example:"LIKE"` // only set for the current user
+	FileUploadData *utils.SignatureFormat           `gorm:"-" json:"file_upload_data,omitempty"`
+	Snippet        *string                          `gorm:"-" json:"snippet,omitempty" example:"I am the <mark>danger</mark>"` // the matching text, in search results
 }
 
 func (m *Message) AfterCreate(tx *gorm.DB) (err error) {
@@ -118,15 +236,59 @@ func (m *Message) AfterCreate(tx *gorm.DB) (err error) {
 
 func (m Message) Init() Message {
 	// Set Author Details.
-	m.Sender = m.Sender.Init(m.SenderObj)
+	m.Sender = m.GetSender()
 
 	// Set FileUrl
+	m.File = m.GetFileUrl()
+
+	// Describe system messages
+	m.Text = m.GetText()
+
+	if m.Reactions == nil {
+		m.Reactions = map[choices.ReactionChoice]int64{}
+	}
+
+	// Set Quoted Parent
+	parent := m.ParentObj
+	if parent != nil && parent.ID != nil {
+		quoted := QuotedMessageSchema{ID: parent.ID, Sender: parent.GetSender(), File: parent.GetFileUrl()}
+		if parentText := parent.GetText(); parentText != nil {
+			text := []rune(*parentText)
+			if len(text) > quotedTextLength {
+				text = append(text[:quotedTextLength], '…')
+			}
+			quotedText := string(text)
+			quoted.Text = &quotedText
+		}
+		m.Parent = &quoted
+	}
+	return m
+}
+
+func (m Message) GetSender() *UserDataSchema {
+	if m.SenderID == nil {
+		return nil
+	}
+	sender := UserDataSchema{}.Init(m.SenderObj)
+	return &sender
+}
+
+// The message's text, or the description of a system message
+func (m Message) GetText() *string {
+	if m.Kind == choices.MKSYSTEM && m.Payload != nil {
+		text := m.Payload.Text()
+		return &text
+	}
+	return m.Text
+}
+
+func (m Message) GetFileUrl() *string {
 	file := m.FileObj
 	if file != nil {
 		url := utils.GenerateFileUrl(file.ID.String(), "messages", file.ResourceType)
-		m.File = &url
+		return &url
 	}
-	return m
+	return nil
 }
 
 func (m Message) InitC(fileType *string) Message {
@@ -139,3 +301,62 @@ func (m Message) InitC(fileType *string) Message {
 	}
 	return m
 }
+
+// How far a member has received & read a chat. Messages created up to LastDeliveredAt
+// have been fetched by the member, and those up to LastReadAt have been read.
+type ChatReadCursor struct {
+	BaseModel
+	ChatID             uuid.UUID      `json:"chat_id" gorm:"not null;uniqueIndex:idx_chat_read_cursors_chat_user"`
+	ChatObj            Chat           `json:"-" gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE;<-:false"`
+	UserID             uuid.UUID      `json:"-" gorm:"not null;uniqueIndex:idx_chat_read_cursors_chat_user"`
+	UserObj            User           `json:"-" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
+	User               UserDataSchema `gorm:"-" json:"user"`
+	LastReadMessageID  *uuid.UUID     `json:"last_read_message_id" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
+	LastReadMessageObj *Message       `json:"-" gorm:"foreignKey:LastReadMessageID;constraint:OnDelete:SET NULL;<-:false"`
+	LastReadAt         *time.Time     `json:"last_read_at" example:"2024-06-05T02:32:34.462196+01:00"`
+	LastDeliveredAt    *time.Time     `json:"last_delivered_at" example:"2024-06-05T02:32:34.462196+01:00"`
+}
+
+func (c ChatReadCursor) Init() ChatReadCursor {
+	c.User = c.User.Init(c.UserObj)
+	return c
+}
+
+// A shareable link to join a group. It stops working once revoked, expired or used MaxUses times.
+type ChatInvite struct {
+	BaseModel
+	ChatID     uuid.UUID      `json:"-" gorm:"not null;index"`
+	ChatObj    Chat           `json:"-" gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE;<-:false"`
+	CreatorID  uuid.UUID      `json:"-" gorm:"not null"`
+	CreatorObj User           `json:"-" gorm:"foreignKey:CreatorID;constraint:OnDelete:CASCADE;<-:false"`
+	Creator    UserDataSchema `gorm:"-" json:"creator"`
+	Token      string         `json:"token" gorm:"not null;uniqueIndex" example:"x3Pq2A9yTqYb8sJm1eC0gw"`
+	ExpiresAt  *time.Time     `json:"expires_at" example:"2024-06-05T02:32:34.462196+01:00"`
+	MaxUses    *int           `json:"max_uses" example:"10"`
+	Uses       int            `json:"uses" gorm:"not null;default:0" example:"2"`
+	RevokedAt  *time.Time     `json:"-"`
+	Link       string         `gorm:"-" json:"link" example:"https://pigeon.com/groups/join/x3Pq2A9yTqYb8sJm1eC0gw"`
+}
+
+func (i ChatInvite) Init(frontendURL string) ChatInvite {
+	i.Creator = i.Creator.Init(i.CreatorObj)
+	i.Link = fmt.Sprintf("%s/groups/join/%s", frontendURL, i.Token)
+	return i
+}
+
+// A pending request to join a group that requires approval
+type ChatJoinRequest struct {
+	BaseModel
+	ChatID    uuid.UUID      `json:"-" gorm:"not null;uniqueIndex:idx_chat_join_requests_chat_user"`
+	ChatObj   Chat           `json:"-" gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE;<-:false"`
+	UserID    uuid.UUID      `json:"-" gorm:"not null;uniqueIndex:idx_chat_join_requests_chat_user"`
+	UserObj   User           `json:"-" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
+	User      UserDataSchema `gorm:"-" json:"user"`
+	InviteID  *uuid.UUID     `json:"-"`
+	InviteObj *ChatInvite    `json:"-" gorm:"foreignKey:InviteID;constraint:OnDelete:SET NULL;<-:false"`
+}
+
+func (r ChatJoinRequest) Init() ChatJoinRequest {
+	r.User = r.User.Init(r.UserObj)
+	return r
+}
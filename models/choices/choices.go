@@ -11,13 +11,24 @@ const (
 	RANGRY ReactionChoice = "ANGRY"
 )
 
+type PostAudienceChoice string
+
+const (
+	PAPUBLIC  PostAudienceChoice = "PUBLIC"
+	PAFRIENDS PostAudienceChoice = "FRIENDS"
+	PAONLYME  PostAudienceChoice = "ONLY_ME"
+	PACUSTOM  PostAudienceChoice = "CUSTOM" // only the users chosen by the author
+)
+
 type NotificationChoice string
 
 const (
-	NREACTION NotificationChoice = "REACTION"
-	NCOMMENT  NotificationChoice = "COMMENT"
-	NREPLY    NotificationChoice = "REPLY"
-	NADMIN    NotificationChoice = "ADMIN"
+	NREACTION      NotificationChoice = "REACTION"
+	NCOMMENT       NotificationChoice = "COMMENT"
+	NREPLY         NotificationChoice = "REPLY"
+	NADMIN         NotificationChoice = "ADMIN"
+	NFOLLOW        NotificationChoice = "FOLLOW"
+	NFOLLOWREQUEST NotificationChoice = "FOLLOW_REQUEST"
 )
 
 type FriendStatusChoice string
@@ -27,6 +38,13 @@ const (
 	FACCEPTED FriendStatusChoice = "ACCEPTED"
 )
 
+type FollowStatusChoice string
+
+const (
+	FLPENDING  FollowStatusChoice = "PENDING" // waiting for the approval of an account that approves its followers
+	FLACCEPTED FollowStatusChoice = "ACCEPTED"
+)
+
 type ChatTypeChoice string
 
 const (
@@ -41,3 +59,34 @@ const (
 	FTCOMMENT FocusTypeChoice = "COMMENT"
 	FTREPLY   FocusTypeChoice = "REPLY"
 )
+
+type OtpPurposeChoice string
+
+const (
+	OPVERIFYEMAIL   OtpPurposeChoice = "VERIFY_EMAIL"
+	OPPASSWORDRESET OtpPurposeChoice = "PASSWORD_RESET"
+	OPEMAILCHANGE   OtpPurposeChoice = "EMAIL_CHANGE"
+)
+
+type MessageStatusChoice string
+
+const (
+	MSSENT      MessageStatusChoice = "SENT"
+	MSDELIVERED MessageStatusChoice = "DELIVERED"
+	MSREAD      MessageStatusChoice = "READ"
+)
+
+type ChatRoleChoice string
+
+const (
+	CROWNER  ChatRoleChoice = "OWNER" // not stored on memberships, the owner is Chat.OwnerID
+	CRADMIN  ChatRoleChoice = "ADMIN"
+	CRMEMBER ChatRoleChoice = "MEMBER"
+)
+
+type MessageKindChoice string
+
+const (
+	MKUSER   MessageKindChoice = "USER"
+	MKSYSTEM MessageKindChoice = "SYSTEM" // sent by the app about the chat (someone joined, left...), with no sender
+)
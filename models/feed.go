@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/pborman/uuid"
@@ -16,6 +18,7 @@ type FeedAbstract struct {
 	Slug           string         `gorm:"unique;not null;" json:"slug"`
 	Reactions      []Reaction     `json:"-"`
 	ReactionsCount int            `json:"reactions_count" gorm:"-"`
+	Snippet        *string        `json:"snippet,omitempty" gorm:"-" example:"the <mark>danger</mark>"` // the matching text, in search results
 }
 
 type Post struct {
@@ -26,6 +29,11 @@ type Post struct {
 	Comments       []Comment              `json:"-"`
 	CommentsCount  int                    `json:"comments_count" gorm:"-"`
 	FileUploadData *utils.SignatureFormat `gorm:"-" json:"file_upload_data,omitempty"`
+
+	// Who can see the post (and its comments, replies & reactions) besides the author
+	Audience          choices.PostAudienceChoice `gorm:"varchar(50);not null;default:PUBLIC" json:"audience" example:"PUBLIC"`
+	AudienceUsers     []User                     `gorm:"many2many:post_audience_users;" json:"-"`                  // the users of a CUSTOM audience
+	AudienceUsernames []string                   `gorm:"-" json:"audience_usernames,omitempty" example:"john-doe"` // only shown to the author
 }
 
 func (p Post) Init() Post {
@@ -88,7 +96,7 @@ func (r Reply) Init() Reply {
 
 type Reaction struct {
 	BaseModel
-	UserID    uuid.UUID              `json:"-" gorm:"not null;index:,unique,composite:user_id_post_id;index:,unique,composite:user_id_comment_id;index:,unique,composite:user_id_reply_id"`
+	UserID    uuid.UUID              `json:"-" gorm:"not null;index:,unique,composite:user_id_post_id;index:,unique,composite:user_id_comment_id;index:,unique,composite:user_id_reply_id;index:,unique,composite:user_id_message_id"`
 	UserObj   User                   `json:"-" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
 	User      UserDataSchema         `gorm:"-" json:"user"`
 	Rtype     choices.ReactionChoice `gorm:"varchar(50)" json:"rtype" example:"LIKE"`
@@ -98,6 +106,8 @@ type Reaction struct {
 	Comment   *Comment               `json:"-" gorm:"foreignKey:CommentID;constraint:OnDelete:CASCADE;<-:false"`
 	ReplyID   *uuid.UUID             `json:"-" gorm:"null;index:,unique,composite:user_id_reply_id"`
 	Reply     *Reply                 `json:"-" gorm:"foreignKey:ReplyID;constraint:OnDelete:CASCADE;<-:false"`
+	MessageID *uuid.UUID             `json:"-" gorm:"null;index:,unique,composite:user_id_message_id"`
+	Message   *Message               `json:"-" gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE;<-:false"`
 }
 
 func (r *Reaction) Init() {
@@ -113,3 +123,20 @@ func (r *Reaction) AfterCreate(tx *gorm.DB) (err error) {
 	r.Init()
 	return
 }
+
+// The ranked posts of a user's home feed at a point in time. Pages are read from it,
+// so changes in between (new posts, reactions, friends, follows...) don't reorder them.
+type HomeFeedSnapshot struct {
+	BaseModel
+	UserID    uuid.UUID `gorm:"not null;index"`
+	UserObj   User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;<-:false"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type HomeFeedSnapshotPost struct {
+	SnapshotID  uuid.UUID        `gorm:"primaryKey"`
+	SnapshotObj HomeFeedSnapshot `gorm:"foreignKey:SnapshotID;constraint:OnDelete:CASCADE;<-:false"`
+	PostID      uuid.UUID        `gorm:"primaryKey"`
+	PostObj     Post             `gorm:"foreignKey:PostID;constraint:OnDelete:CASCADE;<-:false"`
+	Score       float64          `gorm:"not null"`
+}
@@ -15,6 +15,34 @@ type Friend struct {
 	Status      choices.FriendStatusChoice `gorm:"varchar(50)"`
 }
 
+// A one-way follow. Following an account that approves its followers is PENDING until it does.
+type Follow struct {
+	BaseModel
+	FollowerID  uuid.UUID                  `gorm:"not null;uniqueIndex:idx_follows_follower_followee"`
+	FollowerObj User                       `gorm:"foreignKey:FollowerID;constraint:OnDelete:CASCADE;<-:false"`
+	FolloweeID  uuid.UUID                  `gorm:"not null;uniqueIndex:idx_follows_follower_followee;check:follower_id <> followee_id"`
+	FolloweeObj User                       `gorm:"foreignKey:FolloweeID;constraint:OnDelete:CASCADE;<-:false"`
+	Status      choices.FollowStatusChoice `gorm:"varchar(50);not null"`
+}
+
+// A block hides the users' content from each other and stops the blocked user from reaching the blocker
+type Block struct {
+	BaseModel
+	BlockerID  uuid.UUID `gorm:"not null;uniqueIndex:idx_blocks_blocker_blocked"`
+	BlockerObj User      `gorm:"foreignKey:BlockerID;constraint:OnDelete:CASCADE;<-:false"`
+	BlockedID  uuid.UUID `gorm:"not null;uniqueIndex:idx_blocks_blocker_blocked;check:blocker_id <> blocked_id"`
+	BlockedObj User      `gorm:"foreignKey:BlockedID;constraint:OnDelete:CASCADE;<-:false"`
+}
+
+// A mute only hides the muted user's content & notifications from the muter
+type Mute struct {
+	BaseModel
+	MuterID  uuid.UUID `gorm:"not null;uniqueIndex:idx_mutes_muter_muted"`
+	MuterObj User      `gorm:"foreignKey:MuterID;constraint:OnDelete:CASCADE;<-:false"`
+	MutedID  uuid.UUID `gorm:"not null;uniqueIndex:idx_mutes_muter_muted;check:muter_id <> muted_id"`
+	MutedObj User      `gorm:"foreignKey:MutedID;constraint:OnDelete:CASCADE;<-:false"`
+}
+
 type Notification struct {
 	BaseModel
 	SenderID  *uuid.UUID                 `gorm:"null" json:"-"`
@@ -105,6 +133,10 @@ func (n Notification) GetMessage() string {
 		message = sender + " commented on your post"
 	} else if ntype == "REPLY" {
 		message = sender + " replied your comment"
+	} else if ntype == "FOLLOW" {
+		message = sender + " started following you"
+	} else if ntype == "FOLLOW_REQUEST" {
+		message = sender + " requested to follow you"
 	}
 	return message
 }
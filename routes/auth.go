@@ -1,13 +1,21 @@
 package routes
 
 import (
+	"log"
+	"strings"
+
+	"github.com/acatalepsy17/pigeon/managers"
 	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/schemas"
 	"github.com/acatalepsy17/pigeon/senders"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/gofiber/fiber/v2"
 )
 
+var otpManager = managers.OtpManager{}
+var passwordManager = managers.PasswordManager{}
+
 // @Summary Register a new user
 // @Description `This endpoint registers new users into our application.`
 // @Tags Auth
@@ -25,6 +33,14 @@ func (ep Endpoint) SignUp(c *fiber.Ctx) error {
 		return c.Status(*errCode).JSON(errData)
 	}
 
+	// Same password policy as password changes & resets
+	if errMsg := utils.CheckPasswordPolicy(data.Password); errMsg != nil {
+		data := map[string]string{
+			"password": *errMsg,
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+
 	user := utils.ConvertStructData(data, models.User{}).(*models.User)
 	// Validate email uniqueness
 	db.Take(&user, models.User{Email: user.Email})
@@ -39,10 +55,8 @@ func (ep Endpoint) SignUp(c *fiber.Ctx) error {
 	db.Create(&user)
 
 	// Send Email
-	otp := models.Otp{UserId: user.ID}
-	db.Take(&otp, otp)
-	db.Save(&otp) // Create or save
-	go senders.SendEmail(user, "activate", &otp.Code)
+	code, _, _ := otpManager.Create(db, *user, choices.OPVERIFYEMAIL)
+	go senders.SendEmail(user, "activate", code)
 
 	response := schemas.RegisterResponseSchema{
 		ResponseSchema: SuccessResponse("Registration successful"),
@@ -57,6 +71,7 @@ func (ep Endpoint) SignUp(c *fiber.Ctx) error {
 // @Param verify_email body schemas.VerifyEmailRequestSchema true "Verify Email object"
 // @Success 200 {object} schemas.ResponseSchema
 // @Failure 422 {object} utils.ErrorResponse
+// @Failure 429 {object} utils.ErrorResponse
 // @Router /auth/verify_email [post]
 func (ep Endpoint) VerifyEmail(c *fiber.Ctx) error {
 	db := ep.DB
@@ -68,9 +83,14 @@ func (ep Endpoint) VerifyEmail(c *fiber.Ctx) error {
 		return c.Status(*errCode).JSON(errData)
 	}
 
+	if errCode, errData := throttleManager.Check(db, THROTTLE_VERIFY_EMAIL, data.Email, c.IP()); errData != nil {
+		return ThrottledResponse(c, *errCode, errData)
+	}
+
 	user := models.User{Email: data.Email}
 	db.Take(&user, user)
 	if user.ID == nil {
+		RecordFailedAttempt(c, db, THROTTLE_VERIFY_EMAIL, data.Email, nil)
 		return c.Status(404).JSON(utils.RequestErr(utils.ERR_INCORRECT_EMAIL, "Incorrect Email"))
 	}
 
@@ -78,15 +98,13 @@ func (ep Endpoint) VerifyEmail(c *fiber.Ctx) error {
 		return c.Status(200).JSON(SuccessResponse("Email already verified"))
 	}
 
-	otp := models.Otp{UserId: user.ID}
-	db.Take(&otp, otp)
-	if otp.ID == nil || otp.Code != data.Otp {
-		return c.Status(404).JSON(utils.RequestErr(utils.ERR_INCORRECT_OTP, "Incorrect Otp"))
-	}
-
-	if otp.CheckExpiration() {
-		return c.Status(400).JSON(utils.RequestErr(utils.ERR_EXPIRED_OTP, "Expired Otp"))
+	if _, errCode, errData := otpManager.Verify(db, user, choices.OPVERIFYEMAIL, data.Otp); errData != nil {
+		if errData.Code == utils.ERR_INCORRECT_OTP {
+			RecordFailedAttempt(c, db, THROTTLE_VERIFY_EMAIL, data.Email, &user)
+		}
+		return c.Status(*errCode).JSON(errData)
 	}
+	throttleManager.Reset(db, THROTTLE_VERIFY_EMAIL, data.Email)
 
 	// Update User
 	user.IsEmailVerified = true
@@ -125,10 +143,11 @@ func (ep Endpoint) ResendVerificationEmail(c *fiber.Ctx) error {
 	}
 
 	// Send Email
-	otp := models.Otp{UserId: user.ID}
-	db.Take(&otp, otp)
-	db.Save(&otp) // Create or save
-	go senders.SendEmail(&user, "activate", &otp.Code)
+	code, errCode, errData := otpManager.Create(db, user, choices.OPVERIFYEMAIL)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	go senders.SendEmail(&user, "activate", code)
 
 	return c.Status(200).JSON(SuccessResponse("Verification email sent"))
 }
@@ -158,10 +177,11 @@ func (ep Endpoint) SendPasswordResetOtp(c *fiber.Ctx) error {
 	}
 
 	// Send Email
-	otp := models.Otp{UserId: user.ID}
-	db.Take(&otp, otp)
-	db.Save(&otp) // Create or save
-	go senders.SendEmail(&user, "reset", &otp.Code)
+	code, errCode, errData := otpManager.Create(db, user, choices.OPPASSWORDRESET)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	go senders.SendEmail(&user, "reset", code)
 
 	return c.Status(200).JSON(SuccessResponse("Password otp sent"))
 }
@@ -173,6 +193,7 @@ func (ep Endpoint) SendPasswordResetOtp(c *fiber.Ctx) error {
 // @Success 200 {object} schemas.ResponseSchema
 // @Failure 422 {object} utils.ErrorResponse
 // @Failure 404 {object} utils.ErrorResponse
+// @Failure 429 {object} utils.ErrorResponse
 // @Router /auth/set_new_password [post]
 func (ep Endpoint) SetNewPassword(c *fiber.Ctx) error {
 	db := ep.DB
@@ -184,25 +205,37 @@ func (ep Endpoint) SetNewPassword(c *fiber.Ctx) error {
 		return c.Status(*errCode).JSON(errData)
 	}
 
+	if errCode, errData := throttleManager.Check(db, THROTTLE_SET_NEW_PASSWORD, data.Email, c.IP()); errData != nil {
+		return ThrottledResponse(c, *errCode, errData)
+	}
+
 	user := models.User{Email: data.Email}
 	db.Take(&user, user)
 	if user.ID == nil {
+		RecordFailedAttempt(c, db, THROTTLE_SET_NEW_PASSWORD, data.Email, nil)
 		return c.Status(404).JSON(utils.RequestErr(utils.ERR_INCORRECT_EMAIL, "Incorrect Email"))
 	}
 
-	otp := models.Otp{UserId: user.ID}
-	db.Take(&otp, otp)
-	if otp.ID == nil || otp.Code != data.Otp {
-		return c.Status(404).JSON(utils.RequestErr(utils.ERR_INCORRECT_OTP, "Incorrect Otp"))
+	// The otp is checked first, so nothing about the account's passwords is revealed without it
+	if _, errCode, errData := otpManager.Verify(db, user, choices.OPPASSWORDRESET, data.Otp); errData != nil {
+		if errData.Code == utils.ERR_INCORRECT_OTP {
+			RecordFailedAttempt(c, db, THROTTLE_SET_NEW_PASSWORD, data.Email, &user)
+		}
+		return c.Status(*errCode).JSON(errData)
 	}
+	throttleManager.Reset(db, THROTTLE_SET_NEW_PASSWORD, data.Email)
 
-	if otp.CheckExpiration() {
-		return c.Status(400).JSON(utils.RequestErr(utils.ERR_EXPIRED_OTP, "Expired Otp"))
+	// The otp is used up at this point, so a rejected password needs a new one
+	if errMsg := passwordManager.Validate(db, user, data.Password); errMsg != nil {
+		data := map[string]string{
+			"password": *errMsg,
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
 	}
 
-	// Set Password
-	user.Password = utils.HashPassword(data.Password)
-	db.Save(&user)
+	// Set Password & sign out every session, as the old password may have been compromised
+	passwordManager.SetPassword(db, &user, data.Password)
+	sessionManager.RevokeAll(db, user)
 
 	// Send Email
 	go senders.SendEmail(&user, "reset-success", nil)
@@ -210,14 +243,95 @@ func (ep Endpoint) SetNewPassword(c *fiber.Ctx) error {
 	return c.Status(200).JSON(SuccessResponse("Password reset successful"))
 }
 
+// @Summary Change password
+// @Description `This endpoint changes the password of the signed in user and signs out every other session.`
+// @Tags Auth
+// @Param passwords body schemas.ChangePasswordSchema true "Current & new password"
+// @Success 200 {object} schemas.ResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Router /auth/change_password [post]
+// @Security BearerAuth
+func (ep Endpoint) ChangePassword(c *fiber.Ctx) error {
+	db := ep.DB
+	user := RequestUser(c)
+	session := RequestSession(c)
+
+	data := schemas.ChangePasswordSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	// Check if current password is valid. Users who signed up with an identity provider can set one without it.
+	if user.Password != "" && !utils.CheckPasswordHash(data.CurrentPassword, user.Password) {
+		data := map[string]string{
+			"current_password": "Incorrect password",
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+
+	if errMsg := passwordManager.Validate(db, *user, data.NewPassword); errMsg != nil {
+		data := map[string]string{
+			"new_password": *errMsg,
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+
+	// Set Password & sign out other devices
+	passwordManager.SetPassword(db, user, data.NewPassword)
+	sessionManager.RevokeAll(db, *user, session.ID)
+
+	// Send Email
+	go senders.SendEmail(user, "password-changed", nil)
+
+	return c.Status(200).JSON(SuccessResponse("Password changed successfully"))
+}
+
+// @Summary Cancel a pending email change
+// @Description `This endpoint cancels a pending email change with the token from the link sent to the current address.`
+// @Tags Auth
+// @Param token body schemas.CancelEmailChangeSchema true "Cancel token"
+// @Success 200 {object} schemas.ResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Router /auth/cancel_email_change [post]
+func (ep Endpoint) CancelEmailChange(c *fiber.Ctx) error {
+	db := ep.DB
+
+	data := schemas.CancelEmailChangeSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	payload := DecodeEmailChangeCancelToken(data.Token)
+	if payload == nil {
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Token is invalid or expired"))
+	}
+	user := models.User{BaseModel: models.BaseModel{ID: payload.UserId}}
+	otp := otpManager.Get(db, user, choices.OPEMAILCHANGE)
+	if otp == nil || otp.Target == nil || *otp.Target != payload.Email {
+		return c.Status(200).JSON(SuccessResponse("No pending email change"))
+	}
+	otpManager.Delete(db, otp)
+	return c.Status(200).JSON(SuccessResponse("Email change cancelled"))
+}
+
 // @Summary Login a user
 // @Description This endpoint generates new access and refresh tokens for authentication
+// @Description
+// @Description `If the user has two-factor auth enabled, a 200 response with mfa_required and a challenge_token is returned instead. Exchange it at /auth/sign_in/mfa.`
 // @Tags Auth
 // @Param user body schemas.LoginSchema true "User login"
-// @Success 201 {object} schemas.ResponseSchema
+// @Success 201 {object} schemas.LoginResponseSchema
+// @Success 200 {object} schemas.MfaChallengeResponseSchema
 // @Failure 422 {object} utils.ErrorResponse
 // @Failure 401 {object} utils.ErrorResponse
 // @Security GuestUserAuth
+// @Failure 429 {object} utils.ErrorResponse
 // @Router /auth/sign_in [post]
 func (ep Endpoint) SignIn(c *fiber.Ctx) error {
 	db := ep.DB
@@ -229,36 +343,309 @@ func (ep Endpoint) SignIn(c *fiber.Ctx) error {
 		return c.Status(*errCode).JSON(errData)
 	}
 
+	if errCode, errData := throttleManager.Check(db, THROTTLE_SIGN_IN, data.Email, c.IP()); errData != nil {
+		return ThrottledResponse(c, *errCode, errData)
+	}
+
 	user := models.User{Email: data.Email}
 	db.Take(&user, user)
 	if user.ID == nil || !utils.CheckPasswordHash(data.Password, user.Password) {
+		RecordFailedAttempt(c, db, THROTTLE_SIGN_IN, data.Email, &user)
 		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_CREDENTIALS, "Invalid Credentials"))
 	}
+	if !user.TotpEnabled {
+		// Otherwise the failures are only cleared once the second factor succeeds
+		throttleManager.Reset(db, THROTTLE_SIGN_IN, data.Email)
+	}
 
 	if !user.IsEmailVerified {
 		return c.Status(401).JSON(utils.RequestErr(utils.ERR_UNVERIFIED_USER, "Verify your email first"))
 	}
 
-	// Create Auth Tokens
-	access := GenerateAccessToken(user.ID, user.Username)
-	user.Access = &access
-	refresh := GenerateRefreshToken()
-	user.Refresh = &refresh
-	db.Save(&user)
+	return IssueAuthResponse(c, db, user, data.DeviceName)
+}
+
+var oidcManager = managers.OidcManager{}
+
+// @Summary Start a social (OpenID Connect) login
+// @Description This endpoint returns the identity provider's authorization url to redirect the user to.
+// @Description
+// @Description `The provider redirects back to the frontend with a code & state which should be posted to /auth/oidc/callback.`
+// @Tags Auth
+// @Param device_name query string false "Name of the device signing in"
+// @Success 200 {object} schemas.OidcAuthorizeResponseSchema
+// @Failure 404 {object} utils.ErrorResponse
+// @Router /auth/oidc/authorize [get]
+func (ep Endpoint) OidcAuthorize(c *fiber.Ctx) error {
+	db := ep.DB
+	if ep.Oidc == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Social login is not enabled"))
+	}
+
+	var deviceName *string
+	if name := c.Query("device_name"); name != "" {
+		if len(name) > 255 {
+			name = name[:255]
+		}
+		deviceName = &name
+	}
+	loginRequest := oidcManager.CreateLoginRequest(db, deviceName)
+	authorizationURL, err := ep.Oidc.AuthorizationURL(loginRequest.State, loginRequest.Nonce, loginRequest.CodeVerifier)
+	if err != nil {
+		log.Println("OIDC discovery failed:", err)
+		return c.Status(502).JSON(utils.RequestErr(utils.ERR_NETWORK_FAILURE, "Identity provider is unavailable"))
+	}
+
+	response := schemas.OidcAuthorizeResponseSchema{
+		ResponseSchema: SuccessResponse("Redirect to the identity provider"),
+		Data:           schemas.OidcAuthorizeSchema{AuthorizationURL: authorizationURL, State: loginRequest.State},
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Complete a social (OpenID Connect) login
+// @Description This endpoint exchanges the code returned by the identity provider for access and refresh tokens.
+// @Description
+// @Description `A user is created (or linked by verified email) on first login. As with sign in, a 200 response with mfa_required may be returned instead.`
+// @Tags Auth
+// @Param callback body schemas.OidcCallbackSchema true "Code & state"
+// @Success 201 {object} schemas.LoginResponseSchema
+// @Success 200 {object} schemas.MfaChallengeResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Router /auth/oidc/callback [post]
+func (ep Endpoint) OidcCallback(c *fiber.Ctx) error {
+	db := ep.DB
+	if ep.Oidc == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Social login is not enabled"))
+	}
+
+	data := schemas.OidcCallbackSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	loginRequest := oidcManager.PopLoginRequest(db, data.State)
+	if loginRequest == nil {
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_AUTH, "Login request is invalid or expired"))
+	}
+	claims, err := ep.Oidc.Exchange(data.Code, loginRequest.CodeVerifier, loginRequest.Nonce)
+	if err != nil {
+		log.Println("OIDC login failed:", err)
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_AUTH, "Unable to verify your identity"))
+	}
+
+	firstName, lastName := oidcNames(claims)
+	user, errCode, errData := oidcManager.GetOrCreateUser(db, ep.Oidc.Issuer, claims.Subject, claims.Email, claims.EmailVerified, firstName, lastName)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	return IssueAuthResponse(c, db, *user, loginRequest.DeviceName)
+}
+
+// Names for a new user, falling back to the full name or the email when the provider omits them
+func oidcNames(claims *OidcIDTokenClaims) (string, string) {
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" {
+		names := strings.Fields(claims.Name)
+		if len(names) == 0 {
+			names = []string{strings.Split(claims.Email, "@")[0]}
+		}
+		firstName = names[0]
+		if lastName == "" {
+			lastName = strings.Join(names[1:], " ")
+		}
+	}
+	return firstName, lastName
+}
+
+var mfaManager = managers.MfaManager{}
+
+// @Summary Complete a MFA sign in
+// @Description This endpoint exchanges the challenge token returned by sign in (when `mfa_required` is true) and a TOTP or recovery code for access and refresh tokens.
+// @Tags Auth
+// @Param mfa body schemas.MfaSignInSchema true "MFA sign in object"
+// @Success 201 {object} schemas.LoginResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 429 {object} utils.ErrorResponse
+// @Router /auth/sign_in/mfa [post]
+func (ep Endpoint) SignInMfa(c *fiber.Ctx) error {
+	db := ep.DB
+
+	data := schemas.MfaSignInSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	claims := DecodeMfaChallengeToken(data.ChallengeToken)
+	if claims == nil {
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Challenge token is invalid or expired"))
+	}
+	user := models.User{}
+	db.Take(&user, claims.UserId)
+	if user.ID == nil || !user.TotpEnabled {
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Challenge token is invalid or expired"))
+	}
+
+	// Second factor failures count towards the same sign in throttle
+	if errCode, errData := throttleManager.Check(db, THROTTLE_SIGN_IN, user.Email, c.IP()); errData != nil {
+		return ThrottledResponse(c, *errCode, errData)
+	}
+	// A challenge token can only be exchanged once
+	unused, verified := mfaManager.CompleteChallenge(db, &user, claims.ID, claims.ExpiresAt.Time, data.Code, data.RecoveryCode)
+	if !unused {
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Challenge token is invalid or expired"))
+	}
+	if !verified {
+		RecordFailedAttempt(c, db, THROTTLE_SIGN_IN, user.Email, &user)
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INCORRECT_MFA_CODE, "Incorrect code"))
+	}
+	throttleManager.Reset(db, THROTTLE_SIGN_IN, user.Email)
+
+	tokens := CreateSession(c, db, user, claims.DeviceName)
 	response := schemas.LoginResponseSchema{
 		ResponseSchema: SuccessResponse("Login successful"),
-		Data:           schemas.TokensResponseSchema{Access: *user.Access, Refresh: *user.Refresh},
+		Data:           tokens,
 	}
 	return c.Status(201).JSON(response)
 }
 
+// @Summary Start TOTP enrollment
+// @Description This endpoint generates a new TOTP secret for the authenticated user.
+// @Description
+// @Description `Render the qr_code_payload as a QR code for authenticator apps, then confirm it with a code to enable two-factor auth.`
+// @Tags Auth
+// @Param password body schemas.TotpEnrollSchema true "Password"
+// @Success 200 {object} schemas.TotpEnrollResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Router /auth/mfa/totp [post]
+// @Security BearerAuth
+func (ep Endpoint) EnrollTotp(c *fiber.Ctx) error {
+	db := ep.DB
+	user := RequestUser(c)
+
+	data := schemas.TotpEnrollSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	if user.Password != "" && !utils.CheckPasswordHash(data.Password, user.Password) {
+		data := map[string]string{
+			"password": "Incorrect password",
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+	if user.TotpEnabled {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Two-factor auth is already enabled"))
+	}
+
+	secret := mfaManager.StartTotpEnrollment(db, user)
+	issuer := cfg.ProjectName
+	if issuer == "" {
+		issuer = "Pigeon"
+	}
+	uri := utils.TotpProvisioningURI(secret, issuer, user.Email)
+	response := schemas.TotpEnrollResponseSchema{
+		ResponseSchema: SuccessResponse("Scan the code with your authenticator app"),
+		Data: schemas.TotpEnrollResponseDataSchema{
+			Secret:          secret,
+			ProvisioningURI: uri,
+			QrCodePayload:   uri,
+		},
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Confirm TOTP enrollment
+// @Description This endpoint enables two-factor auth once a code from the authenticator app is confirmed.
+// @Description
+// @Description `The recovery codes in the response are only shown once. Each of them can be used a single time in place of a TOTP code.`
+// @Tags Auth
+// @Param code body schemas.TotpCodeSchema true "TOTP code"
+// @Success 200 {object} schemas.RecoveryCodesResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Router /auth/mfa/totp/confirm [post]
+// @Security BearerAuth
+func (ep Endpoint) ConfirmTotp(c *fiber.Ctx) error {
+	db := ep.DB
+	user := RequestUser(c)
+
+	data := schemas.TotpCodeSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	if user.TotpEnabled {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Two-factor auth is already enabled"))
+	}
+	if user.TotpSecret == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Start the TOTP enrollment first"))
+	}
+	if !mfaManager.VerifyTotp(db, user, data.Code) {
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INCORRECT_MFA_CODE, "Incorrect code"))
+	}
+
+	recoveryCodes := mfaManager.EnableTotp(db, user)
+	response := schemas.RecoveryCodesResponseSchema{
+		ResponseSchema: SuccessResponse("Two-factor auth enabled"),
+		Data:           schemas.RecoveryCodesResponseDataSchema{RecoveryCodes: recoveryCodes},
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Disable TOTP
+// @Description This endpoint disables two-factor auth and deletes the remaining recovery codes.
+// @Tags Auth
+// @Param data body schemas.TotpDisableSchema true "Password and TOTP or recovery code"
+// @Success 200 {object} schemas.ResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Router /auth/mfa/totp/disable [post]
+// @Security BearerAuth
+func (ep Endpoint) DisableTotp(c *fiber.Ctx) error {
+	db := ep.DB
+	user := RequestUser(c)
+
+	data := schemas.TotpDisableSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	if !user.TotpEnabled {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Two-factor auth is not enabled"))
+	}
+	if user.Password != "" && !utils.CheckPasswordHash(data.Password, user.Password) {
+		data := map[string]string{
+			"password": "Incorrect password",
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+	if !mfaManager.VerifySecondFactor(db, user, data.Code, data.RecoveryCode) {
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INCORRECT_MFA_CODE, "Incorrect code"))
+	}
+
+	mfaManager.DisableTotp(db, user)
+	return c.Status(200).JSON(SuccessResponse("Two-factor auth disabled"))
+}
+
 // @Summary Refresh tokens
-// @Description This endpoint refresh tokens by generating new access and refresh tokens for a user
+// @Description This endpoint refresh tokens by generating new access and refresh tokens for a user's session.
+// @Description
+// @Description `Each refresh token can only be used once. Reusing an old refresh token revokes the whole session.`
 // @Tags Auth
 // @Param refresh body schemas.RefreshTokenSchema true "Refresh token"
-// @Success 201 {object} schemas.ResponseSchema
+// @Success 201 {object} schemas.LoginResponseSchema
 // @Failure 422 {object} utils.ErrorResponse
-// @Failure 404 {object} utils.ErrorResponse
 // @Failure 401 {object} utils.ErrorResponse
 // @Router /auth/refresh_token [post]
 func (ep Endpoint) RefreshToken(c *fiber.Ctx) error {
@@ -271,19 +658,37 @@ func (ep Endpoint) RefreshToken(c *fiber.Ctx) error {
 	}
 
 	token := data.Refresh
-	user := models.User{Refresh: &token}
-	db.Take(&user, user)
-	if user.ID == nil || !DecodeRefreshToken(token) {
+	claims := DecodeRefreshToken(token)
+	if claims == nil {
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Refresh token is invalid or expired"))
+	}
+	session := sessionManager.GetByID(db, claims.SessionID)
+	if session == nil {
 		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Refresh token is invalid or expired"))
+	}
+	if session.RefreshHash != utils.HashToken(token) {
+		// A validly signed but already rotated token means it has been stolen (or replayed).
+		// Kill the whole token family (session) so neither party can continue with it.
+		log.Println("Refresh token reuse detected for session: ", session.ID.String())
+		sessionManager.Revoke(db, session)
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Refresh token has already been used. Session revoked"))
+	}
 
+	user := models.User{}
+	db.Take(&user, session.UserID)
+	if user.ID == nil {
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Refresh token is invalid or expired"))
 	}
 
-	// Create and Update Auth Tokens
-	access := GenerateAccessToken(user.ID, user.Username)
-	user.Access = &access
-	refresh := GenerateRefreshToken()
-	user.Refresh = &refresh
-	db.Save(&user)
+	// Rotate the session's tokens
+	access := GenerateAccessToken(user.ID, user.Username, session.ID)
+	refresh := GenerateRefreshToken(session.ID)
+	if !sessionManager.Rotate(db, session, token, refresh, c.Get("User-Agent"), c.IP()) {
+		// Another request used the same token at the same time: reuse as well
+		log.Println("Refresh token reuse detected for session: ", session.ID.String())
+		sessionManager.Revoke(db, session)
+		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, "Refresh token has already been used. Session revoked"))
+	}
 
 	response := schemas.LoginResponseSchema{
 		ResponseSchema: SuccessResponse("Tokens refresh successful"),
@@ -293,7 +698,7 @@ func (ep Endpoint) RefreshToken(c *fiber.Ctx) error {
 }
 
 // @Summary Logout a user
-// @Description This endpoint logs a user out from our application
+// @Description This endpoint logs a user out of the current session (device)
 // @Tags Auth
 // @Success 200 {object} schemas.ResponseSchema
 // @Failure 401 {object} utils.ErrorResponse
@@ -301,9 +706,77 @@ func (ep Endpoint) RefreshToken(c *fiber.Ctx) error {
 // @Security BearerAuth
 func (ep Endpoint) SignOut(c *fiber.Ctx) error {
 	db := ep.DB
-	user := RequestUser(c)
-	user.Access = nil
-	user.Refresh = nil
-	db.Save(user)
+	session := RequestSession(c)
+	sessionManager.Revoke(db, session)
 	return c.Status(200).JSON(SuccessResponse("Logout successful"))
 }
+
+// @Summary Retrieve Sessions
+// @Description This endpoint retrieves all active sessions (devices) of the authenticated user
+// @Tags Auth
+// @Success 200 {object} schemas.SessionsResponseSchema
+// @Failure 401 {object} utils.ErrorResponse
+// @Router /auth/sessions [get]
+// @Security BearerAuth
+func (ep Endpoint) RetrieveSessions(c *fiber.Ctx) error {
+	db := ep.DB
+	user := RequestUser(c)
+	session := RequestSession(c)
+
+	sessions := sessionManager.GetUserSessions(db, *user)
+	response := schemas.SessionsResponseSchema{
+		ResponseSchema: SuccessResponse("Sessions fetched"),
+		Data:           sessions,
+	}.Init(session.ID)
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Revoke a Session
+// @Description This endpoint signs out a particular session (device) of the authenticated user
+// @Tags Auth
+// @Param id path string true "Session ID (uuid)"
+// @Success 200 {object} schemas.ResponseSchema
+// @Failure 404 {object} utils.ErrorResponse
+// @Router /auth/sessions/{id} [delete]
+// @Security BearerAuth
+func (ep Endpoint) RevokeSession(c *fiber.Ctx) error {
+	db := ep.DB
+	user := RequestUser(c)
+
+	sessionID, err := utils.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	session := sessionManager.GetUserSession(db, *user, *sessionID)
+	if session == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no session with that ID"))
+	}
+	sessionManager.Revoke(db, session)
+	return c.Status(200).JSON(SuccessResponse("Session revoked"))
+}
+
+// @Summary Sign out everywhere
+// @Description This endpoint revokes all sessions (devices) of the authenticated user, including the current one
+// @Tags Auth
+// @Success 200 {object} schemas.ResponseSchema
+// @Failure 401 {object} utils.ErrorResponse
+// @Router /auth/sessions [delete]
+// @Security BearerAuth
+func (ep Endpoint) RevokeAllSessions(c *fiber.Ctx) error {
+	db := ep.DB
+	user := RequestUser(c)
+	sessionManager.RevokeAll(db, *user)
+	return c.Status(200).JSON(SuccessResponse("Signed out of all sessions"))
+}
+
+// @Summary Retrieve JSON Web Key Set
+// @Description This endpoint returns the public keys used to sign access tokens so other services can verify them.
+// @Description
+// @Description `Keys are identified by the kid header of the token. Shared (HS512) secrets are never published.`
+// @Tags Auth
+// @Success 200 {object} schemas.JWKSResponseSchema
+// @Router /.well-known/jwks.json [get]
+func (ep Endpoint) RetrieveJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(200).JSON(keyring.JWKS())
+}
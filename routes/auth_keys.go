@@ -0,0 +1,239 @@
+package routes
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/config"
+	"github.com/acatalepsy17/pigeon/schemas"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A single JWT key, identified by the "kid" header of the tokens it signs
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{} // nil for keys that are only kept for verification
+	VerifyKey interface{}
+	ExpiresAt *time.Time // end of the grace window for previous keys
+}
+
+func (key SigningKey) IsExpired() bool {
+	return key.ExpiresAt != nil && time.Now().UTC().After(*key.ExpiresAt)
+}
+
+// Tokens are always signed with the current key, while previous keys are still
+// accepted for verification until their grace window elapses.
+type Keyring struct {
+	Current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+func NewKeyring(current *SigningKey, previous ...*SigningKey) *Keyring {
+	keyring := &Keyring{Current: current, keys: map[string]*SigningKey{current.ID: current}}
+	for _, key := range previous {
+		if _, exists := keyring.keys[key.ID]; !exists {
+			keyring.keys[key.ID] = key
+		}
+	}
+	return keyring
+}
+
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Current.Method, claims)
+	token.Header["kid"] = k.Current.ID
+	return token.SignedString(k.Current.SignKey)
+}
+
+// Used as the jwt.Keyfunc when parsing tokens
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	key := k.Current
+	// Tokens issued before key IDs were introduced have no kid and can only match the current key
+	if kid, ok := token.Header["kid"].(string); ok {
+		key = k.keys[kid]
+	}
+	if key == nil || key.IsExpired() {
+		return nil, errors.New("unknown or expired signing key")
+	}
+	// Prevent algorithm confusion (e.g a HS token "signed" with our public RSA key)
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return key.VerifyKey, nil
+}
+
+func (k *Keyring) Methods() []string {
+	methods := []string{}
+	seen := map[string]bool{}
+	for _, key := range k.keys {
+		alg := key.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+func (k *Keyring) Parse(token string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(token, claims, k.Keyfunc, jwt.WithValidMethods(k.Methods()))
+}
+
+// Public keys (asymmetric only) that other services can use to verify our tokens
+func (k *Keyring) JWKS() schemas.JWKSResponseSchema {
+	jwks := schemas.JWKSResponseSchema{Keys: []schemas.JWKSchema{}}
+	for _, key := range k.keys {
+		if key.IsExpired() {
+			continue
+		}
+		jwk := schemas.JWKSchema{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch publicKey := key.VerifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue // Never publish shared secrets
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// ----------------------------------
+// KEY LOADING
+// --------------------------------
+func NewHMACKey(secret string) *SigningKey {
+	hash := sha256.Sum256([]byte("pigeon-kid:" + secret))
+	return &SigningKey{
+		ID:        "hs-" + hex.EncodeToString(hash[:8]),
+		Method:    jwt.SigningMethodHS512,
+		SignKey:   []byte(secret),
+		VerifyKey: []byte(secret),
+	}
+}
+
+// Load an RSA or Ed25519 key from a PEM file. Private keys can sign, public keys can only verify.
+func LoadPEMKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key := SigningKey{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.SignKey, key.VerifyKey = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.VerifyKey = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.SignKey, key.VerifyKey = jwt.SigningMethodEdDSA, k, k.Public().(ed25519.PublicKey)
+	case ed25519.PublicKey:
+		key.Method, key.VerifyKey = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", path)
+	}
+
+	// Derive a stable key ID from the public key so restarts don't change it
+	der, err := x509.MarshalPKIXPublicKey(key.VerifyKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	hash := sha256.Sum256(der)
+	key.ID = base64.RawURLEncoding.EncodeToString(hash[:12])
+	return &key, nil
+}
+
+func splitConfigList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func LoadKeyring(cfg config.Config) *Keyring {
+	var current *SigningKey
+	algorithm := cfg.JWTAlgorithm
+	switch algorithm {
+	case "", "HS512":
+		current = NewHMACKey(cfg.JWTSecretKey)
+	case "RS256", "EdDSA":
+		key, err := LoadPEMKey(cfg.JWTPrivateKeyFile)
+		if err != nil {
+			log.Fatal("Error loading JWT private key: ", err)
+		}
+		if key.SignKey == nil || key.Method.Alg() != algorithm {
+			log.Fatalf("JWT private key file must contain a %s private key", algorithm)
+		}
+		current = key
+	default:
+		log.Fatal("Unsupported JWT algorithm: ", algorithm)
+	}
+
+	// Previous keys remain valid for verification until the grace window ends
+	var expiresAt *time.Time
+	if cfg.JWTPreviousKeysExpireAt != "" {
+		expiry, err := time.Parse(time.RFC3339, cfg.JWTPreviousKeysExpireAt)
+		if err != nil {
+			log.Fatal("Invalid JWT_PREVIOUS_KEYS_EXPIRE_AT: ", err)
+		}
+		expiry = expiry.UTC()
+		expiresAt = &expiry
+	}
+	previous := []*SigningKey{}
+	for _, secret := range splitConfigList(cfg.JWTPreviousSecretKeys) {
+		key := NewHMACKey(secret)
+		key.SignKey = nil
+		previous = append(previous, key)
+	}
+	for _, path := range splitConfigList(cfg.JWTPreviousKeyFiles) {
+		key, err := LoadPEMKey(path)
+		if err != nil {
+			log.Fatal("Error loading previous JWT key: ", err)
+		}
+		key.SignKey = nil
+		previous = append(previous, key)
+	}
+	for _, key := range previous {
+		key.ExpiresAt = expiresAt
+	}
+	return NewKeyring(current, previous...)
+}
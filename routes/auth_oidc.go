@@ -0,0 +1,306 @@
+package routes
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Endpoints advertised by the provider at {issuer}/.well-known/openid-configuration
+type OidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// Claims of a verified ID token that we use to find or create the user
+type OidcIDTokenClaims struct {
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	jwt.RegisteredClaims
+}
+
+// A generic OpenID Connect provider using the authorization code flow with PKCE.
+// Discovery & signing keys are fetched lazily and cached, so the provider can be a local stub.
+type OidcProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	client       *http.Client
+
+	mu          sync.Mutex
+	discovery   *OidcDiscovery
+	discoveryAt time.Time
+	keys        map[string]interface{}
+	keysAt      time.Time
+}
+
+const oidcCacheTTL = time.Hour
+
+func NewOidcProvider(cfg config.Config) *OidcProvider {
+	if cfg.OidcIssuer == "" {
+		return nil
+	}
+	return &OidcProvider{
+		Issuer:       strings.TrimRight(cfg.OidcIssuer, "/"),
+		ClientID:     cfg.OidcClientID,
+		ClientSecret: cfg.OidcClientSecret,
+		RedirectURL:  cfg.OidcRedirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OidcProvider) getJSON(endpoint string, target interface{}) error {
+	resp, err := p.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+func (p *OidcProvider) Discover() (*OidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveryAt) < oidcCacheTTL {
+		return p.discovery, nil
+	}
+	discovery := OidcDiscovery{}
+	if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q doesn't match %q", discovery.Issuer, p.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	p.discovery = &discovery
+	p.discoveryAt = time.Now()
+	return p.discovery, nil
+}
+
+func (p *OidcProvider) AuthorizationURL(state string, nonce string, codeVerifier string) (string, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", PkceChallenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange an authorization code for the provider's tokens and return the verified ID token claims
+func (p *OidcProvider) Exchange(code string, codeVerifier string, nonce string) (*OidcIDTokenClaims, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token exchange failed: %d %s", resp.StatusCode, tokens.Error)
+	}
+	return p.VerifyIDToken(tokens.IDToken, nonce)
+}
+
+// Verify the ID token's signature (against the provider's JWKS), issuer, audience, expiry and nonce
+func (p *OidcProvider) VerifyIDToken(idToken string, nonce string) (*OidcIDTokenClaims, error) {
+	claims := &OidcIDTokenClaims{}
+	_, err := jwt.ParseWithClaims(
+		idToken, claims, p.keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing subject")
+	}
+	return claims, nil
+}
+
+func (p *OidcProvider) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := p.signingKey(kid, false)
+	if err == nil && key == nil {
+		// The provider may have rotated its keys since we last fetched them
+		key, err = p.signingKey(kid, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+func (p *OidcProvider) signingKey(kid string, refresh bool) (interface{}, error) {
+	p.mu.Lock()
+	stale := p.keys == nil || time.Since(p.keysAt) > oidcCacheTTL
+	p.mu.Unlock()
+	if stale || refresh {
+		discovery, err := p.Discover()
+		if err != nil {
+			return nil, err
+		}
+		jwks := struct {
+			Keys []oidcJWK `json:"keys"`
+		}{}
+		if err := p.getJSON(discovery.JwksURI, &jwks); err != nil {
+			return nil, err
+		}
+		keys := map[string]interface{}{}
+		for _, jwk := range jwks.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			if key, err := jwk.PublicKey(); err == nil {
+				keys[jwk.Kid] = key
+			}
+		}
+		p.mu.Lock()
+		p.keys, p.keysAt = keys, time.Now()
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if kid == "" && len(p.keys) == 1 {
+		// Providers with a single key may omit the kid
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return p.keys[kid], nil
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (jwk oidcJWK) PublicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// PKCE (RFC 7636) S256 code challenge of a verifier
+func PkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
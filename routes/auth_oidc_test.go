@@ -0,0 +1,263 @@
+package routes
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/utils"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A local OpenID Connect provider. Every authorization signs in the "user" described by claims, with no consent screen.
+type oidcStub struct {
+	server *httptest.Server
+	claims OidcIDTokenClaims // subject, email & names of the signed in user
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]oidcStubGrant
+}
+
+// What an authorization code was issued for
+type oidcStubGrant struct {
+	clientID      string
+	redirectURL   string
+	nonce         string
+	codeChallenge string
+}
+
+const oidcStubKeyID = "stub"
+
+func newOidcStub(t *testing.T, claims OidcIDTokenClaims) *oidcStub {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &oidcStub{claims: claims, key: key, codes: map[string]oidcStubGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", stub.discovery)
+	mux.HandleFunc("/jwks", stub.jwks)
+	mux.HandleFunc("/authorize", stub.authorize)
+	mux.HandleFunc("/token", stub.token)
+	stub.server = httptest.NewServer(mux)
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+// A provider pointed at the stub
+func (s *oidcStub) provider(clientID string) *OidcProvider {
+	return &OidcProvider{
+		Issuer:      s.server.URL,
+		ClientID:    clientID,
+		RedirectURL: "https://app.example/auth/oidc/callback",
+		Scopes:      []string{"openid", "email", "profile"},
+		client:      s.server.Client(),
+	}
+}
+
+// Follow an authorization url like a browser would and return the code & state the stub redirects back with
+func (s *oidcStub) authorizeURL(t *testing.T, authorizationURL string) (string, string) {
+	client := *s.server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func (s *oidcStub) writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *oidcStub) discovery(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, OidcDiscovery{
+		Issuer:                s.server.URL,
+		AuthorizationEndpoint: s.server.URL + "/authorize",
+		TokenEndpoint:         s.server.URL + "/token",
+		JwksURI:               s.server.URL + "/jwks",
+	})
+}
+
+func (s *oidcStub) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := oidcJWK{
+		Kty: "RSA",
+		Kid: oidcStubKeyID,
+		Use: "sig",
+		N:   encode(s.key.N.Bytes()),
+		E:   encode(big.NewInt(int64(s.key.E)).Bytes()),
+	}
+	s.writeJSON(w, http.StatusOK, map[string][]oidcJWK{"keys": {jwk}})
+}
+
+func (s *oidcStub) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURL, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	code := utils.GetSecureToken(24)
+	s.mu.Lock()
+	s.codes[code] = oidcStubGrant{
+		clientID:      query.Get("client_id"),
+		redirectURL:   query.Get("redirect_uri"),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	s.mu.Unlock()
+
+	params := redirectURL.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirectURL.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+func (s *oidcStub) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	code := r.PostForm.Get("code")
+	s.mu.Lock()
+	grant, ok := s.codes[code]
+	delete(s.codes, code) // codes are single use
+	s.mu.Unlock()
+	if !ok || grant.clientID != r.PostForm.Get("client_id") || grant.redirectURL != r.PostForm.Get("redirect_uri") ||
+		grant.codeChallenge != PkceChallenge(r.PostForm.Get("code_verifier")) {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := s.signIDToken(grant)
+	if err != nil {
+		s.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func (s *oidcStub) signIDToken(grant oidcStubGrant) (string, error) {
+	if s.claims.Subject == "" {
+		return "", errors.New("stub claims have no subject")
+	}
+	now := time.Now()
+	claims := s.claims
+	claims.Nonce = grant.nonce
+	claims.Issuer = s.server.URL
+	claims.Audience = jwt.ClaimStrings{grant.clientID}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(5 * time.Minute))
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = oidcStubKeyID
+	return token.SignedString(s.key)
+}
+
+var oidcTestClaims = OidcIDTokenClaims{
+	Email:            "john@example.com",
+	EmailVerified:    true,
+	Name:             "John Doe",
+	RegisteredClaims: jwt.RegisteredClaims{Subject: "stub-user-1"},
+}
+
+// Starts a login like OidcAuthorize does and returns the code the stub redirected back with
+func startOidcLogin(t *testing.T, stub *oidcStub, provider *OidcProvider, nonce string, codeVerifier string) string {
+	authorizationURL, err := provider.AuthorizationURL("state-1", nonce, codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := stub.authorizeURL(t, authorizationURL)
+	if state != "state-1" {
+		t.Fatalf("state = %q, want %q", state, "state-1")
+	}
+	return code
+}
+
+func TestOidcExchange(t *testing.T) {
+	stub := newOidcStub(t, oidcTestClaims)
+	provider := stub.provider("pigeon")
+	codeVerifier := utils.GetSecureToken(48)
+	code := startOidcLogin(t, stub, provider, "nonce-1", codeVerifier)
+
+	claims, err := provider.Exchange(code, codeVerifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "stub-user-1" || claims.Email != "john@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if _, err := provider.Exchange(code, codeVerifier, "nonce-1"); err == nil {
+		t.Error("a used code should be rejected")
+	}
+}
+
+func TestOidcExchangeRejectsWrongVerifier(t *testing.T) {
+	stub := newOidcStub(t, oidcTestClaims)
+	provider := stub.provider("pigeon")
+	code := startOidcLogin(t, stub, provider, "nonce-1", utils.GetSecureToken(48))
+
+	if _, err := provider.Exchange(code, utils.GetSecureToken(48), "nonce-1"); err == nil {
+		t.Error("a code exchanged with another verifier should be rejected")
+	}
+}
+
+func TestOidcExchangeRejectsWrongNonce(t *testing.T) {
+	stub := newOidcStub(t, oidcTestClaims)
+	provider := stub.provider("pigeon")
+	codeVerifier := utils.GetSecureToken(48)
+	code := startOidcLogin(t, stub, provider, "nonce-1", codeVerifier)
+
+	if _, err := provider.Exchange(code, codeVerifier, "nonce-2"); err == nil {
+		t.Error("an ID token with another login's nonce should be rejected")
+	}
+}
+
+func TestOidcVerifyIDTokenRejectsOtherAudience(t *testing.T) {
+	stub := newOidcStub(t, oidcTestClaims)
+	idToken, err := stub.signIDToken(oidcStubGrant{clientID: "another-app", nonce: "nonce-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.provider("pigeon").VerifyIDToken(idToken, "nonce-1"); err == nil {
+		t.Error("an ID token issued to another client should be rejected")
+	}
+}
+
+func TestOidcNames(t *testing.T) {
+	tests := []struct {
+		claims    OidcIDTokenClaims
+		firstName string
+		lastName  string
+	}{
+		{OidcIDTokenClaims{GivenName: "John", FamilyName: "Doe", Name: "Johnny D"}, "John", "Doe"},
+		{OidcIDTokenClaims{Name: "Mary Jane Watson"}, "Mary", "Jane Watson"},
+		{OidcIDTokenClaims{Email: "peter@example.com"}, "peter", ""},
+	}
+	for _, test := range tests {
+		firstName, lastName := oidcNames(&test.claims)
+		if firstName != test.firstName || lastName != test.lastName {
+			t.Errorf("oidcNames(%+v) = %q, %q, want %q, %q", test.claims, firstName, lastName, test.firstName, test.lastName)
+		}
+	}
+}
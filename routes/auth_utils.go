@@ -5,42 +5,65 @@ import (
 	"time"
 
 	"github.com/acatalepsy17/pigeon/config"
+	"github.com/acatalepsy17/pigeon/managers"
 	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/schemas"
+	"github.com/acatalepsy17/pigeon/senders"
 	"github.com/acatalepsy17/pigeon/utils"
+	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/pborman/uuid"
 	"gorm.io/gorm"
 )
 
 var cfg = config.GetConfig()
-var SECRETKEY = []byte(cfg.JWTSecretKey)
+var keyring = LoadKeyring(cfg)
+var sessionManager = managers.SessionManager{}
+var throttleManager = managers.ThrottleManager{}
+
+// Actions throttled per account & IP address
+const (
+	THROTTLE_SIGN_IN          = "sign_in"
+	THROTTLE_VERIFY_EMAIL     = "verify_email"
+	THROTTLE_SET_NEW_PASSWORD = "set_new_password"
+)
+
+// Token types, so one kind of token (both are signed with the same keys) can't be used as the other
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
 
 type AccessTokenPayload struct {
-	UserId   uuid.UUID `json:"user_id"`
-	Username string    `json:"username"`
+	UserId    uuid.UUID `json:"user_id"`
+	Username  string    `json:"username"`
+	SessionID uuid.UUID `json:"session_id"`
+	Type      string    `json:"typ"`
 	jwt.RegisteredClaims
 }
 
 type RefreshTokenPayload struct {
-	Data string `json:"data"`
+	Data      string    `json:"data"`
+	SessionID uuid.UUID `json:"session_id"`
+	Type      string    `json:"typ"`
 	jwt.RegisteredClaims
 }
 
-func GenerateAccessToken(userId uuid.UUID, username string) string {
+func GenerateAccessToken(userId uuid.UUID, username string, sessionID uuid.UUID) string {
 	expirationTime := time.Now().Add(time.Duration(cfg.AccessTokenExpireMinutes) * time.Minute)
 	payload := AccessTokenPayload{
-		UserId:   userId,
-		Username: username,
+		UserId:    userId,
+		Username:  username,
+		SessionID: sessionID,
+		Type:      accessTokenType,
 		RegisteredClaims: jwt.RegisteredClaims{
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	// Declare the token with the algorithm used for signing, and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, payload)
-	// Create the JWT string
-	tokenString, err := token.SignedString(SECRETKEY)
+	// Sign the claims with the current key of the keyring
+	tokenString, err := keyring.Sign(payload)
 	if err != nil {
 		// If there is an error in creating the JWT return an internal server error
 		log.Fatal("Error Generating Access token: ", err)
@@ -48,20 +71,20 @@ func GenerateAccessToken(userId uuid.UUID, username string) string {
 	return tokenString
 }
 
-func GenerateRefreshToken() string {
+func GenerateRefreshToken(sessionID uuid.UUID) string {
 	expirationTime := time.Now().Add(time.Duration(cfg.RefreshTokenExpireMinutes) * time.Minute)
 	payload := RefreshTokenPayload{
-		Data: utils.GetRandomString(10),
+		Data:      utils.GetRandomString(10),
+		SessionID: sessionID,
+		Type:      refreshTokenType,
 		RegisteredClaims: jwt.RegisteredClaims{
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	// Declare the token with the algorithm used for signing, and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, payload)
-	// Create the JWT string
-	tokenString, err := token.SignedString(SECRETKEY)
+	// Sign the claims with the current key of the keyring
+	tokenString, err := keyring.Sign(payload)
 	if err != nil {
 		// If there is an error in creating the JWT return an internal server error
 		log.Fatal("Error Generating Refresh token: ", err)
@@ -69,44 +92,167 @@ func GenerateRefreshToken() string {
 	return tokenString
 }
 
-func DecodeAccessToken(token string, db *gorm.DB) (*models.User, *string) {
+type MfaChallengePayload struct {
+	UserId     uuid.UUID `json:"user_id"`
+	DeviceName *string   `json:"device_name,omitempty"`
+	Purpose    string    `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+const mfaChallengePurpose = "mfa_challenge"
+
+func GenerateMfaChallengeToken(userId uuid.UUID, deviceName *string) string {
+	expirationTime := time.Now().Add(time.Duration(cfg.MfaChallengeExpireMinutes) * time.Minute)
+	payload := MfaChallengePayload{
+		UserId:     userId,
+		DeviceName: deviceName,
+		Purpose:    mfaChallengePurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New(),
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+	}
+	tokenString, err := keyring.Sign(payload)
+	if err != nil {
+		log.Fatal("Error Generating MFA challenge token: ", err)
+	}
+	return tokenString
+}
+
+func DecodeMfaChallengeToken(token string) *MfaChallengePayload {
+	claims := &MfaChallengePayload{}
+	tkn, err := keyring.Parse(token, claims)
+	if err != nil || !tkn.Valid || claims.Purpose != mfaChallengePurpose || claims.UserId == nil || claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	return claims
+}
+
+// Responds with a throttling error, telling the client how long to wait via the Retry-After header
+func ThrottledResponse(fiberCtx *fiber.Ctx, errCode int, errData *utils.ErrorResponse) error {
+	if errData.Data != nil {
+		if retryAfter, ok := (*errData.Data)["retry_after"]; ok {
+			fiberCtx.Set(fiber.HeaderRetryAfter, retryAfter)
+		}
+	}
+	return fiberCtx.Status(errCode).JSON(errData)
+}
+
+// Counts a failed attempt of a throttled action and warns the user by email when it locks their account
+func RecordFailedAttempt(fiberCtx *fiber.Ctx, db *gorm.DB, action string, account string, user *models.User) {
+	if throttleManager.Fail(db, action, account, fiberCtx.IP()) && user != nil && user.ID != nil {
+		go senders.SendEmail(user, "account-locked", nil)
+	}
+}
+
+// Sent to the old address of a pending email change, so the owner can cancel it
+type EmailChangeCancelPayload struct {
+	UserId  uuid.UUID `json:"user_id"`
+	Email   string    `json:"email"` // the requested address, so an older link can't cancel a newer request
+	Purpose string    `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+const emailChangeCancelPurpose = "email_change_cancel"
+
+func GenerateEmailChangeCancelToken(userId uuid.UUID, email string) string {
+	expirationTime := time.Now().Add(time.Duration(cfg.EmailOtpExpireSeconds) * time.Second)
+	payload := EmailChangeCancelPayload{
+		UserId:  userId,
+		Email:   email,
+		Purpose: emailChangeCancelPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+	}
+	tokenString, err := keyring.Sign(payload)
+	if err != nil {
+		log.Fatal("Error Generating email change cancel token: ", err)
+	}
+	return tokenString
+}
+
+func DecodeEmailChangeCancelToken(token string) *EmailChangeCancelPayload {
+	claims := &EmailChangeCancelPayload{}
+	tkn, err := keyring.Parse(token, claims)
+	if err != nil || !tkn.Valid || claims.Purpose != emailChangeCancelPurpose || claims.UserId == nil {
+		return nil
+	}
+	return claims
+}
+
+// Creates a new device session for the user and returns its token pair
+func CreateSession(fiberCtx *fiber.Ctx, db *gorm.DB, user models.User, deviceName *string) schemas.TokensResponseSchema {
+	sessionID := uuid.Parse(uuid.New())
+	refresh := GenerateRefreshToken(sessionID)
+	sessionManager.Create(db, sessionID, user, deviceName, fiberCtx.Get("User-Agent"), fiberCtx.IP(), refresh)
+	access := GenerateAccessToken(user.ID, user.Username, sessionID)
+	return schemas.TokensResponseSchema{Access: access, Refresh: refresh}
+}
+
+// Completes a sign in: issues a session's tokens, or a MFA challenge when the user has a second factor enabled
+func IssueAuthResponse(fiberCtx *fiber.Ctx, db *gorm.DB, user models.User, deviceName *string) error {
+	if user.TotpEnabled {
+		response := schemas.MfaChallengeResponseSchema{
+			ResponseSchema: SuccessResponse("MFA required"),
+			Data: schemas.MfaChallengeSchema{
+				MfaRequired:    true,
+				ChallengeToken: GenerateMfaChallengeToken(user.ID, deviceName),
+			},
+		}
+		return fiberCtx.Status(200).JSON(response)
+	}
+
+	// Create a new device session & its auth tokens
+	tokens := CreateSession(fiberCtx, db, user, deviceName)
+	response := schemas.LoginResponseSchema{
+		ResponseSchema: SuccessResponse("Login successful"),
+		Data:           tokens,
+	}
+	return fiberCtx.Status(201).JSON(response)
+}
+
+func DecodeAccessToken(token string, db *gorm.DB) (*models.User, *models.Session, *string) {
 	claims := &AccessTokenPayload{}
 
-	tkn, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return SECRETKEY, nil
-	})
+	tkn, err := keyring.Parse(token, claims)
 	tokenErr := "Auth Token is Invalid or Expired!"
 	if err != nil {
-		return nil, &tokenErr
+		return nil, nil, &tokenErr
+	}
+	if !tkn.Valid || claims.SessionID == nil || claims.Type != accessTokenType {
+		return nil, nil, &tokenErr
 	}
-	if !tkn.Valid {
-		return nil, &tokenErr
+
+	// Ensure the session hasn't been revoked
+	session := sessionManager.GetByID(db, claims.SessionID)
+	if session == nil || session.UserID.String() != claims.UserId.String() {
+		return nil, nil, &tokenErr
 	}
-	user := models.User{Access: &token}
+	user := models.User{}
 	// Fetch User model object
-	result := db.Where(user).Joins("CityObj").Joins("CityObj.RegionObj").Joins("CityObj.CountryObj").Joins("AvatarObj").Take(&user, claims.UserId)
+	result := db.Joins("CityObj").Joins("CityObj.RegionObj").Joins("CityObj.CountryObj").Joins("AvatarObj").Take(&user, claims.UserId)
 	if result.Error != nil {
-		return nil, &tokenErr
+		return nil, nil, &tokenErr
 	}
-	return &user, nil
+	sessionManager.Touch(db, session)
+	return &user, session, nil
 }
 
-func DecodeRefreshToken(token string) bool {
+func DecodeRefreshToken(token string) *RefreshTokenPayload {
 	claims := &RefreshTokenPayload{}
-	tkn, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return SECRETKEY, nil
-	})
+	tkn, err := keyring.Parse(token, claims)
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
 			log.Println("JWT Error: ", "Invalid Signature")
 		} else {
 			log.Println("JWT Error: ", err)
 		}
-		return false
+		return nil
 	}
-	if !tkn.Valid {
+	if !tkn.Valid || claims.SessionID == nil || claims.Type != refreshTokenType {
 		log.Println("Invalid Refresh Token")
-		return false
+		return nil
 	}
-	return true
+	return claims
 }
@@ -1,12 +1,18 @@
 package routes
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/events"
 	"github.com/acatalepsy17/pigeon/managers"
 	"github.com/acatalepsy17/pigeon/models"
 	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/schemas"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pborman/uuid"
 )
 
 var (
@@ -15,23 +21,31 @@ var (
 )
 
 // @Summary Retrieve User Chats
-// @Description `This endpoint retrieves a paginated list of the current user chats`
+// @Description `This endpoint retrieves a paginated list of the current user chats, each with its number of unread messages. DMs with users you blocked or were blocked by are left out.`
 // @Tags Chat
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 200)" default(200)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.ChatsResponseSchema
 // @Router /chats [get]
 // @Security BearerAuth
 func (endpoint Endpoint) RetrieveUserChats(c *fiber.Ctx) error {
 	db := endpoint.DB
 	user := RequestUser(c)
-	chats := chatManager.GetUserChats(db, *user)
 
-	// Paginate, Convert type and return chats
-	paginatedData, paginatedChats, err := PaginateQueryset(chats, c, 200)
+	// Paginate and return chats
+	chats := []models.Chat{}
+	paginator := Pagination{Table: "chats", DefaultPerPage: 200, MaxPerPage: 200}
+	paginatedData, err := paginator.Paginate(c, blockManager.ExcludeBlockedDMs(db, chatManager.GetUserChats(db, *user), *user), &chats, managers.ChatPreloadLatestMessageScope)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	chats = paginatedChats.([]models.Chat)
+	chatManager.SetUnreadCounts(db, *user, chats)
+	chatIDs := []uuid.UUID{}
+	for _, chat := range chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
+	chatManager.MarkDelivered(db, *user, chatIDs)
 	response := schemas.ChatsResponseSchema{
 		ResponseSchema: SuccessResponse("Chats fetched"),
 		Data: schemas.ChatsResponseDataSchema{
@@ -51,6 +65,8 @@ func (endpoint Endpoint) RetrieveUserChats(c *fiber.Ctx) error {
 // @Description
 // @Description `If chat_id is available, then ignore username and set the correct chat_id`
 // @Description
+// @Description `To reply to a message in the chat, set its ID as parent_id. The reply quotes the start of its text.`
+// @Description
 // @Description `The file_upload_data in the response is what is used for uploading the file to cloudinary from client`
 // @Tags Chat
 // @Param message body schemas.MessageCreateSchema true "Message object"
@@ -73,6 +89,12 @@ func (endpoint Endpoint) SendMessage(c *fiber.Ctx) error {
 
 	var chat models.Chat
 	if chatID == nil {
+		if data.ParentID != nil {
+			data := map[string]string{
+				"parent_id": "A new chat has no messages to reply to",
+			}
+			return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid entry", data))
+		}
 		// Create a new chat dm with current user and recipient user
 		recipientUser := models.User{Username: *username}
 		db.Take(&recipientUser, recipientUser)
@@ -82,6 +104,9 @@ func (endpoint Endpoint) SendMessage(c *fiber.Ctx) error {
 			}
 			return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid entry", data))
 		}
+		if blockManager.IsBlocked(db, *user, recipientUser.ID) {
+			return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You cannot send messages to this user"))
+		}
 		chat = chatManager.GetDMChat(db, *user, recipientUser)
 		// Check if a chat already exists between both users
 		if chat.ID != nil {
@@ -97,10 +122,30 @@ func (endpoint Endpoint) SendMessage(c *fiber.Ctx) error {
 		if chat.ID == nil {
 			return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no chat with that ID"))
 		}
+		if blockManager.IsBlockedDM(db, *user, chat) {
+			return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You cannot send messages to this user"))
+		}
+		if chat.Ctype == choices.CGROUP && chat.OnlyAdminsCanPost && !managers.IsGroupAdmin(chatManager.GetRole(db, chat, *user)) {
+			return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Only admins can send messages to this group"))
+		}
+	}
+
+	// Get the message replied to
+	var parent *models.Message
+	if data.ParentID != nil {
+		message := messageManager.GetByID(db, *data.ParentID)
+		if message.ID == nil || message.ChatID.String() != chat.ID.String() {
+			data := map[string]string{
+				"parent_id": "This chat has no message with that ID",
+			}
+			return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid entry", data))
+		}
+		parent = &message
 	}
 
 	//Create Message
-	message := messageManager.Create(db, *user, chat, data.Text, data.FileType)
+	message := messageManager.Create(db, *user, chat, data.Text, data.FileType, parent)
+	endpoint.Bus.Publish(events.MessageCreated{Message: message, MemberIDs: chatManager.GetMemberIDs(db, chat.ID)})
 
 	// Convert type and return Message
 	response := schemas.MessageCreateResponseSchema{
@@ -111,10 +156,17 @@ func (endpoint Endpoint) SendMessage(c *fiber.Ctx) error {
 }
 
 // @Summary Retrieve messages from a Chat
-// @Description `This endpoint retrieves all messages in a chat`
+// @Description `This endpoint retrieves a page of messages in a chat, newest first`
+// @Description
+// @Description `Without a cursor, it returns the latest messages. Pass a message ID as before (older messages), after (newer messages) or around (the message & those around it, e.g. to jump to a search hit).`
+// @Description
+// @Description `The current user's messages have a status: SENT, DELIVERED (fetched by every other member) or READ (read by every other member).`
 // @Tags Chat
 // @Param chat_id path string true "Chat ID (uuid)"
-// @Param page query int false "Current Page" default(1)
+// @Param before query string false "Message ID (uuid) to get older messages from"
+// @Param after query string false "Message ID (uuid) to get newer messages from"
+// @Param around query string false "Message ID (uuid) to get messages around"
+// @Param per_page query int false "Messages per page (max 200)" default(50)
 // @Success 200 {object} schemas.ChatResponseSchema
 // @Router /chats/{chat_id} [get]
 // @Security BearerAuth
@@ -126,32 +178,196 @@ func (endpoint Endpoint) RetrieveMessages(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
+	direction, cursorID, perPage, err := ParseCursorParams(c, 50, 200)
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
 	chat := chatManager.GetSingleUserChatFullDetails(db, *user, *chatID)
-	if chat.ID == nil {
+	if chat.ID == nil || blockManager.IsBlockedDM(db, *user, chat) {
 		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no chat with that ID"))
 	}
+	if chat.Ctype == choices.CGROUP {
+		role := chatManager.GetRole(db, chat, *user)
+		chat.UserRole = &role
+	}
+	var cursor *models.Message
+	if cursorID != nil {
+		message := messageManager.GetByID(db, *cursorID)
+		if message.ID == nil || message.ChatID.String() != chat.ID.String() {
+			return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "This chat has no message with that ID"))
+		}
+		cursor = &message
+	}
 
-	// Paginate, Convert type and return Messages
-	paginatedData, paginatedMessages, err := PaginateQueryset(chat.Messages, c, 400)
-	if err != nil {
-		return c.Status(400).JSON(err)
+	// Get the page of messages
+	messages, hasOlder, hasNewer := messageManager.GetChatMessages(db, chat.ID, direction, cursor, perPage)
+	messageManager.SetRepliesCounts(db, messages)
+	messageManager.SetReactions(db, *user, messages)
+	paginatedData := schemas.CursorPaginatedResponseDataSchema{PerPage: uint(perPage)}
+	if len(messages) > 0 {
+		if hasOlder {
+			paginatedData.OlderCursor = &messages[len(messages)-1].ID
+		}
+		if hasNewer {
+			paginatedData.NewerCursor = &messages[0].ID
+		}
 	}
-	var messages []models.Message = paginatedMessages.([]models.Message)
+
+	chatManager.MarkDelivered(db, *user, []uuid.UUID{chat.ID})
+	readCursors := chatManager.GetReadCursors(db, chat.ID)
+	chatManager.SetMessageStatuses(chat, *user, messages, readCursors)
 	response := schemas.ChatResponseSchema{
 		ResponseSchema: SuccessResponse("Messages fetched"),
 		Data: schemas.MessagesSchema{
-			Chat: chat,
+			Chat:        chat,
+			ReadCursors: readCursors,
 			Messages: schemas.MessagesResponseDataSchema{
-				PaginatedResponseDataSchema: *paginatedData,
-				Items:                       messages,
+				CursorPaginatedResponseDataSchema: paginatedData,
+				Items:                             messages,
 			}.Init(),
 		}.Init(),
 	}
 	return c.Status(200).JSON(response)
 }
 
+// @Summary Retrieve a message thread
+// @Description `This endpoint retrieves a message with a page of its replies, newest first`
+// @Description
+// @Description `The replies are paginated like the chat's messages, with a reply ID as before, after or around.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param message_id path string true "Message ID (uuid)"
+// @Param before query string false "Reply ID (uuid) to get older replies from"
+// @Param after query string false "Reply ID (uuid) to get newer replies from"
+// @Param around query string false "Reply ID (uuid) to get replies around"
+// @Param per_page query int false "Replies per page (max 200)" default(50)
+// @Success 200 {object} schemas.MessageThreadResponseSchema
+// @Router /chats/{chat_id}/messages/{message_id}/thread [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveMessageThread(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chatID, err := utils.ParseUUID(c.Params("chat_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	messageID, err := utils.ParseUUID(c.Params("message_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	direction, cursorID, perPage, err := ParseCursorParams(c, 50, 200)
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	chat := chatManager.GetSingleUserChat(db, *user, *chatID)
+	if chat.ID == nil || blockManager.IsBlockedDM(db, *user, chat) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no chat with that ID"))
+	}
+	message := messageManager.GetByID(db, *messageID)
+	if message.ID == nil || message.ChatID.String() != chat.ID.String() {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "This chat has no message with that ID"))
+	}
+	var cursor *models.Message
+	if cursorID != nil {
+		reply := messageManager.GetByID(db, *cursorID)
+		if reply.ID == nil || reply.ParentID == nil || reply.ParentID.String() != message.ID.String() {
+			return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "This message has no reply with that ID"))
+		}
+		cursor = &reply
+	}
+
+	// Get the page of replies
+	replies, hasOlder, hasNewer := messageManager.GetReplies(db, message.ID, direction, cursor, perPage)
+	paginatedData := schemas.CursorPaginatedResponseDataSchema{PerPage: uint(perPage)}
+	if len(replies) > 0 {
+		if hasOlder {
+			paginatedData.OlderCursor = &replies[len(replies)-1].ID
+		}
+		if hasNewer {
+			paginatedData.NewerCursor = &replies[0].ID
+		}
+	}
+	messages := []models.Message{message}
+	messageManager.SetRepliesCounts(db, messages)
+	messageManager.SetRepliesCounts(db, replies)
+	messageManager.SetReactions(db, *user, messages)
+	messageManager.SetReactions(db, *user, replies)
+
+	response := schemas.MessageThreadResponseSchema{
+		ResponseSchema: SuccessResponse("Message thread fetched"),
+		Data: schemas.MessageThreadSchema{
+			Message: messages[0].Init(),
+			Replies: schemas.MessagesResponseDataSchema{
+				CursorPaginatedResponseDataSchema: paginatedData,
+				Items:                             replies,
+			}.Init(),
+		},
+	}
+	return c.Status(200).JSON(response)
+}
+
+// Move the user's read cursor in the message's chat up to the message and let the members know
+func (endpoint Endpoint) MarkChatRead(user models.User, message models.Message) models.ChatReadCursor {
+	db := endpoint.DB
+	cursor, moved := chatManager.MarkRead(db, user, message)
+	cursor.UserObj = user
+	if moved {
+		endpoint.Bus.Publish(events.ChatRead{Cursor: cursor, MemberIDs: chatManager.GetMemberIDs(db, message.ChatID)})
+	}
+	return cursor.Init()
+}
+
+// @Summary Mark a chat as read
+// @Description `This endpoint marks the messages in a chat as read, up to (and including) the given message.`
+// @Description
+// @Description `The read cursor only moves forward, so marking an older message changes nothing. Members are notified through the chat socket.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param data body schemas.ChatReadSchema true "Last read message"
+// @Success 200 {object} schemas.ChatReadResponseSchema
+// @Router /chats/{chat_id}/read [post]
+// @Security BearerAuth
+func (endpoint Endpoint) ReadChat(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chatID, err := utils.ParseUUID(c.Params("chat_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+
+	data := schemas.ChatReadSchema{}
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	chat := chatManager.GetSingleUserChat(db, *user, *chatID)
+	if chat.ID == nil || blockManager.IsBlockedDM(db, *user, chat) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no chat with that ID"))
+	}
+	message := messageManager.GetByID(db, data.MessageID)
+	if message.ID == nil || message.ChatID.String() != chat.ID.String() {
+		data := map[string]string{
+			"message_id": "This chat has no message with that ID",
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+
+	response := schemas.ChatReadResponseSchema{
+		ResponseSchema: SuccessResponse("Chat marked as read"),
+		Data:           endpoint.MarkChatRead(*user, message),
+	}
+	return c.Status(200).JSON(response)
+}
+
 // @Summary Update a Group Chat
 // @Description `This endpoint updates a group chat.`
+// @Description
+// @Description `Members can change the name, description & image unless only_admins_can_edit_info is set. Only the owner & admins can add or remove members (only the owner can remove admins) and change the settings.`
+// @Description
+// @Description `Each change is posted to the chat as a system message (kind SYSTEM, no sender), which members also receive through the chat socket.`
 // @Tags Chat
 // @Param chat_id path string true "Chat ID (uuid)"
 // @Param chat body schemas.GroupChatInputSchema true "Chat object"
@@ -174,15 +390,17 @@ func (endpoint Endpoint) UpdateGroupChat(c *fiber.Ctx) error {
 		return c.Status(*errCode).JSON(errData)
 	}
 
-	chat := chatManager.GetUserGroup(db, *user, *chatID, true)
+	chat, role := chatManager.GetMemberGroup(db, *user, *chatID, true)
 	if chat.ID == nil {
-		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User owns no group chat with that ID"))
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no group chat with that ID"))
 	}
-	var errData *utils.ErrorResponse
-	updatedChat, errData := chatManager.UpdateGroup(db, &chat, data)
-	if errData != nil {
-		return c.Status(422).JSON(errData)
+	updatedChat, systemMessages, usersRemoved, errCode, errData := chatManager.UpdateGroup(db, &chat, *user, role, data)
+	if errCode != nil {
+		return c.Status(*errCode).JSON(errData)
 	}
+	endpoint.publishSystemMessages(*updatedChat, systemMessages)
+	endpoint.endMemberships(chat.ID, usersRemoved...)
+	updatedChat.UserRole = &role
 	// Convert type and return chat
 	response := schemas.GroupChatInputResponseSchema{
 		ResponseSchema: SuccessResponse("Chat updated"),
@@ -216,6 +434,141 @@ func (endpoint Endpoint) DeleteGroupChat(c *fiber.Ctx) error {
 	return c.Status(200).JSON(SuccessResponse("Group Chat Deleted"))
 }
 
+// @Summary Promote or demote a group member
+// @Description `This endpoint sets the role of a group member: ADMIN or MEMBER.`
+// @Description
+// @Description `The owner & admins can promote members, only the owner can demote admins.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param username path string true "Member's username"
+// @Param role body schemas.GroupMemberRoleSchema true "Role object"
+// @Success 200 {object} schemas.GroupChatInputResponseSchema
+// @Router /chats/{chat_id}/members/{username}/role [put]
+// @Security BearerAuth
+func (endpoint Endpoint) UpdateGroupMemberRole(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chatID, err := utils.ParseUUID(c.Params("chat_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+
+	data := schemas.GroupMemberRoleSchema{}
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	chat, role := chatManager.GetMemberGroup(db, *user, *chatID)
+	if chat.ID == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no group chat with that ID"))
+	}
+	if !managers.IsGroupAdmin(role) {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Only admins can change roles"))
+	}
+	members := userManager.GetByUsernames(db, []string{c.Params("username")})
+	if len(members) == 0 {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "This group has no member with that username"))
+	}
+	member := members[0]
+	memberRole := chatManager.GetRole(db, chat, member)
+	switch {
+	case memberRole == "":
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "This group has no member with that username"))
+	case memberRole == choices.CROWNER:
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "The owner's role can't be changed, transfer the ownership instead"))
+	case memberRole == choices.CRADMIN && role != choices.CROWNER:
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Only the owner can demote admins"))
+	}
+	chatManager.SetRole(db, chat, member, data.Role)
+
+	// Convert type and return chat
+	chat, role = chatManager.GetMemberGroup(db, *user, *chatID, true)
+	chat.UserRole = &role
+	response := schemas.GroupChatInputResponseSchema{
+		ResponseSchema: SuccessResponse("Member role updated"),
+		Data:           chat.InitG(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Leave a group chat
+// @Description `This endpoint removes the current user from a group chat. The owner must transfer the ownership first (or delete the group).`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Success 200 {object} schemas.ResponseSchema
+// @Router /chats/{chat_id}/leave [post]
+// @Security BearerAuth
+func (endpoint Endpoint) LeaveGroupChat(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chatID, err := utils.ParseUUID(c.Params("chat_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	chat, role := chatManager.GetMemberGroup(db, *user, *chatID)
+	if chat.ID == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no group chat with that ID"))
+	}
+	if role == choices.CROWNER {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Transfer the ownership before leaving the group"))
+	}
+	chatManager.Leave(db, chat, *user)
+	endpoint.sendSystemMessage(chat, models.SystemEventMemberLeft, *user)
+	endpoint.endMemberships(chat.ID, *user)
+	return c.Status(200).JSON(SuccessResponse("Group Chat Left"))
+}
+
+// @Summary Transfer a group chat's ownership
+// @Description `This endpoint makes a member the owner of a group chat. The current owner stays on as an admin.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param data body schemas.GroupOwnershipTransferSchema true "New owner"
+// @Success 200 {object} schemas.GroupChatInputResponseSchema
+// @Router /chats/{chat_id}/transfer [post]
+// @Security BearerAuth
+func (endpoint Endpoint) TransferGroupOwnership(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chatID, err := utils.ParseUUID(c.Params("chat_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+
+	data := schemas.GroupOwnershipTransferSchema{}
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	chat := chatManager.GetUserGroup(db, *user, *chatID)
+	if chat.ID == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "User owns no group chat with that ID"))
+	}
+	members := userManager.GetByUsernames(db, []string{data.Username}, user.ID)
+	if len(members) == 0 || chatManager.GetRole(db, chat, members[0]) == "" {
+		data := map[string]string{
+			"username": "This group has no member with that username",
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+	if err := chatManager.TransferOwnership(db, &chat, members[0]); err != nil {
+		return c.Status(500).JSON(utils.RequestErr(utils.ERR_SERVER_ERROR, "Unable to transfer the ownership"))
+	}
+
+	// Convert type and return chat
+	chat, role := chatManager.GetMemberGroup(db, *user, *chatID, true)
+	chat.UserRole = &role
+	response := schemas.GroupChatInputResponseSchema{
+		ResponseSchema: SuccessResponse("Ownership transferred"),
+		Data:           chat.InitG(),
+	}
+	return c.Status(200).JSON(response)
+}
+
 // @Summary Update a message
 // @Description `This endpoint updates a message.`
 // @Description
@@ -249,6 +602,7 @@ func (endpoint Endpoint) UpdateMessage(c *fiber.Ctx) error {
 	}
 
 	message = messageManager.Update(db, message, data.Text, data.FileType)
+	endpoint.Bus.Publish(events.MessageUpdated{Message: message, MemberIDs: chatManager.GetMemberIDs(db, message.ChatID)})
 	response := schemas.MessageCreateResponseSchema{
 		ResponseSchema: SuccessResponse("Message updated"),
 		Data:           message.InitC(data.FileType),
@@ -278,9 +632,7 @@ func (endpoint Endpoint) DeleteMessage(c *fiber.Ctx) error {
 	}
 	chat := message.ChatObj
 	messagesCount := chatManager.GetMessagesCount(db, chat.ID)
-
-	// Send message deletion socket
-	SendMessageDeletionInSocket(c, chat.ID, message.ID)
+	memberIDs := chatManager.GetMemberIDs(db, chat.ID)
 
 	// Delete message and chat if its the last message in the dm being deleted
 	if messagesCount == 1 && chat.Ctype == choices.CDM {
@@ -288,6 +640,7 @@ func (endpoint Endpoint) DeleteMessage(c *fiber.Ctx) error {
 	} else {
 		db.Delete(&message)
 	}
+	endpoint.Bus.Publish(events.MessageDeleted{ChatID: chat.ID, MessageID: message.ID, MemberIDs: memberIDs})
 
 	// Return response
 	return c.Status(200).JSON(SuccessResponse("Message Deleted"))
@@ -314,14 +667,23 @@ func (endpoint Endpoint) CreateGroupChat(c *fiber.Ctx) error {
 	if errCode, errData := ValidateRequest(c, &data); errData != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
-	usersToAdd := chatManager.GetByUsernames(db, data.UsernamesToAdd, user.ID)
+	usersToAdd := userManager.GetByUsernames(db, data.UsernamesToAdd, user.ID)
 	if len(usersToAdd) == 0 {
 		data := map[string]string{
 			"usernames_to_add": "Enter at least one valid username",
 		}
 		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
 	}
-	chat := chatManager.CreateGroup(db, *user, usersToAdd, data)
+	if blockedUsernames := blockManager.GetBlockedUsernames(db, *user, usersToAdd); len(blockedUsernames) > 0 {
+		data := map[string]string{
+			"usernames_to_add": fmt.Sprintf("You can't add these users: %s", strings.Join(blockedUsernames, ", ")),
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+	chat, systemMessage := chatManager.CreateGroup(db, *user, usersToAdd, data)
+	endpoint.publishSystemMessages(chat, []models.Message{systemMessage})
+	role := choices.CROWNER
+	chat.UserRole = &role
 	// Convert type and return chat
 	response := schemas.GroupChatInputResponseSchema{
 		ResponseSchema: SuccessResponse("Chat created"),
@@ -329,3 +691,382 @@ func (endpoint Endpoint) CreateGroupChat(c *fiber.Ctx) error {
 	}
 	return c.Status(201).JSON(response)
 }
+
+// Get a message from one of the user's chats
+func (endpoint Endpoint) getUserChatMessage(c *fiber.Ctx, user models.User) (*models.Message, *int, *utils.ErrorResponse) {
+	db := endpoint.DB
+	messageID, err := utils.ParseUUID(c.Params("message_id"))
+	if err != nil {
+		statusCode := 400
+		return nil, &statusCode, err
+	}
+	message := messageManager.GetByID(db, *messageID)
+	chat := models.Chat{}
+	if message.ID != nil {
+		chat = chatManager.GetSingleUserChat(db, user, message.ChatID)
+	}
+	if chat.ID == nil || blockManager.IsBlockedDM(db, user, chat) {
+		statusCode := 404
+		errData := utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no chat with that message")
+		return nil, &statusCode, &errData
+	}
+	return &message, nil, nil
+}
+
+// @Summary React to a message
+// @Description `This endpoint adds the user's reaction to a message in one of their chats, or changes it as there's one per user.`
+// @Description
+// @Description `Members are notified through the chat socket.`
+// @Tags Chat
+// @Param message_id path string true "Message ID (uuid)"
+// @Param reaction body schemas.ReactionInputSchema true "Reaction object. rtype should be any of these: LIKE, LOVE, HAHA, WOW, SAD, ANGRY"
+// @Success 200 {object} schemas.MessageCreateResponseSchema
+// @Router /chats/messages/{message_id}/reactions [put]
+// @Security BearerAuth
+func (endpoint Endpoint) ReactToMessage(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	message, errCode, errData := endpoint.getUserChatMessage(c, *user)
+	if errCode != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	data := schemas.ReactionInputSchema{}
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	messageManager.React(db, *user, *message, data.Rtype)
+	messages := []models.Message{*message}
+	messageManager.SetReactions(db, *user, messages)
+	endpoint.Bus.Publish(events.MessageReactionUpdated{Message: messages[0], User: *user, Rtype: data.Rtype})
+
+	response := schemas.MessageCreateResponseSchema{
+		ResponseSchema: SuccessResponse("Reaction saved"),
+		Data:           messages[0].Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Remove a message reaction
+// @Description `This endpoint removes the user's reaction to a message. Members are notified through the chat socket.`
+// @Tags Chat
+// @Param message_id path string true "Message ID (uuid)"
+// @Success 200 {object} schemas.MessageCreateResponseSchema
+// @Router /chats/messages/{message_id}/reactions [delete]
+// @Security BearerAuth
+func (endpoint Endpoint) RemoveMessageReaction(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	message, errCode, errData := endpoint.getUserChatMessage(c, *user)
+	if errCode != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	messages := []models.Message{*message}
+	messageManager.SetReactions(db, *user, messages)
+	rtype := messages[0].UserReaction
+	if rtype == nil || !messageManager.Unreact(db, *user, *message) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "You haven't reacted to this message"))
+	}
+	messageManager.SetReactions(db, *user, messages)
+	endpoint.Bus.Publish(events.MessageReactionUpdated{Message: messages[0], User: *user, Rtype: *rtype, Removed: true})
+
+	response := schemas.MessageCreateResponseSchema{
+		ResponseSchema: SuccessResponse("Reaction removed"),
+		Data:           messages[0].Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// Post a system message about the user to a chat and let its members know
+func (endpoint Endpoint) sendSystemMessage(chat models.Chat, event string, user models.User) {
+	userData := models.UserDataSchema{}.Init(user)
+	message := messageManager.CreateSystem(endpoint.DB, chat, models.SystemMessagePayload{Event: event, Actor: &userData})
+	endpoint.publishSystemMessages(chat, []models.Message{message})
+}
+
+// Let a chat's members know about system messages already created
+func (endpoint Endpoint) publishSystemMessages(chat models.Chat, messages []models.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	memberIDs := chatManager.GetMemberIDs(endpoint.DB, chat.ID)
+	for _, message := range messages {
+		endpoint.Bus.Publish(events.MessageCreated{Message: message, MemberIDs: memberIDs})
+	}
+}
+
+// Stop pushing a chat to users who aren't members anymore
+func (endpoint Endpoint) endMemberships(chatID uuid.UUID, users ...models.User) {
+	if len(users) == 0 {
+		return
+	}
+	userIDs := []uuid.UUID{}
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+	}
+	endpoint.Bus.Publish(events.ChatMembershipEnded{ChatID: chatID, UserIDs: userIDs})
+}
+
+// Get a group the user is an admin (or the owner) of
+func (endpoint Endpoint) getAdminGroup(c *fiber.Ctx, user models.User) (*models.Chat, *int, *utils.ErrorResponse) {
+	chatID, err := utils.ParseUUID(c.Params("chat_id"))
+	if err != nil {
+		statusCode := 400
+		return nil, &statusCode, err
+	}
+	chat, role := chatManager.GetMemberGroup(endpoint.DB, user, *chatID)
+	if chat.ID == nil {
+		statusCode := 404
+		errData := utils.RequestErr(utils.ERR_NON_EXISTENT, "User has no group chat with that ID")
+		return nil, &statusCode, &errData
+	}
+	if !managers.IsGroupAdmin(role) {
+		statusCode := 403
+		errData := utils.RequestErr(utils.ERR_NOT_ALLOWED, "Only admins can manage this group's invites & requests")
+		return nil, &statusCode, &errData
+	}
+	return &chat, nil, nil
+}
+
+// @Summary Create a group invite link
+// @Description `This endpoint creates a shareable link to join a group. Only admins can.`
+// @Description
+// @Description `The link stops working once revoked, after expires_at or once used max_uses times. Leave them null for no limit.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param data body schemas.GroupInviteCreateSchema true "Invite object"
+// @Success 201 {object} schemas.GroupInviteResponseSchema
+// @Router /chats/{chat_id}/invites [post]
+// @Security BearerAuth
+func (endpoint Endpoint) CreateGroupInvite(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chat, errCode, errData := endpoint.getAdminGroup(c, *user)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	data := schemas.GroupInviteCreateSchema{}
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	if data.ExpiresAt != nil && !data.ExpiresAt.After(time.Now()) {
+		data := map[string]string{
+			"expires_at": "Must be in the future",
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+	invite := chatManager.CreateInvite(db, *chat, *user, data)
+	response := schemas.GroupInviteResponseSchema{
+		ResponseSchema: SuccessResponse("Invite created"),
+		Data:           invite.Init(cfg.FrontendURL),
+	}
+	return c.Status(201).JSON(response)
+}
+
+// @Summary Retrieve group invite links
+// @Description `This endpoint retrieves a group's invite links that haven't been revoked, including expired & used up ones. Only admins can.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Success 200 {object} schemas.GroupInvitesResponseSchema
+// @Router /chats/{chat_id}/invites [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveGroupInvites(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chat, errCode, errData := endpoint.getAdminGroup(c, *user)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	invites := chatManager.GetInvites(db, chat.ID)
+	for i := range invites {
+		invites[i] = invites[i].Init(cfg.FrontendURL)
+	}
+	response := schemas.GroupInvitesResponseSchema{
+		ResponseSchema: SuccessResponse("Invites fetched"),
+		Data:           invites,
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Revoke a group invite link
+// @Description `This endpoint revokes a group's invite link so it can't be used anymore. Only admins can.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param invite_id path string true "Invite ID (uuid)"
+// @Success 200 {object} schemas.ResponseSchema
+// @Router /chats/{chat_id}/invites/{invite_id} [delete]
+// @Security BearerAuth
+func (endpoint Endpoint) RevokeGroupInvite(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chat, errCode, errData := endpoint.getAdminGroup(c, *user)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	inviteID, err := utils.ParseUUID(c.Params("invite_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	if !chatManager.RevokeInvite(db, chat.ID, *inviteID) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "This group has no active invite with that ID"))
+	}
+	return c.Status(200).JSON(SuccessResponse("Invite revoked"))
+}
+
+// @Summary Join a group with an invite link
+// @Description `This endpoint joins the group of an invite link, using its token.`
+// @Description
+// @Description `If the group requires approval, a join request is created instead (or the pending one returned) and chat is null until an admin approves it.`
+// @Description
+// @Description `Users who blocked or were blocked by the group's owner or the invite's creator can't join.`
+// @Tags Chat
+// @Param token path string true "Invite token"
+// @Success 200 {object} schemas.GroupJoinResponseSchema
+// @Router /chats/invites/{token}/join [post]
+// @Security BearerAuth
+func (endpoint Endpoint) JoinGroupByInvite(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	invite := chatManager.GetUsableInvite(db, c.Params("token"))
+	if invite.ID == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Invalid or expired invite link"))
+	}
+	chat := invite.ChatObj
+	if chatManager.GetRole(db, chat, *user) != "" {
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "You're already a member of this group"))
+	}
+	if blockManager.IsBlocked(db, *user, chat.OwnerID, invite.CreatorID) {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You can't join this group"))
+	}
+
+	if chat.JoinApprovalRequired {
+		request := chatManager.GetJoinRequest(db, chat.ID, *user)
+		if request.ID == nil {
+			if !chatManager.UseInvite(db, invite) {
+				return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Invalid or expired invite link"))
+			}
+			request = chatManager.CreateJoinRequest(db, invite, *user)
+		}
+		request.UserObj = *user
+		request = request.Init()
+		response := schemas.GroupJoinResponseSchema{
+			ResponseSchema: SuccessResponse("Join request sent"),
+			Data:           schemas.GroupJoinSchema{Request: &request},
+		}
+		return c.Status(200).JSON(response)
+	}
+
+	joined, errCode, errData := chatManager.Join(db, chat, *user, invite)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	if joined {
+		endpoint.sendSystemMessage(chat, models.SystemEventMemberJoined, *user)
+	}
+
+	// Convert type and return chat
+	chat, role := chatManager.GetMemberGroup(db, *user, chat.ID, true)
+	chat.UserRole = &role
+	chat = chat.InitG()
+	response := schemas.GroupJoinResponseSchema{
+		ResponseSchema: SuccessResponse("Group joined"),
+		Data:           schemas.GroupJoinSchema{Chat: &chat},
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Retrieve group join requests
+// @Description `This endpoint retrieves a paginated list of a group's pending join requests. Only admins can.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
+// @Success 200 {object} schemas.GroupJoinRequestsResponseSchema
+// @Router /chats/{chat_id}/requests [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveGroupJoinRequests(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chat, errCode, errData := endpoint.getAdminGroup(c, *user)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	// Paginate and return requests
+	requests := []models.ChatJoinRequest{}
+	paginator := Pagination{Table: "chat_join_requests", DefaultPerPage: 20, MaxPerPage: 100}
+	paginatedData, err := paginator.Paginate(c, chatManager.GetJoinRequestsQueryset(db, chat.ID), &requests)
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	response := schemas.GroupJoinRequestsResponseSchema{
+		ResponseSchema: SuccessResponse("Join requests fetched"),
+		Data: schemas.GroupJoinRequestsResponseDataSchema{
+			PaginatedResponseDataSchema: *paginatedData,
+			Items:                       requests,
+		}.Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Approve or reject a group join request
+// @Description `This endpoint approves (accepted: true) or rejects (accepted: false) a pending join request. Only admins can.`
+// @Tags Chat
+// @Param chat_id path string true "Chat ID (uuid)"
+// @Param request_id path string true "Join request ID (uuid)"
+// @Param data body schemas.GroupJoinRequestActionSchema true "Approve or reject"
+// @Success 200 {object} schemas.ResponseSchema
+// @Router /chats/{chat_id}/requests/{request_id} [post]
+// @Security BearerAuth
+func (endpoint Endpoint) HandleGroupJoinRequest(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	chat, errCode, errData := endpoint.getAdminGroup(c, *user)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	requestID, err := utils.ParseUUID(c.Params("request_id"))
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+
+	data := schemas.GroupJoinRequestActionSchema{}
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	request := chatManager.GetJoinRequestByID(db, chat.ID, *requestID)
+	if request.ID == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "This group has no join request with that ID"))
+	}
+	if !data.Accepted {
+		db.Delete(&request)
+		return c.Status(200).JSON(SuccessResponse("Join request rejected"))
+	}
+	if blockManager.IsBlocked(db, request.UserObj, chat.OwnerID, user.ID) {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You can't approve this user's request"))
+	}
+	joined, errCode, errData := chatManager.Join(db, *chat, request.UserObj)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	if joined {
+		endpoint.sendSystemMessage(*chat, models.SystemEventMemberJoined, request.UserObj)
+	}
+	db.Delete(&request)
+	return c.Status(200).JSON(SuccessResponse("Join request approved"))
+}
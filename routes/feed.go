@@ -1,32 +1,45 @@
 package routes
 
 import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/events"
 	"github.com/acatalepsy17/pigeon/managers"
 	"github.com/acatalepsy17/pigeon/models"
 	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/schemas"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
 )
 
 var postManager = managers.PostManager{}
 
 // @Summary Retrieve Latest Posts
-// @Description This endpoint retrieves paginated responses of latest posts
+// @Description This endpoint retrieves paginated responses of latest posts, except those of users you blocked, were blocked by or muted, and those you aren't in the audience of
 // @Tags Feed
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 200)" default(50)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.PostsResponseSchema
 // @Router /feed/posts [get]
 func (endpoint Endpoint) RetrievePosts(c *fiber.Ctx) error {
 	db := endpoint.DB
-	posts := postManager.All(db)
+	user := RequestUser(c)
 
-	// Paginate, Convert type and return Posts
-	paginatedData, paginatedPosts, err := PaginateQueryset(posts, c)
+	// Paginate and return Posts
+	posts := []models.Post{}
+	paginator := Pagination{Table: "posts", DefaultPerPage: 50, MaxPerPage: 200}
+	query := postManager.ExcludeInvisible(db, blockManager.ExcludeHidden(db, postManager.All(db), *user, "posts.author_id"), *user)
+	paginatedData, err := paginator.Paginate(c, query, &posts, managers.PostCountsPreloadScope)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	posts = paginatedPosts.([]models.Post)
 	response := schemas.PostsResponseSchema{
 		ResponseSchema: SuccessResponse("Posts fetched"),
 		Data: schemas.PostsResponseDataSchema{
@@ -37,8 +50,59 @@ func (endpoint Endpoint) RetrievePosts(c *fiber.Ctx) error {
 	return c.Status(200).JSON(response)
 }
 
+// @Summary Retrieve Home Feed
+// @Description `This endpoint retrieves the current user's home feed: posts from their friends and the users they follow (and their own), blended with other recent posts that are getting reactions & comments. Newer and more engaging posts rank higher.`
+// @Description
+// @Description `The first page (without cursor) takes a snapshot of the feed which the next links keep paging through for 30 minutes, so new posts, reactions, friends & follows don't shift the pages.`
+// @Tags Feed
+// @Param per_page query int false "Items per page (max 50)" default(20)
+// @Param cursor query string false "Cursor from the previous page's next link"
+// @Success 200 {object} schemas.PostsResponseSchema
+// @Router /feed/home [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveHomeFeed(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	perPage := c.QueryInt("per_page", 20)
+	if perPage < 1 || perPage > 50 {
+		return c.Status(400).JSON(utils.RequestErr(utils.ERR_INVALID_VALUE, "per_page must be between 1 and 50"))
+	}
+	var cursor *managers.HomeFeedCursor
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		decodedCursor, err := decodeHomeFeedCursor(cursorParam)
+		if err != nil {
+			return c.Status(400).JSON(err)
+		}
+		cursor = decodedCursor
+	}
+
+	posts, next, total, errCode, errData := postManager.GetHomeFeed(db, *user, time.Now().UTC(), cursor, perPage)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+	paginatedData := schemas.PaginatedResponseDataSchema{
+		PerPage:    uint(perPage),
+		LastPage:   uint(max(1, math.Ceil(float64(total)/float64(perPage)))),
+		TotalItems: total,
+	}
+	if next != nil {
+		paginatedData.Next = pageLink(c, "cursor", encodeHomeFeedCursor(*next))
+	}
+	response := schemas.PostsResponseSchema{
+		ResponseSchema: SuccessResponse("Home feed fetched"),
+		Data: schemas.PostsResponseDataSchema{
+			PaginatedResponseDataSchema: paginatedData,
+			Items:                       posts,
+		}.Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
 // @Summary Create Post
-// @Description This endpoint creates a new post
+// @Description `This endpoint creates a new post.`
+// @Description
+// @Description `Its audience is who can see it (and its comments, replies & reactions): PUBLIC, FRIENDS, ONLY_ME or CUSTOM (the users in audience_usernames). Without one, it's the user's default_post_audience.`
 // @Tags Feed
 // @Param post body schemas.PostInputSchema true "Post object"
 // @Success 201 {object} schemas.PostInputResponseSchema
@@ -54,7 +118,12 @@ func (endpoint Endpoint) CreatePost(c *fiber.Ctx) error {
 		return c.Status(*errCode).JSON(errData)
 	}
 
-	post := postManager.Create(db, *user, data)
+	audienceUsers, errData := getPostAudienceUsers(db, *user, data)
+	if errData != nil {
+		return c.Status(422).JSON(errData)
+	}
+	post := postManager.Create(db, *user, data, audienceUsers)
+	setPostAudienceUsernames(db, *user, &post)
 
 	// Convert type and return Post
 	response := schemas.PostInputResponseSchema{
@@ -79,6 +148,11 @@ func (endpoint Endpoint) RetrievePost(c *fiber.Ctx) error {
 	if errCode != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
+	user := RequestUser(c)
+	if postManager.IsHidden(db, *user, post, nil, nil) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Post does not exist"))
+	}
+	setPostAudienceUsernames(db, *user, post)
 	response := schemas.PostResponseSchema{
 		ResponseSchema: SuccessResponse("Post Detail fetched"),
 		Data:           post.Init(),
@@ -117,8 +191,18 @@ func (endpoint Endpoint) UpdatePost(c *fiber.Ctx) error {
 		return c.Status(400).JSON(utils.RequestErr(utils.ERR_INVALID_OWNER, "This Post isn't yours"))
 	}
 
+	// Usernames alone change the users of a CUSTOM audience
+	if data.Audience == nil && len(data.AudienceUsernames) > 0 && post.Audience == choices.PACUSTOM {
+		data.Audience = &post.Audience
+	}
+
 	// Update, Convert type and return Post
-	post = postManager.Update(db, post, data)
+	audienceUsers, errData := getPostAudienceUsers(db, *user, data)
+	if errData != nil {
+		return c.Status(422).JSON(errData)
+	}
+	post = postManager.Update(db, post, data, audienceUsers)
+	setPostAudienceUsernames(db, *user, post)
 	response := schemas.PostInputResponseSchema{
 		ResponseSchema: SuccessResponse("Post updated"),
 		Data:           post.InitC(data.FileType),
@@ -154,6 +238,62 @@ func (endpoint Endpoint) DeletePost(c *fiber.Ctx) error {
 	return c.Status(200).JSON(SuccessResponse("Post Deleted"))
 }
 
+// The users of a CUSTOM audience in the request. Usernames that don't exist or are the author's own are rejected,
+// as are usernames for any other audience.
+func getPostAudienceUsers(db *gorm.DB, user models.User, data schemas.PostInputSchema) ([]models.User, *utils.ErrorResponse) {
+	if data.Audience == nil || *data.Audience != choices.PACUSTOM {
+		if len(data.AudienceUsernames) > 0 {
+			data := map[string]string{
+				"audience_usernames": "Only a CUSTOM audience has usernames",
+			}
+			errData := utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data)
+			return nil, &errData
+		}
+		return nil, nil
+	}
+	users := userManager.GetByUsernames(db, data.AudienceUsernames, user.ID)
+	if len(users) == 0 {
+		data := map[string]string{
+			"audience_usernames": "Enter at least one valid username for a CUSTOM audience",
+		}
+		errData := utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data)
+		return nil, &errData
+	}
+	found := map[string]bool{}
+	for _, audienceUser := range users {
+		found[audienceUser.Username] = true
+	}
+	invalidUsernames := []string{}
+	for _, username := range data.AudienceUsernames {
+		if !found[username] && !slices.Contains(invalidUsernames, username) {
+			invalidUsernames = append(invalidUsernames, username)
+		}
+	}
+	if len(invalidUsernames) > 0 {
+		data := map[string]string{
+			"audience_usernames": fmt.Sprintf("Invalid usernames: %s", strings.Join(invalidUsernames, ", ")),
+		}
+		errData := utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data)
+		return nil, &errData
+	}
+	return users, nil
+}
+
+// Shows the users of a CUSTOM audience to the post's author
+func setPostAudienceUsernames(db *gorm.DB, user models.User, post *models.Post) {
+	if post.Audience == choices.PACUSTOM && post.AuthorID.String() == user.ID.String() {
+		post.AudienceUsernames = postManager.GetAudienceUsernames(db, *post)
+	}
+}
+
+// Whether the receiver is notified of the user's action on their post, comment or reply:
+// not if it's their own, they muted the user or they can't see it anymore
+func notifies(db *gorm.DB, user models.User, receiver models.User, post *models.Post, comment *models.Comment, reply *models.Reply) bool {
+	return user.ID.String() != receiver.ID.String() &&
+		!blockManager.IsMuted(db, receiver.ID, user.ID) &&
+		!postManager.IsHidden(db, receiver, post, comment, reply)
+}
+
 var reactionManager = managers.ReactionManager{}
 
 // @Summary Retrieve Latest Reactions of a Post, Comment, or Reply
@@ -177,17 +317,17 @@ func (endpoint Endpoint) RetrieveReactions(c *fiber.Ctx) error {
 		return c.Status(404).JSON(err)
 	}
 
-	// Paginate, Convert type and return Posts
-	reactions, errCode, errData := reactionManager.GetReactionsQueryset(db, c, focus, slug)
+	query, errCode, errData := reactionManager.GetReactionsQueryset(db, c, *RequestUser(c), focus, slug)
 	if errCode != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
-	// Paginate, Convert type and return Reactions
-	paginatedData, paginatedReactions, err := PaginateQueryset(reactions, c)
+	// Paginate and return Reactions
+	reactions := []models.Reaction{}
+	paginator := Pagination{Table: "reactions", DefaultPerPage: 50, MaxPerPage: 200}
+	paginatedData, err := paginator.Paginate(c, query, &reactions)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	reactions = paginatedReactions.([]models.Reaction)
 	response := schemas.ReactionsResponseSchema{
 		ResponseSchema: SuccessResponse("Reactions fetched"),
 		Data: schemas.ReactionsResponseDataSchema{
@@ -240,7 +380,7 @@ func (endpoint Endpoint) CreateReaction(c *fiber.Ctx) error {
 	}
 
 	// Create & Send Notifications
-	if user.ID.String() != targetedObjAuthor.ID.String() {
+	if notifies(db, *user, *targetedObjAuthor, reaction.Post, reaction.Comment, reaction.Reply) {
 		notification, created := notificationManager.GetOrCreate(
 			db, user, choices.NREACTION,
 			[]models.User{*targetedObjAuthor},
@@ -249,7 +389,7 @@ func (endpoint Endpoint) CreateReaction(c *fiber.Ctx) error {
 			reaction.Reply,
 		)
 		if created {
-			SendNotificationInSocket(c, notification, nil, nil)
+			endpoint.Bus.Publish(events.NotificationCreated{Notification: notification, ReceiverIDs: []uuid.UUID{targetedObjAuthor.ID}})
 		}
 	}
 	return c.Status(201).JSON(response)
@@ -289,8 +429,8 @@ func (endpoint Endpoint) DeleteReaction(c *fiber.Ctx) error {
 		reaction.Post, reaction.Comment, reaction.Reply,
 	)
 	if notification != nil {
-		// Send to websocket and delete notification
-		SendNotificationInSocket(c, *notification, nil, nil, "DELETED")
+		receiverIDs := notificationManager.Delete(db, notification)
+		endpoint.Bus.Publish(events.NotificationDeleted{Notification: *notification, ReceiverIDs: receiverIDs})
 	}
 
 	// Delete reaction and return response
@@ -305,6 +445,8 @@ var commentManager = managers.CommentManager{}
 // @Tags Feed
 // @Param slug path string true "Post Slug"
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 200)" default(50)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.CommentsResponseSchema
 // @Router /feed/posts/{slug}/comments [get]
 func (endpoint Endpoint) RetrieveComments(c *fiber.Ctx) error {
@@ -316,16 +458,19 @@ func (endpoint Endpoint) RetrieveComments(c *fiber.Ctx) error {
 	if errCode != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
+	user := RequestUser(c)
+	if postManager.IsHidden(db, *user, post, nil, nil) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Post does not exist"))
+	}
 
-	// Get Comments
-	comments := commentManager.GetByPostID(db, post.ID)
-
-	// Paginate, Convert type and return comments
-	paginatedData, paginatedComments, err := PaginateQueryset(comments, c)
+	// Paginate and return comments
+	comments := []models.Comment{}
+	paginator := Pagination{Table: "comments", DefaultPerPage: 50, MaxPerPage: 200}
+	query := blockManager.ExcludeHidden(db, commentManager.GetByPostID(db, post.ID), *user, "comments.author_id")
+	paginatedData, err := paginator.Paginate(c, query, &comments, managers.CommentCountsPreloadScope)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	comments = paginatedComments.([]models.Comment)
 	response := schemas.CommentsResponseSchema{
 		ResponseSchema: SuccessResponse("Comments fetched"),
 		Data: schemas.CommentsResponseDataSchema{
@@ -354,6 +499,9 @@ func (endpoint Endpoint) CreateComment(c *fiber.Ctx) error {
 	if errCode != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
+	if postManager.IsHidden(db, *user, post, nil, nil) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Post does not exist"))
+	}
 
 	data := schemas.CommentInputSchema{}
 	// Validate request
@@ -365,9 +513,9 @@ func (endpoint Endpoint) CreateComment(c *fiber.Ctx) error {
 	comment := commentManager.Create(db, *user, *post, data.Text)
 
 	// Created & Send Notification
-	if user.ID.String() != post.AuthorID.String() {
+	if notifies(db, *user, post.AuthorObj, post, nil, nil) {
 		notification := notificationManager.Create(db, user, choices.NCOMMENT, []models.User{post.AuthorObj}, nil, &comment, nil, nil)
-		SendNotificationInSocket(c, notification, nil, nil)
+		endpoint.Bus.Publish(events.NotificationCreated{Notification: notification, ReceiverIDs: []uuid.UUID{post.AuthorID}})
 	}
 
 	response := schemas.CommentResponseSchema{
@@ -382,6 +530,8 @@ func (endpoint Endpoint) CreateComment(c *fiber.Ctx) error {
 // @Tags Feed
 // @Param slug path string true "Comment Slug"
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 200)" default(50)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.CommentWithRepliesResponseSchema
 // @Router /feed/comments/{slug} [get]
 func (endpoint Endpoint) RetrieveCommentWithReplies(c *fiber.Ctx) error {
@@ -393,13 +543,19 @@ func (endpoint Endpoint) RetrieveCommentWithReplies(c *fiber.Ctx) error {
 	if errCode != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
+	user := RequestUser(c)
+	if postManager.IsHidden(db, *user, nil, comment, nil) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Comment does not exist"))
+	}
 
-	// Paginate, Convert type and return replies
-	paginatedData, paginatedReplies, err := PaginateQueryset(comment.Replies, c)
+	// Paginate and return replies
+	replies := []models.Reply{}
+	paginator := Pagination{Table: "replies", DefaultPerPage: 50, MaxPerPage: 200}
+	query := blockManager.ExcludeHidden(db, replyManager.GetByCommentID(db, comment.ID), *user, "replies.author_id")
+	paginatedData, err := paginator.Paginate(c, query, &replies, managers.ReactionsPreloadScope)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	replies := paginatedReplies.([]models.Reply)
 	response := schemas.CommentWithRepliesResponseSchema{
 		ResponseSchema: SuccessResponse("Comment with replies fetched"),
 		Data: schemas.CommentWithRepliesSchema{
@@ -433,6 +589,9 @@ func (endpoint Endpoint) CreateReply(c *fiber.Ctx) error {
 	if errCode != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
+	if postManager.IsHidden(db, *user, nil, comment, nil) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Comment does not exist"))
+	}
 
 	data := schemas.CommentInputSchema{}
 	// Validate request
@@ -444,9 +603,9 @@ func (endpoint Endpoint) CreateReply(c *fiber.Ctx) error {
 	reply := replyManager.Create(db, *user, *comment, data.Text)
 
 	// Created & Send Notification
-	if user.ID.String() != comment.AuthorID.String() {
+	if notifies(db, *user, comment.AuthorObj, nil, comment, nil) {
 		notification := notificationManager.Create(db, user, choices.NREPLY, []models.User{comment.AuthorObj}, nil, nil, &reply, nil)
-		SendNotificationInSocket(c, notification, nil, nil)
+		endpoint.Bus.Publish(events.NotificationCreated{Notification: notification, ReceiverIDs: []uuid.UUID{comment.AuthorID}})
 	}
 
 	// Convert type and return reply
@@ -523,11 +682,12 @@ func (endpoint Endpoint) DeleteComment(c *fiber.Ctx) error {
 		nil, comment, nil,
 	)
 	if notification != nil {
-		// Send to websocket and delete notification & comment
-		SendNotificationInSocket(c, *notification, &comment.Slug, nil, "DELETED")
+		receiverIDs := notificationManager.Delete(db, notification)
+		endpoint.Bus.Publish(events.NotificationDeleted{Notification: *notification, CommentSlug: &comment.Slug, ReceiverIDs: receiverIDs})
 	}
 
-	// Return response
+	// Delete comment and return response
+	db.Delete(comment)
 	return c.Status(200).JSON(SuccessResponse("Comment Deleted"))
 }
 
@@ -546,6 +706,9 @@ func (endpoint Endpoint) RetrieveReply(c *fiber.Ctx) error {
 	if errCode != nil {
 		return c.Status(*errCode).JSON(errData)
 	}
+	if postManager.IsHidden(db, *RequestUser(c), nil, nil, reply) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "Reply does not exist"))
+	}
 
 	// Convert type and return reply
 	response := schemas.ReplyResponseSchema{
@@ -621,10 +784,11 @@ func (endpoint Endpoint) DeleteReply(c *fiber.Ctx) error {
 		nil, nil, reply,
 	)
 	if notification != nil {
-		// Send to websocket and delete notification
-		SendNotificationInSocket(c, *notification, nil, &reply.Slug, "DELETED")
+		receiverIDs := notificationManager.Delete(db, notification)
+		endpoint.Bus.Publish(events.NotificationDeleted{Notification: *notification, ReplySlug: &reply.Slug, ReceiverIDs: receiverIDs})
 	}
 
-	// Return response
+	// Delete reply and return response
+	db.Delete(reply)
 	return c.Status(200).JSON(SuccessResponse("Reply Deleted"))
 }
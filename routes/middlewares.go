@@ -9,16 +9,16 @@ import (
 	"gorm.io/gorm"
 )
 
-func GetUser(token string, db *gorm.DB) (*models.User, *string) {
+func GetUser(token string, db *gorm.DB) (*models.User, *models.Session, *string) {
 	if !strings.HasPrefix(token, "Bearer ") {
 		err := "Bearer token is not provided!"
-		return nil, &err
+		return nil, nil, &err
 	}
-	user, err := DecodeAccessToken(token[7:], db)
+	user, session, err := DecodeAccessToken(token[7:], db)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return user, nil
+	return user, session, nil
 }
 
 func (ep Endpoint) AuthMiddleware(c *fiber.Ctx) error {
@@ -28,11 +28,12 @@ func (ep Endpoint) AuthMiddleware(c *fiber.Ctx) error {
 	if len(token) < 1 {
 		return c.Status(401).JSON(utils.RequestErr(utils.ERR_UNAUTHORIZED_USER, "Unauthorized User!"))
 	}
-	user, err := GetUser(token, db)
+	user, session, err := GetUser(token, db)
 	if err != nil {
 		return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, *err))
 	}
 	c.Locals("user", user)
+	c.Locals("session", session)
 	return c.Next()
 }
 
@@ -40,13 +41,16 @@ func (ep Endpoint) GuestMiddleware(c *fiber.Ctx) error {
 	token := c.Get("Authorization")
 	db := ep.DB
 	var user *models.User
+	var session *models.Session
 	if len(token) > 0 {
-		userObj, err := GetUser(token, db)
+		userObj, sessionObj, err := GetUser(token, db)
 		if err != nil {
 			return c.Status(401).JSON(utils.RequestErr(utils.ERR_INVALID_TOKEN, *err))
 		}
 		user = userObj
+		session = sessionObj
 	}
 	c.Locals("user", user)
+	c.Locals("session", session)
 	return c.Next()
 }
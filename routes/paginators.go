@@ -1,59 +1,210 @@
 package routes
 
 import (
+	"encoding/base64"
+	"fmt"
 	"math"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/acatalepsy17/pigeon/managers"
 	"github.com/acatalepsy17/pigeon/schemas"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-func PaginateQueryset(queryset interface{}, fiberCtx *fiber.Ctx, opts ...int) (*schemas.PaginatedResponseDataSchema, any, *utils.ErrorResponse) {
-	currentPage := fiberCtx.QueryInt("page", 1)
-	var perPage int
+// How a list endpoint pages through its query. Items are ordered newest first by the table's (OrderColumn, id).
+type Pagination struct {
+	Table          string
+	OrderColumn    string // created_at if not set
+	OrderBy        string // ordered by this first if set (e.g relevance), which cursors can't follow so only pages are supported
+	DefaultPerPage int
+	MaxPerPage     int
+}
 
-	if currentPage < 1 {
-		errData := utils.RequestErr(utils.ERR_INVALID_PAGE, "Invalid Page")
-		return nil, nil, &errData
+// Paginates the query in the database and loads the page into items (a pointer to a slice).
+// Pages are picked with page (a COUNT, then LIMIT/OFFSET), or in keyset mode with cursor (empty for the first page),
+// which stays fast deep into large tables and doesn't repeat items when new ones are added.
+// Preloads are only applied when loading the page, as they can't be part of the count.
+func (p Pagination) Paginate(fiberCtx *fiber.Ctx, query *gorm.DB, items interface{}, preloads ...func(*gorm.DB) *gorm.DB) (*schemas.PaginatedResponseDataSchema, *utils.ErrorResponse) {
+	perPage := fiberCtx.QueryInt("per_page", p.DefaultPerPage)
+	if perPage < 1 || perPage > p.MaxPerPage {
+		errData := utils.RequestErr(utils.ERR_INVALID_VALUE, fmt.Sprintf("per_page must be between 1 and %d", p.MaxPerPage))
+		return nil, &errData
 	}
-
-	// Check if page size is provided as an argument
-	if len(opts) > 0 {
-		perPage = opts[0]
-	} else {
-		// Default page size if not provided
-		perPage = 50
+	orderColumn := p.OrderColumn
+	if orderColumn == "" {
+		orderColumn = "created_at"
 	}
-	querysetValue := reflect.ValueOf(queryset)
-	itemsCount := querysetValue.Len()
-	lastPage := math.Ceil(float64(itemsCount) / float64(perPage))
+	orderKey, idKey := p.Table+"."+orderColumn, p.Table+".id"
+
+	var totalItems int64
+	query.Session(&gorm.Session{}).Count(&totalItems)
+	lastPage := int(math.Ceil(float64(totalItems) / float64(perPage)))
 	if lastPage == 0 {
 		lastPage = 1
 	}
-	if currentPage > int(lastPage) {
+	paginatorData := schemas.PaginatedResponseDataSchema{
+		PerPage:    uint(perPage),
+		LastPage:   uint(lastPage),
+		TotalItems: totalItems,
+	}
+	pageQuery := query.Session(&gorm.Session{}).Scopes(preloads...).Order(p.OrderBy).Order(orderKey + " DESC").Order(idKey + " DESC")
+
+	// Keyset mode
+	if fiberCtx.Context().QueryArgs().Has("cursor") {
+		if p.OrderBy != "" {
+			errData := utils.RequestErr(utils.ERR_INVALID_REQUEST, "cursor isn't supported here, use page")
+			return nil, &errData
+		}
+		if cursor := fiberCtx.Query("cursor"); cursor != "" {
+			orderValue, id, err := decodePageCursor(cursor)
+			if err != nil {
+				return nil, err
+			}
+			pageQuery = pageQuery.Where("("+orderKey+", "+idKey+") < (?, ?)", orderValue, id)
+		}
+		pageQuery.Limit(perPage + 1).Find(items)
+
+		page := reflect.ValueOf(items).Elem()
+		if page.Len() > perPage {
+			page.Set(page.Slice(0, perPage))
+			nextCursor, err := encodePageCursor(query, items, page.Index(perPage-1), orderColumn)
+			if err != nil {
+				errData := utils.RequestErr(utils.ERR_SERVER_ERROR, "Unable to paginate")
+				return nil, &errData
+			}
+			paginatorData.Next = pageLink(fiberCtx, "cursor", nextCursor)
+		}
+		return &paginatorData, nil
+	}
+
+	currentPage := fiberCtx.QueryInt("page", 1)
+	if currentPage < 1 {
+		errData := utils.RequestErr(utils.ERR_INVALID_PAGE, "Invalid Page")
+		return nil, &errData
+	}
+	if currentPage > lastPage {
 		errData := utils.RequestErr(utils.ERR_INVALID_PAGE, "Page number is out of range")
-		return nil, nil, &errData
+		return nil, &errData
+	}
+	pageQuery.Limit(perPage).Offset((currentPage - 1) * perPage).Find(items)
+
+	paginatorData.CurrentPage = uint(currentPage)
+	if currentPage < lastPage {
+		paginatorData.Next = pageLink(fiberCtx, "page", strconv.Itoa(currentPage+1))
+	}
+	if currentPage > 1 {
+		paginatorData.Previous = pageLink(fiberCtx, "page", strconv.Itoa(currentPage-1))
 	}
+	return &paginatorData, nil
+}
 
-	startIndex := (currentPage - 1) * perPage
-	endIndex := startIndex + perPage
+// The current URL with a query param replaced
+func pageLink(fiberCtx *fiber.Ctx, param string, value string) *string {
+	params, _ := url.ParseQuery(string(fiberCtx.Request().URI().QueryString()))
+	params.Set(param, value)
+	link := fiberCtx.BaseURL() + fiberCtx.Path() + "?" + params.Encode()
+	return &link
+}
 
-	// Ensure startIndex is within bounds
-	if startIndex < 0 {
-		startIndex = 0
+// A keyset cursor holds the order column value & id of the last item of a page
+func encodePageCursor(query *gorm.DB, items interface{}, item reflect.Value, orderColumn string) (string, error) {
+	stmt := query.Session(&gorm.Session{}).Statement
+	if err := stmt.Parse(items); err != nil {
+		return "", err
+	}
+	orderField, idField := stmt.Schema.LookUpField(orderColumn), stmt.Schema.LookUpField("id")
+	if orderField == nil || idField == nil {
+		return "", fmt.Errorf("no %s or id field", orderColumn)
 	}
+	orderValue, _ := orderField.ValueOf(stmt.Context, item)
+	idValue, _ := idField.ValueOf(stmt.Context, item)
+	orderTime, ok := orderValue.(time.Time)
+	id, ok2 := idValue.(uuid.UUID)
+	if !ok || !ok2 {
+		return "", fmt.Errorf("unsupported %s or id type", orderColumn)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(orderTime.Format(time.RFC3339Nano) + "|" + id.String())), nil
+}
 
-	// Ensure endIndex is within bounds
-	if endIndex > itemsCount {
-		endIndex = itemsCount
+func decodePageCursor(cursor string) (time.Time, uuid.UUID, *utils.ErrorResponse) {
+	errData := utils.RequestErr(utils.ERR_INVALID_VALUE, "Invalid cursor")
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, nil, &errData
 	}
+	orderValue, idValue, found := strings.Cut(string(decoded), "|")
+	orderTime, err := time.Parse(time.RFC3339Nano, orderValue)
+	id := uuid.Parse(idValue)
+	if !found || err != nil || id == nil {
+		return time.Time{}, nil, &errData
+	}
+	return orderTime, id, nil
+}
 
-	paginatorData := schemas.PaginatedResponseDataSchema{
-		PerPage:     uint(perPage),
-		CurrentPage: uint(currentPage),
-		LastPage:    uint(lastPage),
+// A home feed cursor holds the feed's snapshot id and the score & id of the last post of a page
+func encodeHomeFeedCursor(cursor managers.HomeFeedCursor) string {
+	value := strings.Join([]string{
+		cursor.SnapshotID.String(), strconv.FormatFloat(cursor.Score, 'g', -1, 64), cursor.ID.String(),
+	}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeHomeFeedCursor(cursor string) (*managers.HomeFeedCursor, *utils.ErrorResponse) {
+	errData := utils.RequestErr(utils.ERR_INVALID_VALUE, "Invalid cursor")
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, &errData
 	}
-	paginatedItems := querysetValue.Slice(startIndex, endIndex).Interface()
-	return &paginatorData, paginatedItems, nil
+	parts := strings.Split(string(decoded), "|")
+	if len(parts) != 3 {
+		return nil, &errData
+	}
+	snapshotID := uuid.Parse(parts[0])
+	score, err := strconv.ParseFloat(parts[1], 64)
+	id := uuid.Parse(parts[2])
+	if snapshotID == nil || err != nil || id == nil {
+		return nil, &errData
+	}
+	return &managers.HomeFeedCursor{SnapshotID: snapshotID, Score: score, ID: id}, nil
+}
+
+// Reads the keyset pagination params: at most one of the before, after & around cursors (an item ID) and the page size.
+// Returns the name of the cursor param used, if any.
+func ParseCursorParams(fiberCtx *fiber.Ctx, defaultPerPage int, maxPerPage int) (string, *uuid.UUID, int, *utils.ErrorResponse) {
+	perPage := fiberCtx.QueryInt("per_page", defaultPerPage)
+	if perPage < 1 || perPage > maxPerPage {
+		errData := utils.RequestErr(utils.ERR_INVALID_VALUE, fmt.Sprintf("per_page must be between 1 and %d", maxPerPage))
+		return "", nil, 0, &errData
+	}
+
+	direction := ""
+	var cursor *uuid.UUID
+	for _, param := range []string{"before", "after", "around"} {
+		value := fiberCtx.Query(param)
+		if value == "" {
+			continue
+		}
+		if direction != "" {
+			errData := utils.RequestErr(utils.ERR_INVALID_REQUEST, "Use only one of before, after or around")
+			return "", nil, 0, &errData
+		}
+		parsedCursor, err := utils.ParseUUID(value)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		direction, cursor = param, parsedCursor
+	}
+	return direction, cursor, perPage, nil
+}
+
+func preloadAssociations(db *gorm.DB) *gorm.DB {
+	return db.Preload(clause.Associations)
 }
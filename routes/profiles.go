@@ -4,15 +4,21 @@ import (
 	"fmt"
 	"regexp"
 
+	"github.com/acatalepsy17/pigeon/events"
 	"github.com/acatalepsy17/pigeon/managers"
 	"github.com/acatalepsy17/pigeon/models"
 	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/schemas"
+	"github.com/acatalepsy17/pigeon/senders"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+var userManager = managers.UserManager{}
+
 // @Summary Retrieve cities based on query params
 // @Description This endpoint retrieves the first 10 cities that matches the query params
 // @Tags Profiles
@@ -45,6 +51,8 @@ func (endpoint Endpoint) RetrieveCities(c *fiber.Ctx) error {
 // @Description This endpoint retrieves a paginated list of users
 // @Tags Profiles
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 200)" default(50)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.ProfilesResponseSchema
 // @Router /profiles [get]
 // @Security BearerAuth
@@ -52,18 +60,17 @@ func (endpoint Endpoint) RetrieveUsers(c *fiber.Ctx) error {
 	db := endpoint.DB
 	user := RequestUser(c)
 
-	users := []models.User{}
-	query := db.Preload(clause.Associations)
+	query := db.Model(&models.User{})
 	if user != nil {
-		query.Not(models.User{BaseModel: models.BaseModel{ID: user.ID}})
+		query = blockManager.ExcludeBlocked(db, query.Where("users.id <> ?", user.ID), *user, "users.id")
 	}
-	query.Find(&users)
-	// Paginate, Convert type and return Users
-	paginatedData, paginatedUsers, err := PaginateQueryset(users, c)
+	// Paginate and return Users
+	users := []models.User{}
+	paginator := Pagination{Table: "users", DefaultPerPage: 50, MaxPerPage: 200}
+	paginatedData, err := paginator.Paginate(c, query, &users, preloadAssociations)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	users = paginatedUsers.([]models.User)
 
 	response := schemas.ProfilesResponseSchema{
 		ResponseSchema: SuccessResponse("Users fetched"),
@@ -76,7 +83,7 @@ func (endpoint Endpoint) RetrieveUsers(c *fiber.Ctx) error {
 }
 
 // @Summary Retrieve User Profile
-// @Description This endpoint retrieves a user profile
+// @Description This endpoint retrieves a user profile, with their followers & following counts and whether the current user follows them
 // @Tags Profiles
 // @Param username path string true "Username of user"
 // @Success 200 {object} schemas.ProfileResponseSchema
@@ -87,14 +94,24 @@ func (endpoint Endpoint) RetrieveUserProfile(c *fiber.Ctx) error {
 
 	user := models.User{}
 	db.Preload("CityObj").Preload("AvatarObj").Take(&user, models.User{Username: username})
-	if user.ID == nil {
+	if user.ID == nil || blockManager.GetBlock(db, user.ID, RequestUser(c).ID) != nil {
 		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "No user with that username"))
 	}
+	followersCount, followingCount := followManager.GetCounts(db, user)
+	user.FollowersCount = &followersCount
+	user.FollowingCount = &followingCount
+	if follow := followManager.Get(db, RequestUser(c).ID, user.ID); follow != nil {
+		user.FollowStatus = &follow.Status
+	}
 
-	// Return User
+	// Return User, with their own settings if it's the current user
+	data := user.Init()
+	if user.ID.String() == RequestUser(c).ID.String() {
+		data = user.InitOwn()
+	}
 	response := schemas.ProfileResponseSchema{
 		ResponseSchema: SuccessResponse("User details fetched"),
-		Data:           user.Init(),
+		Data:           data,
 	}
 	return c.Status(200).JSON(response)
 }
@@ -137,8 +154,13 @@ func (endpoint Endpoint) UpdateProfile(c *fiber.Ctx) error {
 		user.AvatarObj = &file
 	}
 	// Set values & save
+	approvedFollowers := user.ApproveFollowers
 	user = data.SetValues(user)
 	db.Save(&user)
+	if approvedFollowers && !user.ApproveFollowers {
+		// No one is left waiting for an approval that can't come anymore
+		followManager.AcceptPending(db, *user)
+	}
 
 	// Return repsonse
 	updatedData := schemas.ProfileUpdateResponseDataSchema{
@@ -151,6 +173,115 @@ func (endpoint Endpoint) UpdateProfile(c *fiber.Ctx) error {
 	return c.Status(200).JSON(response)
 }
 
+// @Summary Request an email change
+// @Description `This endpoint sends an otp to the new email address and a notice (with a cancel link) to the current one.`
+// @Description `The change is only applied once the otp is confirmed at /profiles/profile/email/confirm.`
+// @Tags Profiles
+// @Param email body schemas.EmailChangeSchema true "New email & password"
+// @Success 200 {object} schemas.ResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Router /profiles/profile/email [post]
+// @Security BearerAuth
+func (endpoint Endpoint) RequestEmailChange(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	data := schemas.EmailChangeSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	// Check if password is valid
+	if user.Password != "" && !utils.CheckPasswordHash(data.Password, user.Password) {
+		data := map[string]string{
+			"password": "Incorrect password",
+		}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+
+	// Validate the new email
+	if errData := validateNewEmail(db, user, data.Email); errData != nil {
+		return c.Status(422).JSON(errData)
+	}
+
+	code, errCode, errData := otpManager.Create(db, *user, choices.OPEMAILCHANGE, data.Email)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	// Send the otp to the new address & a notice to the current one
+	go senders.SendEmail(user, "email-change", code, map[string]string{"email": data.Email})
+	cancelLink := fmt.Sprintf("%s/email-change/cancel?token=%s", cfg.FrontendURL, GenerateEmailChangeCancelToken(user.ID, data.Email))
+	go senders.SendEmail(user, "email-change-notice", nil, map[string]string{"link": cancelLink, "new_email": data.Email})
+
+	return c.Status(200).JSON(SuccessResponse("Otp sent to the new email"))
+}
+
+// @Summary Confirm an email change
+// @Description `This endpoint applies a pending email change with the otp sent to the new address.`
+// @Tags Profiles
+// @Param otp body schemas.EmailChangeConfirmSchema true "Otp"
+// @Success 200 {object} schemas.ProfileResponseSchema
+// @Failure 422 {object} utils.ErrorResponse
+// @Router /profiles/profile/email/confirm [post]
+// @Security BearerAuth
+func (endpoint Endpoint) ConfirmEmailChange(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	data := schemas.EmailChangeConfirmSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	otp, errCode, errData := otpManager.Verify(db, *user, choices.OPEMAILCHANGE, data.Otp)
+	if errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	// The address may have been taken since the change was requested
+	if errData := validateNewEmail(db, user, *otp.Target); errData != nil {
+		return c.Status(422).JSON(errData)
+	}
+
+	// Update User
+	// The unique constraint still catches an address taken in between
+	user.Email = *otp.Target
+	if result := db.Model(user).Select("Email").Updates(user); result.Error != nil {
+		data := map[string]string{"email": "Email already taken!"}
+		return c.Status(422).JSON(utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", data))
+	}
+
+	response := schemas.ProfileResponseSchema{
+		ResponseSchema: SuccessResponse("Email changed"),
+		Data:           user.InitOwn(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// Same uniqueness check as at sign up
+func validateNewEmail(db *gorm.DB, user *models.User, email string) *utils.ErrorResponse {
+	var errMsg string
+	if email == user.Email {
+		errMsg = "This is already your email"
+	} else {
+		existingUser := models.User{}
+		db.Take(&existingUser, models.User{Email: email})
+		if existingUser.ID != nil {
+			errMsg = "Email already taken!"
+		}
+	}
+	if errMsg == "" {
+		return nil
+	}
+	errData := utils.RequestErr(utils.ERR_INVALID_ENTRY, "Invalid Entry", map[string]string{"email": errMsg})
+	return &errData
+}
+
 // @Summary Delete User's Account
 // @Description This endpoint deletes a particular user's account (irreversible)
 // @Tags Profiles
@@ -170,7 +301,7 @@ func (endpoint Endpoint) DeleteUser(c *fiber.Ctx) error {
 	}
 
 	// Check if password is valid
-	if !utils.CheckPasswordHash(data.Password, user.Password) {
+	if user.Password != "" && !utils.CheckPasswordHash(data.Password, user.Password) {
 		data := map[string]string{
 			"password": "Incorrect password",
 		}
@@ -188,19 +319,22 @@ var friendManager = managers.FriendManager{}
 // @Description This endpoint retrieves friends of a user
 // @Tags Profiles
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.ProfilesResponseSchema
 // @Router /profiles/friends [get]
 // @Security BearerAuth
 func (endpoint Endpoint) RetrieveFriends(c *fiber.Ctx) error {
 	db := endpoint.DB
 	user := RequestUser(c)
-	friends := friendManager.GetFriends(db, *user)
+
 	// Paginate and return Friends
-	paginatedData, paginatedFriends, err := PaginateQueryset(friends, c, 20)
+	friends := []models.User{}
+	paginator := Pagination{Table: "users", DefaultPerPage: 20, MaxPerPage: 100}
+	paginatedData, err := paginator.Paginate(c, friendManager.GetFriendsQueryset(db, *user), &friends, preloadAssociations)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	friends = paginatedFriends.([]models.User)
 	response := schemas.ProfilesResponseSchema{
 		ResponseSchema: SuccessResponse("Friends fetched"),
 		Data: schemas.ProfilesResponseDataSchema{
@@ -211,10 +345,55 @@ func (endpoint Endpoint) RetrieveFriends(c *fiber.Ctx) error {
 	return c.Status(200).JSON(response)
 }
 
+// @Summary Retrieve Presence
+// @Description This endpoint retrieves the presence (online, away or offline & last seen) of the user's friends and chat partners
+// @Tags Profiles
+// @Success 200 {object} schemas.PresenceResponseSchema
+// @Router /profiles/presence [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrievePresence(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	users := friendManager.GetFriends(db, *user)
+	seen := map[string]bool{}
+	for _, friend := range users {
+		seen[friend.ID.String()] = true
+	}
+	partnerIDs := []uuid.UUID{}
+	for _, partnerID := range chatManager.GetChatPartnerIDs(db, *user) {
+		if !seen[partnerID.String()] {
+			seen[partnerID.String()] = true
+			partnerIDs = append(partnerIDs, partnerID)
+		}
+	}
+	if len(partnerIDs) > 0 {
+		// Partners blocked either way are left out
+		partners := []models.User{}
+		blockManager.ExcludeBlocked(db, db.Preload("AvatarObj").Where("users.id IN ?", partnerIDs), *user, "users.id").Find(&partners)
+		users = append(users, partners...)
+	}
+
+	data := []schemas.UserPresenceSchema{}
+	for _, presenceUser := range users {
+		data = append(data, schemas.UserPresenceSchema{
+			User:           models.UserDataSchema{}.Init(presenceUser),
+			PresenceSchema: endpoint.Presence.Get(presenceUser.ID.String()),
+		})
+	}
+	response := schemas.PresenceResponseSchema{
+		ResponseSchema: SuccessResponse("Presence fetched"),
+		Data:           data,
+	}
+	return c.Status(200).JSON(response)
+}
+
 // @Summary Retrieve Friend Requests
 // @Description This endpoint retrieves friend requests of a user
 // @Tags Profiles
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.ProfilesResponseSchema
 // @Router /profiles/friends/requests [get]
 // @Security BearerAuth
@@ -222,14 +401,13 @@ func (endpoint Endpoint) RetrieveFriendRequests(c *fiber.Ctx) error {
 	db := endpoint.DB
 	user := RequestUser(c)
 
-	friendsRequests := friendManager.GetFriendRequests(db, user)
-
-	// Paginate, Convert type and return Friends Requests
-	paginatedData, paginatedFriendRequests, err := PaginateQueryset(friendsRequests, c, 20)
+	// Paginate and return Friends Requests
+	friendsRequests := []models.User{}
+	paginator := Pagination{Table: "users", DefaultPerPage: 20, MaxPerPage: 100}
+	paginatedData, err := paginator.Paginate(c, friendManager.GetFriendRequestsQueryset(db, user), &friendsRequests, preloadAssociations)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	friendsRequests = paginatedFriendRequests.([]models.User)
 	response := schemas.ProfilesResponseSchema{
 		ResponseSchema: SuccessResponse("Friend Requests fetched"),
 		Data: schemas.ProfilesResponseDataSchema{
@@ -262,6 +440,9 @@ func (endpoint Endpoint) SendOrDeleteFriendRequest(c *fiber.Ctx) error {
 	if errData != nil {
 		return c.Status(404).JSON(errData)
 	}
+	if blockManager.IsBlocked(db, *user, requestee.ID) {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You cannot send a friend request to this user"))
+	}
 	message := "Friend Request sent"
 	statusCode := 201
 	if friend.ID != nil {
@@ -327,12 +508,409 @@ func (endpoint Endpoint) AcceptOrRejectFriendRequest(c *fiber.Ctx) error {
 	return c.Status(200).JSON(SuccessResponse(fmt.Sprintf("Friend Request %s", message)))
 }
 
+var followManager = managers.FollowManager{}
+
+// The user with the username in the path
+func getPathUser(c *fiber.Ctx, db *gorm.DB) (*models.User, *utils.ErrorResponse) {
+	user := models.User{}
+	db.Take(&user, models.User{Username: c.Params("username")})
+	if user.ID == nil {
+		errData := utils.RequestErr(utils.ERR_NON_EXISTENT, "No user with that username")
+		return nil, &errData
+	}
+	return &user, nil
+}
+
+// @Summary Follow a User
+// @Description `This endpoint follows a user. If the user approves their followers, a follow request is sent instead and the follow is PENDING until they accept it.`
+// @Description `The user is notified either way.`
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Success 201 {object} schemas.ResponseSchema
+// @Failure 403 {object} utils.ErrorResponse
+// @Router /profiles/profile/{username}/follow [post]
+// @Security BearerAuth
+func (endpoint Endpoint) FollowUser(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	followee, errData := getPathUser(c, db)
+	if errData != nil {
+		return c.Status(404).JSON(errData)
+	}
+	if followee.ID.String() == user.ID.String() {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You cannot follow yourself"))
+	}
+	if blockManager.IsBlocked(db, *user, followee.ID) {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You cannot follow this user"))
+	}
+	if follow := followManager.Get(db, user.ID, followee.ID); follow != nil {
+		message := "You already follow this user"
+		if follow.Status == choices.FLPENDING {
+			message = "You already requested to follow this user"
+		}
+		return c.Status(200).JSON(SuccessResponse(message))
+	}
+
+	follow := followManager.Create(db, *user, *followee)
+	message := "User followed"
+	ntype := choices.NFOLLOW
+	if follow.Status == choices.FLPENDING {
+		message = "Follow request sent"
+		ntype = choices.NFOLLOWREQUEST
+	}
+
+	// Create & Send Notification
+	if !blockManager.IsMuted(db, followee.ID, user.ID) {
+		notification := notificationManager.Create(db, user, ntype, []models.User{*followee}, nil, nil, nil, nil)
+		endpoint.Bus.Publish(events.NotificationCreated{Notification: notification, ReceiverIDs: []uuid.UUID{followee.ID}})
+	}
+	return c.Status(201).JSON(SuccessResponse(message))
+}
+
+// @Summary Unfollow a User
+// @Description This endpoint unfollows a user, or cancels a pending follow request
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Success 200 {object} schemas.ResponseSchema
+// @Router /profiles/profile/{username}/follow [delete]
+// @Security BearerAuth
+func (endpoint Endpoint) UnfollowUser(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	followee, errData := getPathUser(c, db)
+	if errData != nil {
+		return c.Status(404).JSON(errData)
+	}
+	follow := followManager.Get(db, user.ID, followee.ID)
+	if follow == nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "You don't follow this user"))
+	}
+	db.Delete(follow)
+
+	// Remove follow notification
+	notification := notificationManager.GetSentTo(db, *user, *followee, choices.NFOLLOW, choices.NFOLLOWREQUEST)
+	if notification != nil {
+		receiverIDs := notificationManager.Delete(db, notification)
+		endpoint.Bus.Publish(events.NotificationDeleted{Notification: *notification, ReceiverIDs: receiverIDs})
+	}
+	return c.Status(200).JSON(SuccessResponse("User unfollowed"))
+}
+
+// Paginates the users of a follow list of the user in the path.
+// The lists of a user who approves their followers are only visible to them and their followers.
+func (endpoint Endpoint) retrieveFollowList(c *fiber.Ctx, getQueryset func(*gorm.DB, models.User) *gorm.DB, message string) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	profileUser, errData := getPathUser(c, db)
+	if errData != nil || blockManager.GetBlock(db, profileUser.ID, user.ID) != nil {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "No user with that username"))
+	}
+	if profileUser.ApproveFollowers && profileUser.ID.String() != user.ID.String() {
+		follow := followManager.Get(db, user.ID, profileUser.ID)
+		if follow == nil || follow.Status != choices.FLACCEPTED {
+			return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "Only this user's followers can see this"))
+		}
+	}
+
+	users := []models.User{}
+	paginator := Pagination{Table: "users", DefaultPerPage: 20, MaxPerPage: 100}
+	query := blockManager.ExcludeBlocked(db, getQueryset(db, *profileUser), *user, "users.id")
+	paginatedData, err := paginator.Paginate(c, query, &users, preloadAssociations)
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	response := schemas.ProfilesResponseSchema{
+		ResponseSchema: SuccessResponse(message),
+		Data: schemas.ProfilesResponseDataSchema{
+			PaginatedResponseDataSchema: *paginatedData,
+			Items:                       users,
+		}.Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Retrieve a User's Followers
+// @Description This endpoint retrieves the followers of a user. If the user approves their followers, only they and their followers can see them.
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
+// @Success 200 {object} schemas.ProfilesResponseSchema
+// @Failure 403 {object} utils.ErrorResponse
+// @Router /profiles/profile/{username}/followers [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveFollowers(c *fiber.Ctx) error {
+	return endpoint.retrieveFollowList(c, followManager.GetFollowersQueryset, "Followers fetched")
+}
+
+// @Summary Retrieve the Users a User Follows
+// @Description This endpoint retrieves the users a user follows. If the user approves their followers, only they and their followers can see them.
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
+// @Success 200 {object} schemas.ProfilesResponseSchema
+// @Failure 403 {object} utils.ErrorResponse
+// @Router /profiles/profile/{username}/following [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveFollowing(c *fiber.Ctx) error {
+	return endpoint.retrieveFollowList(c, followManager.GetFollowingQueryset, "Following fetched")
+}
+
+// @Summary Retrieve Follow Requests
+// @Description This endpoint retrieves the users waiting for the auth user to approve their follow
+// @Tags Profiles
+// @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
+// @Success 200 {object} schemas.ProfilesResponseSchema
+// @Router /profiles/followers/requests [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveFollowRequests(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	// Paginate and return users
+	users := []models.User{}
+	paginator := Pagination{Table: "users", DefaultPerPage: 20, MaxPerPage: 100}
+	paginatedData, err := paginator.Paginate(c, followManager.GetFollowRequestsQueryset(db, *user), &users, preloadAssociations)
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	response := schemas.ProfilesResponseSchema{
+		ResponseSchema: SuccessResponse("Follow requests fetched"),
+		Data: schemas.ProfilesResponseDataSchema{
+			PaginatedResponseDataSchema: *paginatedData,
+			Items:                       users,
+		}.Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Accept Or Reject a Follow Request
+// @Description This endpoint accepts or rejects a user's request to follow the auth user
+// @Tags Profiles
+// @Param follow_request body schemas.AcceptFollowRequestSchema true "Follow Request object"
+// @Success 200 {object} schemas.ResponseSchema
+// @Router /profiles/followers/requests [put]
+// @Security BearerAuth
+func (endpoint Endpoint) AcceptOrRejectFollowRequest(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	data := schemas.AcceptFollowRequestSchema{}
+
+	// Validate request
+	if errCode, errData := ValidateRequest(c, &data); errData != nil {
+		return c.Status(*errCode).JSON(errData)
+	}
+
+	follower := models.User{}
+	db.Take(&follower, models.User{Username: data.Username})
+	var follow *models.Follow
+	if follower.ID != nil {
+		follow = followManager.Get(db, follower.ID, user.ID)
+	}
+	if follow == nil || follow.Status != choices.FLPENDING {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "That user has not requested to follow you"))
+	}
+
+	// Update or delete follow request based on status
+	message := "Accepted"
+	if data.Accepted {
+		follow.Status = choices.FLACCEPTED
+		db.Save(follow)
+		// The request's notification becomes a follow one
+		notification := notificationManager.GetSentTo(db, follower, *user, choices.NFOLLOWREQUEST)
+		if notification != nil {
+			receiverIDs := notificationManager.Delete(db, notification)
+			endpoint.Bus.Publish(events.NotificationDeleted{Notification: *notification, ReceiverIDs: receiverIDs})
+			notification := notificationManager.Create(db, &follower, choices.NFOLLOW, []models.User{*user}, nil, nil, nil, nil)
+			endpoint.Bus.Publish(events.NotificationCreated{Notification: notification, ReceiverIDs: []uuid.UUID{user.ID}})
+		}
+	} else {
+		message = "Rejected"
+		db.Delete(follow)
+		notification := notificationManager.GetSentTo(db, follower, *user, choices.NFOLLOWREQUEST)
+		if notification != nil {
+			receiverIDs := notificationManager.Delete(db, notification)
+			endpoint.Bus.Publish(events.NotificationDeleted{Notification: *notification, ReceiverIDs: receiverIDs})
+		}
+	}
+	return c.Status(200).JSON(SuccessResponse(fmt.Sprintf("Follow Request %s", message)))
+}
+
+var blockManager = managers.BlockManager{}
+
+// @Summary Block a User
+// @Description `This endpoint blocks a user. It ends any friendship, friend request & follow between you.`
+// @Description `The user can't send you friend requests or messages, follow you, react to or comment on your posts, or see your profile & posts. You won't see their content either.`
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Success 201 {object} schemas.ResponseSchema
+// @Failure 403 {object} utils.ErrorResponse
+// @Router /profiles/profile/{username}/block [post]
+// @Security BearerAuth
+func (endpoint Endpoint) BlockUser(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	blocked, errData := getPathUser(c, db)
+	if errData != nil {
+		return c.Status(404).JSON(errData)
+	}
+	if blocked.ID.String() == user.ID.String() {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You cannot block yourself"))
+	}
+	if !blockManager.Block(db, *user, *blocked) {
+		return c.Status(200).JSON(SuccessResponse("You already blocked this user"))
+	}
+	if chat := chatManager.GetDMBetween(db, *user, *blocked); chat.ID != nil {
+		endpoint.endMemberships(chat.ID, *user, *blocked)
+	}
+	return c.Status(201).JSON(SuccessResponse("User blocked"))
+}
+
+// @Summary Unblock a User
+// @Description This endpoint unblocks a user. Friendships & follows ended by the block aren't restored.
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Success 200 {object} schemas.ResponseSchema
+// @Router /profiles/profile/{username}/block [delete]
+// @Security BearerAuth
+func (endpoint Endpoint) UnblockUser(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	blocked, errData := getPathUser(c, db)
+	if errData != nil {
+		return c.Status(404).JSON(errData)
+	}
+	if !blockManager.Unblock(db, *user, *blocked) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "You haven't blocked this user"))
+	}
+	return c.Status(200).JSON(SuccessResponse("User unblocked"))
+}
+
+// @Summary Mute a User
+// @Description This endpoint mutes a user: their posts, comments & replies are hidden from your feeds and you stop getting notifications from them. Nothing else changes and they aren't told.
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Success 201 {object} schemas.ResponseSchema
+// @Failure 403 {object} utils.ErrorResponse
+// @Router /profiles/profile/{username}/mute [post]
+// @Security BearerAuth
+func (endpoint Endpoint) MuteUser(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	muted, errData := getPathUser(c, db)
+	if errData != nil {
+		return c.Status(404).JSON(errData)
+	}
+	if muted.ID.String() == user.ID.String() {
+		return c.Status(403).JSON(utils.RequestErr(utils.ERR_NOT_ALLOWED, "You cannot mute yourself"))
+	}
+	if !blockManager.Mute(db, *user, *muted) {
+		return c.Status(200).JSON(SuccessResponse("You already muted this user"))
+	}
+	return c.Status(201).JSON(SuccessResponse("User muted"))
+}
+
+// @Summary Unmute a User
+// @Description This endpoint unmutes a user
+// @Tags Profiles
+// @Param username path string true "Username of user"
+// @Success 200 {object} schemas.ResponseSchema
+// @Router /profiles/profile/{username}/mute [delete]
+// @Security BearerAuth
+func (endpoint Endpoint) UnmuteUser(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	muted, errData := getPathUser(c, db)
+	if errData != nil {
+		return c.Status(404).JSON(errData)
+	}
+	if !blockManager.Unmute(db, *user, *muted) {
+		return c.Status(404).JSON(utils.RequestErr(utils.ERR_NON_EXISTENT, "You haven't muted this user"))
+	}
+	return c.Status(200).JSON(SuccessResponse("User unmuted"))
+}
+
+// @Summary Retrieve Blocked Users
+// @Description This endpoint retrieves the users blocked by the auth user
+// @Tags Profiles
+// @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
+// @Success 200 {object} schemas.ProfilesResponseSchema
+// @Router /profiles/blocked [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveBlockedUsers(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	// Paginate and return users
+	users := []models.User{}
+	paginator := Pagination{Table: "users", DefaultPerPage: 20, MaxPerPage: 100}
+	paginatedData, err := paginator.Paginate(c, blockManager.GetBlockedQueryset(db, *user), &users, preloadAssociations)
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	response := schemas.ProfilesResponseSchema{
+		ResponseSchema: SuccessResponse("Blocked users fetched"),
+		Data: schemas.ProfilesResponseDataSchema{
+			PaginatedResponseDataSchema: *paginatedData,
+			Items:                       users,
+		}.Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Retrieve Muted Users
+// @Description This endpoint retrieves the users muted by the auth user
+// @Tags Profiles
+// @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 100)" default(20)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
+// @Success 200 {object} schemas.ProfilesResponseSchema
+// @Router /profiles/muted [get]
+// @Security BearerAuth
+func (endpoint Endpoint) RetrieveMutedUsers(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	// Paginate and return users
+	users := []models.User{}
+	paginator := Pagination{Table: "users", DefaultPerPage: 20, MaxPerPage: 100}
+	paginatedData, err := paginator.Paginate(c, blockManager.GetMutedQueryset(db, *user), &users, preloadAssociations)
+	if err != nil {
+		return c.Status(400).JSON(err)
+	}
+	response := schemas.ProfilesResponseSchema{
+		ResponseSchema: SuccessResponse("Muted users fetched"),
+		Data: schemas.ProfilesResponseDataSchema{
+			PaginatedResponseDataSchema: *paginatedData,
+			Items:                       users,
+		}.Init(),
+	}
+	return c.Status(200).JSON(response)
+}
+
 var notificationManager = managers.NotificationManager{}
 
 // @Summary Retrieve User Notifications
-// @Description This endpoint retrieves a paginated list of auth user's notifications. Use post, comment, reply slug to navigate to the post, comment or reply.
+// @Description This endpoint retrieves a paginated list of auth user's notifications, except those from users you blocked, were blocked by or muted. Use post, comment, reply slug to navigate to the post, comment or reply.
 // @Tags Profiles
 // @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page (max 200)" default(50)
+// @Param cursor query string false "Keyset cursor from the previous page's next link, empty for the first page (replaces page)"
 // @Success 200 {object} schemas.NotificationsResponseSchema
 // @Router /profiles/notifications [get]
 // @Security BearerAuth
@@ -340,14 +918,14 @@ func (endpoint Endpoint) RetrieveUserNotifications(c *fiber.Ctx) error {
 	db := endpoint.DB
 	user := RequestUser(c)
 
-	notifications := notificationManager.GetQueryset(db, user.ID)
-
-	// Paginate, Convert type and return notifications
-	paginatedData, paginatedNotifications, err := PaginateQueryset(notifications, c)
+	// Paginate and return notifications
+	notifications := []models.Notification{}
+	paginator := Pagination{Table: "notifications", DefaultPerPage: 50, MaxPerPage: 200}
+	query := blockManager.ExcludeHidden(db, notificationManager.GetQueryset(db, *user), *user, "notifications.sender_id")
+	paginatedData, err := paginator.Paginate(c, query, &notifications, preloadAssociations)
 	if err != nil {
 		return c.Status(400).JSON(err)
 	}
-	notifications = paginatedNotifications.([]models.Notification)
 	response := schemas.NotificationsResponseSchema{
 		ResponseSchema: SuccessResponse("Notifications fetched"),
 		Data: schemas.NotificationsResponseDataSchema{
@@ -1,29 +1,58 @@
 package routes
 
 import (
+	"log"
+
+	"github.com/acatalepsy17/pigeon/config"
+	"github.com/acatalepsy17/pigeon/events"
+	"github.com/acatalepsy17/pigeon/fanout"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
 
 type Endpoint struct {
-	DB *gorm.DB
+	DB       *gorm.DB
+	Hub      *Hub
+	Presence *PresenceTracker
+	Bus      *events.Bus
+	Oidc     *OidcProvider // nil when social login is disabled
 }
 
 func SetupRoutes(app *fiber.App, db *gorm.DB) {
-	endpoint := Endpoint{DB: db}
+	backend, err := fanout.New(config.GetConfig(), db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	endpoint := Endpoint{DB: db, Hub: NewHub(backend), Presence: NewPresenceTracker(backend), Bus: events.NewBus(), Oidc: NewOidcProvider(config.GetConfig())}
+	endpoint.Bus.Subscribe(SocketEventHandler(endpoint.Hub))
+
+	// public signing keys for other services
+	app.Get("/.well-known/jwks.json", endpoint.RetrieveJWKS)
+
 	api := app.Group("/api/v1")
 
 	// authentication
 	authRouter := api.Group("/auth")
 	authRouter.Post("/sign_up", endpoint.SignUp)
 	authRouter.Post("/sign_in", endpoint.SignIn)
-	authRouter.Get("/sign_out", endpoint.SignOut)
+	authRouter.Post("/sign_in/mfa", endpoint.SignInMfa)
+	authRouter.Get("/oidc/authorize", endpoint.OidcAuthorize)
+	authRouter.Post("/oidc/callback", endpoint.OidcCallback)
+	authRouter.Get("/sign_out", endpoint.AuthMiddleware, endpoint.SignOut)
 	authRouter.Post("/verify_email", endpoint.VerifyEmail)
 	authRouter.Post("/resend_verification_email", endpoint.ResendVerificationEmail)
 	authRouter.Post("/send_password_reset_otp", endpoint.SendPasswordResetOtp)
 	authRouter.Post("/set_new_password", endpoint.SetNewPassword)
+	authRouter.Post("/change_password", endpoint.AuthMiddleware, endpoint.ChangePassword)
 	authRouter.Post("/refresh_token", endpoint.RefreshToken)
+	authRouter.Post("/cancel_email_change", endpoint.CancelEmailChange)
+	authRouter.Get("/sessions", endpoint.AuthMiddleware, endpoint.RetrieveSessions)
+	authRouter.Delete("/sessions", endpoint.AuthMiddleware, endpoint.RevokeAllSessions)
+	authRouter.Delete("/sessions/:id", endpoint.AuthMiddleware, endpoint.RevokeSession)
+	authRouter.Post("/mfa/totp", endpoint.AuthMiddleware, endpoint.EnrollTotp)
+	authRouter.Post("/mfa/totp/confirm", endpoint.AuthMiddleware, endpoint.ConfirmTotp)
+	authRouter.Post("/mfa/totp/disable", endpoint.AuthMiddleware, endpoint.DisableTotp)
 
 	// user profile
 	profilesRouter := api.Group("/profiles", endpoint.AuthMiddleware)
@@ -32,16 +61,32 @@ func SetupRoutes(app *fiber.App, db *gorm.DB) {
 	profilesRouter.Get("/profile/:username", endpoint.RetrieveUserProfile)
 	profilesRouter.Patch("/profile", endpoint.UpdateProfile)
 	profilesRouter.Post("/profile", endpoint.DeleteUser)
+	profilesRouter.Post("/profile/email", endpoint.RequestEmailChange)
+	profilesRouter.Post("/profile/email/confirm", endpoint.ConfirmEmailChange)
 	profilesRouter.Get("/friends", endpoint.RetrieveFriends)
+	profilesRouter.Get("/presence", endpoint.RetrievePresence)
 	profilesRouter.Get("/friends/requests", endpoint.RetrieveFriendRequests)
 	profilesRouter.Post("/friends/requests", endpoint.SendOrDeleteFriendRequest)
 	profilesRouter.Put("/friends/requests", endpoint.AcceptOrRejectFriendRequest)
+	profilesRouter.Post("/profile/:username/follow", endpoint.FollowUser)
+	profilesRouter.Delete("/profile/:username/follow", endpoint.UnfollowUser)
+	profilesRouter.Get("/profile/:username/followers", endpoint.RetrieveFollowers)
+	profilesRouter.Get("/profile/:username/following", endpoint.RetrieveFollowing)
+	profilesRouter.Get("/followers/requests", endpoint.RetrieveFollowRequests)
+	profilesRouter.Put("/followers/requests", endpoint.AcceptOrRejectFollowRequest)
+	profilesRouter.Post("/profile/:username/block", endpoint.BlockUser)
+	profilesRouter.Delete("/profile/:username/block", endpoint.UnblockUser)
+	profilesRouter.Post("/profile/:username/mute", endpoint.MuteUser)
+	profilesRouter.Delete("/profile/:username/mute", endpoint.UnmuteUser)
+	profilesRouter.Get("/blocked", endpoint.RetrieveBlockedUsers)
+	profilesRouter.Get("/muted", endpoint.RetrieveMutedUsers)
 	profilesRouter.Get("/notifications", endpoint.RetrieveUserNotifications)
 	profilesRouter.Post("/notifications", endpoint.ReadNotification)
 
 	// newsfeed
 	feedRouter := api.Group("/feed", endpoint.AuthMiddleware)
 	feedRouter.Get("/posts", endpoint.RetrievePosts)
+	feedRouter.Get("/home", endpoint.RetrieveHomeFeed)
 	feedRouter.Post("/posts", endpoint.CreatePost)
 	feedRouter.Get("/posts/:slug", endpoint.RetrievePost)
 	feedRouter.Put("/posts/:slug", endpoint.UpdatePost)
@@ -59,15 +104,31 @@ func SetupRoutes(app *fiber.App, db *gorm.DB) {
 	feedRouter.Put("/replies/:slug", endpoint.UpdateReply)
 	feedRouter.Delete("/replies/:slug", endpoint.DeleteReply)
 
+	// search
+	api.Get("/search", endpoint.AuthMiddleware, endpoint.Search)
+
 	// communication
 	chatRouter := api.Group("/chats", endpoint.AuthMiddleware)
 	chatRouter.Get("", endpoint.RetrieveUserChats)
 	chatRouter.Post("", endpoint.SendMessage)
 	chatRouter.Get("/:chat_id", endpoint.RetrieveMessages)
 	chatRouter.Patch("/:chat_id", endpoint.UpdateGroupChat)
+	chatRouter.Post("/:chat_id/read", endpoint.ReadChat)
+	chatRouter.Get("/:chat_id/messages/:message_id/thread", endpoint.RetrieveMessageThread)
 	chatRouter.Delete("/:chat_id", endpoint.DeleteGroupChat)
+	chatRouter.Put("/:chat_id/members/:username/role", endpoint.UpdateGroupMemberRole)
+	chatRouter.Post("/:chat_id/leave", endpoint.LeaveGroupChat)
+	chatRouter.Post("/:chat_id/transfer", endpoint.TransferGroupOwnership)
+	chatRouter.Post("/invites/:token/join", endpoint.JoinGroupByInvite)
+	chatRouter.Post("/:chat_id/invites", endpoint.CreateGroupInvite)
+	chatRouter.Get("/:chat_id/invites", endpoint.RetrieveGroupInvites)
+	chatRouter.Delete("/:chat_id/invites/:invite_id", endpoint.RevokeGroupInvite)
+	chatRouter.Get("/:chat_id/requests", endpoint.RetrieveGroupJoinRequests)
+	chatRouter.Post("/:chat_id/requests/:request_id", endpoint.HandleGroupJoinRequest)
 	chatRouter.Put("/messages/:message_id", endpoint.UpdateMessage)
 	chatRouter.Delete("/messages/:message_id", endpoint.DeleteMessage)
+	chatRouter.Put("/messages/:message_id/reactions", endpoint.ReactToMessage)
+	chatRouter.Delete("/messages/:message_id/reactions", endpoint.RemoveMessageReaction)
 	chatRouter.Post("/groups/group", endpoint.CreateGroupChat)
 
 	// websocket
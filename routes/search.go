@@ -0,0 +1,171 @@
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/acatalepsy17/pigeon/managers"
+	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/schemas"
+	"github.com/acatalepsy17/pigeon/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pborman/uuid"
+)
+
+var searchManager = managers.SearchManager{}
+
+// @Summary Search
+// @Description `This endpoint searches posts, comments, replies, users and the messages of the current user's chats.`
+// @Description
+// @Description `q supports quoted phrases, OR and -word to exclude a word. Results are ordered by relevance, with the matching text highlighted in their snippet (<mark> tags).`
+// @Description
+// @Description `Set type to one or more (comma separated) of posts, comments, replies, users & messages to only search those. Each type has its own page of results, and further pages can only be fetched for a single type.`
+// @Description
+// @Description `Content of users you blocked or were blocked by is left out, and so are posts, comments & replies of users you muted and posts you aren't in the audience of (with their comments & replies).`
+// @Tags Search
+// @Param q query string true "Search text"
+// @Param type query string false "Types to search, comma separated (all if not set)"
+// @Param page query int false "Current Page" default(1)
+// @Param per_page query int false "Items per page of each type (max 50)" default(20)
+// @Success 200 {object} schemas.SearchResponseSchema
+// @Router /search [get]
+// @Security BearerAuth
+func (endpoint Endpoint) Search(c *fiber.Ctx) error {
+	db := endpoint.DB
+	user := RequestUser(c)
+
+	search := strings.TrimSpace(c.Query("q"))
+	if search == "" {
+		return c.Status(400).JSON(utils.RequestErr(utils.ERR_INVALID_VALUE, "Enter something to search for"))
+	}
+	searchTypes := managers.SearchTypes
+	if typeParam := c.Query("type"); typeParam != "" {
+		searchTypes = strings.Split(typeParam, ",")
+		for _, searchType := range searchTypes {
+			if !slices.Contains(managers.SearchTypes, searchType) {
+				return c.Status(400).JSON(utils.RequestErr(utils.ERR_INVALID_VALUE, fmt.Sprintf("Invalid type: %s. Use any of: %s", searchType, strings.Join(managers.SearchTypes, ", "))))
+			}
+		}
+	}
+	if len(searchTypes) > 1 && c.QueryInt("page", 1) != 1 {
+		return c.Status(400).JSON(utils.RequestErr(utils.ERR_INVALID_PAGE, "Search a single type to get more pages"))
+	}
+
+	results := schemas.SearchResultsSchema{}
+	for _, searchType := range searchTypes {
+		paginator := Pagination{Table: searchType, OrderBy: managers.SearchRankOrder(searchType), DefaultPerPage: 20, MaxPerPage: 50}
+		var paginatedData *schemas.PaginatedResponseDataSchema
+		var err *utils.ErrorResponse
+		ids := []uuid.UUID{}
+		switch searchType {
+		case managers.SearchPosts:
+			posts := []models.Post{}
+			if paginatedData, err = paginator.Paginate(c, searchManager.Posts(db, search, *user), &posts, managers.PostCountsPreloadScope); err != nil {
+				break
+			}
+			for _, post := range posts {
+				ids = append(ids, post.ID)
+			}
+			snippets := searchManager.GetSnippets(db, searchType, search, ids)
+			for i := range posts {
+				posts[i].Snippet = getSnippet(snippets, posts[i].ID)
+			}
+			data := schemas.PostsResponseDataSchema{PaginatedResponseDataSchema: *paginatedData, Items: posts}.Init()
+			results.Posts = &data
+		case managers.SearchComments:
+			comments := []models.Comment{}
+			if paginatedData, err = paginator.Paginate(c, searchManager.Comments(db, search, *user), &comments, managers.CommentCountsPreloadScope); err != nil {
+				break
+			}
+			for _, comment := range comments {
+				ids = append(ids, comment.ID)
+			}
+			snippets := searchManager.GetSnippets(db, searchType, search, ids)
+			for i := range comments {
+				comments[i].Snippet = getSnippet(snippets, comments[i].ID)
+			}
+			data := schemas.CommentsResponseDataSchema{PaginatedResponseDataSchema: *paginatedData, Items: comments}.Init()
+			results.Comments = &data
+		case managers.SearchReplies:
+			replies := []models.Reply{}
+			if paginatedData, err = paginator.Paginate(c, searchManager.Replies(db, search, *user), &replies, managers.ReactionsPreloadScope); err != nil {
+				break
+			}
+			for _, reply := range replies {
+				ids = append(ids, reply.ID)
+			}
+			snippets := searchManager.GetSnippets(db, searchType, search, ids)
+			for i := range replies {
+				replies[i].Snippet = getSnippet(snippets, replies[i].ID)
+			}
+			data := schemas.CommentWithRepliesResponseDataSchema{PaginatedResponseDataSchema: *paginatedData, Items: replies}.Init()
+			results.Replies = &data
+		case managers.SearchUsers:
+			users := []models.User{}
+			if paginatedData, err = paginator.Paginate(c, searchManager.Users(db, search, *user), &users); err != nil {
+				break
+			}
+			for _, foundUser := range users {
+				ids = append(ids, foundUser.ID)
+			}
+			snippets := searchManager.GetSnippets(db, searchType, search, ids)
+			for i := range users {
+				users[i].Snippet = getSnippet(snippets, users[i].ID)
+			}
+			data := schemas.ProfilesResponseDataSchema{PaginatedResponseDataSchema: *paginatedData, Items: users}.Init()
+			results.Users = &data
+		case managers.SearchMessages:
+			messages := []models.Message{}
+			if paginatedData, err = paginator.Paginate(c, searchManager.Messages(db, search, *user), &messages); err != nil {
+				break
+			}
+			for _, message := range messages {
+				ids = append(ids, message.ID)
+			}
+			snippets := searchManager.GetSnippets(db, searchType, search, ids)
+			for i := range messages {
+				messages[i].Snippet = getSnippet(snippets, messages[i].ID)
+			}
+			data := schemas.SearchMessagesResponseDataSchema{PaginatedResponseDataSchema: *paginatedData, Items: messages}.Init()
+			results.Messages = &data
+		}
+		if err != nil {
+			return c.Status(400).JSON(err)
+		}
+		if len(searchTypes) > 1 {
+			// Link to the type's next page on its own
+			paginatedData.Next = linkWithParam(paginatedData.Next, "type", searchType)
+		}
+	}
+	response := schemas.SearchResponseSchema{
+		ResponseSchema: SuccessResponse("Search results fetched"),
+		Data:           results,
+	}
+	return c.Status(200).JSON(response)
+}
+
+func getSnippet(snippets map[string]string, id uuid.UUID) *string {
+	snippet, ok := snippets[id.String()]
+	if !ok {
+		return nil
+	}
+	return &snippet
+}
+
+// The link with a query param replaced
+func linkWithParam(link *string, param string, value string) *string {
+	if link == nil {
+		return nil
+	}
+	parsedLink, err := url.Parse(*link)
+	if err != nil {
+		return link
+	}
+	params := parsedLink.Query()
+	params.Set(param, value)
+	parsedLink.RawQuery = params.Encode()
+	newLink := parsedLink.String()
+	return &newLink
+}
@@ -2,10 +2,10 @@ package routes
 
 import (
 	"encoding/json"
-	"log"
 
-	"github.com/acatalepsy17/pigeon/database"
 	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/models/choices"
+	"github.com/acatalepsy17/pigeon/schemas"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/pborman/uuid"
@@ -13,221 +13,200 @@ import (
 )
 
 // Entry & Exit Schemas
+
+// Deprecated: clients used to announce a message they created or updated through the REST API,
+// which was then relayed to the chat. Messages are now pushed as they happen, so these are
+// still validated for older clients but no longer relayed. Use events with a "type" instead.
 type SocketMessageEntrySchema struct {
-	Status string    `json:"status" validate:"required,oneof=CREATED UPDATED DELETED"`
+	Status string    `json:"status" validate:"required,oneof=CREATED UPDATED"`
 	ID     uuid.UUID `json:"id" validate:"required"`
 }
 
+type SocketEventEntrySchema struct {
+	Type      string     `json:"type" validate:"required,oneof=typing_started typing_stopped presence read"`
+	Status    string     `json:"status" validate:"required_if=Type presence,omitempty,oneof=online away offline"`
+	MessageID *uuid.UUID `json:"message_id" validate:"required_if=Type read"` // the chat is marked read up to this message
+}
+
+type SocketTypingSchema struct {
+	Type   string                `json:"type"`
+	ChatID string                `json:"chat_id"`
+	User   models.UserDataSchema `json:"user"`
+}
+
+type SocketPresenceSchema struct {
+	Type string                `json:"type"`
+	User models.UserDataSchema `json:"user"`
+	schemas.PresenceSchema
+}
+
+type SocketReadSchema struct {
+	Type string `json:"type"`
+	models.ChatReadCursor
+}
+
+type SocketReactionSchema struct {
+	Type      string                           `json:"type"` // reaction_added (also when changed) or reaction_removed
+	ChatID    uuid.UUID                        `json:"chat_id"`
+	MessageID uuid.UUID                        `json:"message_id"`
+	User      models.UserDataSchema            `json:"user"`
+	Rtype     choices.ReactionChoice           `json:"rtype"`
+	Reactions map[choices.ReactionChoice]int64 `json:"reactions"` // the message's counts after the change
+}
+
 type SocketMessageExitSchema struct {
 	models.Message
 	Status string `json:"status"`
 }
 
+type SocketMessageDeletedSchema struct {
+	ID     uuid.UUID `json:"id"`
+	ChatID uuid.UUID `json:"chat_id"`
+	Status string    `json:"status"`
+}
+
 // ---------------------------
 
-var (
-	messageData = SocketMessageEntrySchema{}
-)
+// Resolve the room of a chat socket.
+// The id is a chat ID, or the user's own username/ID to receive messages from all their chats.
+func ResolveChatRoom(db *gorm.DB, user *models.User, id string) (string, *int, *string, *string) {
+	if user.ID.String() == id || user.Username == id {
+		return UserRoom(user.ID.String()), nil, nil, nil
+	}
 
-// Retrieve chat or user based on the given id
-func GetChatOrUser(c *websocket.Conn, db *gorm.DB, user models.User, id string) (models.Chat, *models.User) {
+	parsedID, _ := utils.ParseUUID(id)
 	chat := models.Chat{}
-	var objUser *models.User = nil
-
-	if user.ID.String() != id {
-		parsedID, _ := utils.ParseUUID(id)
-		if parsedID == nil {
-			db.Where(models.User{Username: id}).Take(&objUser, objUser)
-		} else {
-			chat = chatManager.GetByID(db, *parsedID)
-		}
-	} else {
-		objUser = &user // Message is sent to self
+	if parsedID != nil {
+		chat = chatManager.GetByID(db, *parsedID)
 	}
-	c.Locals("objUser", objUser)
-	return chat, objUser
-}
-
-// --------------------------------------------
-
-// Validate chat existence or membership
-func ValidateChatMembership(c *websocket.Conn, db *gorm.DB, user models.User, id string) (*int, *string, *string) {
-	chat, objUser := GetChatOrUser(c, db, user, id)
-
-	if chat.ID == nil && objUser.ID == nil {
-		// If no chat nor user
+	if chat.ID == nil || blockManager.IsBlockedDM(db, *user, chat) {
 		errCode := 4004
 		errType := "invalid_input"
 		errMsg := "Invalid ID"
-		return &errCode, &errType, &errMsg
+		return "", &errCode, &errType, &errMsg
 	}
-	if chat.ID != nil && user.ID.String() != chat.OwnerID.String() && !chatManager.UserIsMember(chat, user) {
+	if user.ID.String() != chat.OwnerID.String() && !chatManager.UserIsMember(chat, *user) {
 		errCode := 4001
 		errType := "invalid_member"
 		errMsg := "You're not a member of this chat"
-		return &errCode, &errType, &errMsg
-	}
-	return nil, nil, nil
-}
-
-// ----------------------------------------------------
-
-// Store new connection client
-func AddChatClient(c *websocket.Conn, db *gorm.DB, id string) (*int, *string, *string) {
-	// Validate chat ID & membership
-	user := c.Locals("user").(*models.User)
-	secret := c.Locals("secret").(*string)
-
-	if secret == nil {
-		// validate chat memership
-		errCode, errType, errMsg := ValidateChatMembership(c, db, *user, id)
-		if errCode != nil && errType != nil && errMsg != nil {
-			return errCode, errType, errMsg
-		}
-	}
-
-	// Add client
-	AddClient(c)
-	return nil, nil, nil
-}
-
-// ------------------------------------------
-
-// Validate data entering the socket.
-func ValidateEnteredData(c *websocket.Conn, db *gorm.DB, user *models.User, secret *string, data []byte) (*[]byte, *int, *string, *string, *map[string]string) {
-	// Ensure data is a Message data. That means it aligns with the Message schema above
-	err := json.Unmarshal(data, &messageData)
-	if err != nil {
-		errCode := 4220
-		errType := utils.ERR_INVALID_ENTRY
-		errMsg := "Invalid Json data"
-		return nil, &errCode, &errType, &errMsg, nil
-	} else if err := validator.Validate(messageData); err != nil {
-		errCode := 4220
-		errType := err.Code
-		errMsg := "Invalid Message data"
-		errData := err.Data
-		return nil, &errCode, &errType, &errMsg, errData
-	}
-	status := messageData.Status
-	if status == "DELETED" && secret == nil {
-		// Only allowed for secret users (in app)
-		errCode := 4001
-		errType := utils.ERR_UNAUTHORIZED_USER
-		errMsg := "Not allowed to send deletion socket message"
-		return nil, &errCode, &errType, &errMsg, nil
-	}
-	messageDataToReturn := data
-	if status != "DELETED" {
-		message := messageManager.GetByID(db, messageData.ID)
-		if message.ID == nil {
-			errCode := 4004
-			errType := utils.ERR_NON_EXISTENT
-			errMsg := "Invalid message ID"
-			return nil, &errCode, &errType, &errMsg, nil
-		} else if message.SenderID.String() != user.ID.String() {
-			errCode := 4001
-			errType := utils.ERR_INVALID_OWNER
-			errMsg := "Message isn't yours"
-			return nil, &errCode, &errType, &errMsg, nil
-		}
-		messageData := SocketMessageExitSchema{
-			Message: message.Init(),
-			Status:  messageData.Status,
-		}
-		messageDataJson, _ := json.Marshal(messageData)
-		messageDataToReturn = []byte(messageDataJson)
-	}
-	return &messageDataToReturn, nil, nil, nil, nil
-}
-
-// --------------------------------------------
-
-// Broadcast chat messages to connected clients
-func broadcastChatMessage(_ *websocket.Conn, mt int, groupName string, data []byte) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
-
-	for client := range clients {
-		secret := client.Locals("secret").(*string)
-
-		// Only true receivers should access the data
-		if client.Locals("groupName") == groupName && secret == nil {
-			user := client.Locals("user").(*models.User)
-			objUser := client.Locals("objUser").(*models.User)
-			if objUser != nil {
-				// Ensure that reading messages from a user id can only be done by the owner
-				if user.ID.String() == objUser.ID.String() {
-					if err := client.WriteMessage(mt, data); err != nil {
-						log.Println("write:", err)
-					}
-				}
-			} else {
-				if err := client.WriteMessage(mt, data); err != nil {
-					log.Println("write:", err)
-				}
-			}
-		}
+		return "", &errCode, &errType, &errMsg
 	}
+	return ChatRoom(chat.ID.String()), nil, nil, nil
 }
 
 // --------------------------------------------
 
-// Chat socket endpoint
+// Chat socket endpoint. Messages are sent through the REST endpoints and pushed here as they happen.
+// Clients can send typing & presence events, which are relayed to the other members without being stored,
+// and mark the chat read up to a message.
 func (ep Endpoint) ChatSocket(c *websocket.Conn) {
-	db := database.ConnectDb(cfg, true)
-	sqlDB, _ := db.DB()
-	defer sqlDB.Close()
+	db := ep.DB
 	token := c.Headers("Authorization")
 	chatID := c.Params("id")
 
-	var (
-		mt        int
-		entryData []byte
-		exitData  *[]byte
-		err       error
-		user      *models.User
-		secret    *string
-		errC      *int               // error code
-		errT      *string            // error type
-		errM      *string            // error message
-		errD      *map[string]string // error data
-	)
-
 	// Validate Auth
-	if user, secret, errM = ValidateAuth(db, token); errM != nil {
+	user, errM := ValidateAuth(db, token)
+	if errM != nil {
 		ReturnError(c, utils.ERR_INVALID_TOKEN, *errM, 4001)
 		return
 	}
-	c.Locals("user", user)
-	c.Locals("secret", secret)
-	// Set Group name
-	groupName := "chat_" + chatID
-	c.Locals("groupName", groupName)
-
-	// Add the client to the list of connected clients
-	errC, errT, errM = AddChatClient(c, db, chatID)
-	if errC != nil || errT != nil || errM != nil {
+
+	// Validate chat ID & membership
+	room, errC, errT, errM := ResolveChatRoom(db, user, chatID)
+	if errC != nil {
 		ReturnError(c, *errT, *errM, *errC)
 		return
 	}
-	// Remove the client from the list when the handler exits
-	defer RemoveClient(c)
-
-	for {
-		if mt, entryData, err = c.ReadMessage(); err != nil {
-			ReturnError(c, utils.ERR_INVALID_ENTRY, "Invalid Entry", 4220)
-			break
+	inChat := room != UserRoom(user.ID.String())
+	userID := user.ID.String()
+	userData := models.UserDataSchema{}.Init(*user)
+
+	client := NewSocketClient(c, user)
+	ep.Hub.Join(client, room)
+	defer ep.Hub.Leave(client, room)
+
+	sendPresence := func(presence schemas.PresenceSchema) {
+		if inChat {
+			data, _ := json.Marshal(SocketPresenceSchema{Type: "presence", User: userData, PresenceSchema: presence})
+			ep.Hub.Broadcast(room, data, userID)
 		}
+	}
+	typing := false
+	sendTyping := func(eventType string) {
+		typing = eventType == "typing_started"
+		data, _ := json.Marshal(SocketTypingSchema{Type: eventType, ChatID: chatID, User: userData})
+		ep.Hub.Broadcast(room, data, userID)
+	}
 
-		// Validate received data
-		exitData, errC, errT, errM, errD = ValidateEnteredData(c, db, user, secret, entryData)
-		if errC != nil {
-			ReturnError(c, *errT, *errM, *errC, errD)
-			break
+	sendPresence(ep.Presence.Connect(client))
+	defer func() {
+		if typing {
+			sendTyping("typing_stopped")
+		}
+		sendPresence(ep.Presence.Disconnect(client))
+	}()
+
+	limiter := socketRateLimiter{}
+	client.Run(func(_ int, data []byte) bool {
+		if !limiter.Allow() {
+			client.Send(SocketError(utils.ERR_TOO_MANY_ATTEMPTS, "Too many events, slow down", 4029))
+			return true
+		}
+		if isLegacyMessageEntry(data) {
+			if errData := validateLegacyMessageEntry(db, user, room, data); errData != nil {
+				client.Send(errData)
+			}
+			return true
+		}
+		event := SocketEventEntrySchema{}
+		if errData := ValidateSocketEvent(data, &event); errData != nil {
+			client.Send(errData)
+			return true
 		}
-		broadcastChatMessage(c, mt, groupName, *exitData)
+		switch event.Type {
+		case "typing_started", "typing_stopped":
+			if !inChat {
+				client.Send(SocketError(utils.ERR_INVALID_ENTRY, "Typing events are sent on a chat's socket", 4220))
+				return true
+			}
+			sendTyping(event.Type)
+		case "presence":
+			sendPresence(ep.Presence.Set(client, event.Status))
+		case "read":
+			message := messageManager.GetByID(db, *event.MessageID)
+			if message.ID == nil || ChatRoom(message.ChatID.String()) != room {
+				client.Send(SocketError(utils.ERR_NON_EXISTENT, "This chat has no message with that ID", 4004))
+				return true
+			}
+			ep.MarkChatRead(*user, message)
+		}
+		return true
+	})
+}
+
+// Whether the data is the deprecated message entry (a status without a type)
+func isLegacyMessageEntry(data []byte) bool {
+	entry := struct {
+		Type   *string `json:"type"`
+		Status *string `json:"status"`
+	}{}
+	return json.Unmarshal(data, &entry) == nil && entry.Type == nil && entry.Status != nil
+}
+
+// Same checks the message entry always had. Nothing is relayed as the message was pushed when it was sent.
+func validateLegacyMessageEntry(db *gorm.DB, user *models.User, room string, data []byte) []byte {
+	entry := SocketMessageEntrySchema{}
+	if errData := ValidateSocketEvent(data, &entry); errData != nil {
+		return errData
+	}
+	message := messageManager.GetByID(db, entry.ID)
+	if message.ID == nil || (room != UserRoom(user.ID.String()) && ChatRoom(message.ChatID.String()) != room) {
+		return SocketError(utils.ERR_NON_EXISTENT, "Invalid message ID", 4004)
+	}
+	if message.SenderID == nil || message.SenderID.String() != user.ID.String() {
+		return SocketError(utils.ERR_INVALID_OWNER, "Message isn't yours", 4001)
 	}
+	return nil
 }
 
 // --------------------------------------------
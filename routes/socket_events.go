@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"encoding/json"
+
+	"github.com/acatalepsy17/pigeon/events"
+	"github.com/acatalepsy17/pigeon/models"
+	"github.com/pborman/uuid"
+)
+
+// Pushes app events to the websocket rooms interested in them
+func SocketEventHandler(hub *Hub) events.Handler {
+	return func(event events.Event) {
+		switch e := event.(type) {
+		case events.NotificationCreated:
+			data, _ := json.Marshal(SocketNotificationSchema{Notification: e.Notification.Init(nil), Status: "CREATED"})
+			hub.BroadcastRooms(userRooms(NotificationsRoom, e.ReceiverIDs), data)
+
+		case events.NotificationDeleted:
+			notification := models.Notification{
+				BaseModel:   models.BaseModel{ID: e.Notification.ID},
+				Ntype:       e.Notification.Ntype,
+				CommentSlug: e.CommentSlug,
+				ReplySlug:   e.ReplySlug,
+			}
+			data, _ := json.Marshal(SocketNotificationSchema{Notification: notification, Status: "DELETED"})
+			hub.BroadcastRooms(userRooms(NotificationsRoom, e.ReceiverIDs), data)
+
+		case events.MessageCreated:
+			data, _ := json.Marshal(SocketMessageExitSchema{Message: e.Message.Init(), Status: "CREATED"})
+			hub.BroadcastRooms(append(userRooms(UserRoom, e.MemberIDs), ChatRoom(e.Message.ChatID.String())), data)
+
+		case events.MessageUpdated:
+			data, _ := json.Marshal(SocketMessageExitSchema{Message: e.Message.Init(), Status: "UPDATED"})
+			hub.BroadcastRooms(append(userRooms(UserRoom, e.MemberIDs), ChatRoom(e.Message.ChatID.String())), data)
+
+		case events.MessageReactionUpdated:
+			reaction := SocketReactionSchema{
+				Type:      "reaction_added",
+				ChatID:    e.Message.ChatID,
+				MessageID: e.Message.ID,
+				User:      models.UserDataSchema{}.Init(e.User),
+				Rtype:     e.Rtype,
+				Reactions: e.Message.Reactions,
+			}
+			if e.Removed {
+				reaction.Type = "reaction_removed"
+			}
+			data, _ := json.Marshal(reaction)
+			hub.Broadcast(ChatRoom(e.Message.ChatID.String()), data)
+
+		case events.ChatRead:
+			data, _ := json.Marshal(SocketReadSchema{Type: "read", ChatReadCursor: e.Cursor.Init()})
+			hub.BroadcastRooms(append(userRooms(UserRoom, e.MemberIDs), ChatRoom(e.Cursor.ChatID.String())), data)
+
+		case events.ChatMembershipEnded:
+			userIDs := []string{}
+			for _, userID := range e.UserIDs {
+				userIDs = append(userIDs, userID.String())
+			}
+			hub.Evict(ChatRoom(e.ChatID.String()), userIDs...)
+
+		case events.MessageDeleted:
+			data, _ := json.Marshal(SocketMessageDeletedSchema{ID: e.MessageID, ChatID: e.ChatID, Status: "DELETED"})
+			hub.BroadcastRooms(append(userRooms(UserRoom, e.MemberIDs), ChatRoom(e.ChatID.String())), data)
+		}
+	}
+}
+
+// The given room of each user
+func userRooms(room func(string) string, userIDs []uuid.UUID) []string {
+	rooms := make([]string, 0, len(userIDs)+1)
+	for _, userID := range userIDs {
+		rooms = append(rooms, room(userID.String()))
+	}
+	return rooms
+}
@@ -0,0 +1,250 @@
+package routes
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/fanout"
+	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/utils"
+	"github.com/gofiber/contrib/websocket"
+)
+
+const (
+	socketWriteWait      = 10 * time.Second // time allowed to write a message to the peer
+	socketPongWait       = 60 * time.Second // connections without any message or pong for this long are closed
+	socketPingPeriod     = socketPongWait * 9 / 10
+	socketMaxMessageSize = 4096 // bytes accepted from a client per message
+	socketSendBufferSize = 256  // queued messages before a client counts as a slow consumer
+)
+
+// Room names. Chat members listen in their chat's room, or in their own user room
+// to receive new messages from all their chats. Notifications go to the receiver's room.
+func ChatRoom(chatID string) string {
+	return "chat_" + chatID
+}
+
+func UserRoom(userID string) string {
+	return "user_" + userID
+}
+
+func NotificationsRoom(userID string) string {
+	return "notifications_" + userID
+}
+
+// A websocket connection. Only its writer goroutine writes to the connection,
+// everyone else queues messages through Send.
+type SocketClient struct {
+	Conn *websocket.Conn
+	User *models.User
+
+	send   chan []byte
+	evict  chan struct{}
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewSocketClient(conn *websocket.Conn, user *models.User) *SocketClient {
+	return &SocketClient{
+		Conn:  conn,
+		User:  user,
+		send:  make(chan []byte, socketSendBufferSize),
+		evict: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Queue a message without blocking. A client whose queue is full is too slow to keep up
+// and gets disconnected instead of stalling everyone else.
+func (cl *SocketClient) Send(data []byte) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		return false
+	}
+	select {
+	case cl.send <- data:
+		return true
+	default:
+		log.Println("socket: evicting slow consumer")
+		cl.closed = true
+		close(cl.evict) // the queue is dropped rather than flushed
+		return false
+	}
+}
+
+// Stop accepting messages. The writer flushes what is queued, then closes the connection.
+func (cl *SocketClient) Close() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if !cl.closed {
+		cl.closed = true
+		close(cl.send)
+	}
+}
+
+// Starts the writer and reads messages until the connection closes, passing each to handle.
+// Returns once the writer has finished, as the connection must not be used after the handler returns.
+func (cl *SocketClient) Run(handle func(mt int, data []byte) bool) {
+	go cl.writePump()
+
+	cl.Conn.SetReadLimit(socketMaxMessageSize)
+	cl.Conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	cl.Conn.SetPongHandler(func(string) error {
+		return cl.Conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+	for {
+		mt, data, err := cl.Conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		cl.Conn.SetReadDeadline(time.Now().Add(socketPongWait))
+		if !handle(mt, data) {
+			break
+		}
+	}
+	cl.Close()
+	<-cl.done
+}
+
+func (cl *SocketClient) writePump() {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		cl.Conn.Close() // unblocks the reader if the writer fails first
+		close(cl.done)
+	}()
+	for {
+		select {
+		case <-cl.evict:
+			cl.Conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			cl.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"))
+			return
+		case data, ok := <-cl.send:
+			cl.Conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if !ok {
+				cl.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := cl.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			cl.Conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := cl.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Keeps track of the clients in each room. Broadcasts go through the fanout backend so that
+// every instance delivers them to its own clients. Delivery only locks the hub long enough
+// to copy a room's clients, so one slow connection can't hold up the others.
+type Hub struct {
+	mu      sync.RWMutex
+	rooms   map[string]map[*SocketClient]bool
+	backend fanout.Backend
+}
+
+func NewHub(backend fanout.Backend) *Hub {
+	h := &Hub{rooms: map[string]map[*SocketClient]bool{}, backend: backend}
+	backend.Subscribe(h.deliver)
+	return h
+}
+
+func (h *Hub) Join(client *SocketClient, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[room] == nil {
+		h.rooms[room] = map[*SocketClient]bool{}
+	}
+	h.rooms[room][client] = true
+}
+
+func (h *Hub) Leave(client *SocketClient, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if clients, ok := h.rooms[room]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+}
+
+func (h *Hub) Clients(room string) []*SocketClient {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*SocketClient, 0, len(h.rooms[room]))
+	for client := range h.rooms[room] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Send data to every client in the room, on all instances (except the clients of the user given, if any)
+func (h *Hub) Broadcast(room string, data []byte, exceptUserIDOpts ...string) {
+	msg := fanout.Message{Room: room, Data: data}
+	if len(exceptUserIDOpts) > 0 {
+		msg.ExceptUserID = exceptUserIDOpts[0]
+	}
+	if err := h.backend.Publish(msg); err != nil {
+		log.Println("socket: broadcast failed:", err)
+	}
+}
+
+// Send the same data to every client in several rooms, published as a single broadcast
+func (h *Hub) BroadcastRooms(rooms []string, data []byte) {
+	if len(rooms) == 0 {
+		return
+	}
+	if err := h.backend.Publish(fanout.Message{Rooms: rooms, Data: data}); err != nil {
+		log.Println("socket: broadcast failed:", err)
+	}
+}
+
+// Drop the clients of the users from the room, on all instances
+func (h *Hub) Evict(room string, userIDs ...string) {
+	if len(userIDs) == 0 {
+		return
+	}
+	if err := h.backend.Publish(fanout.Message{Room: room, EvictUserIDs: userIDs}); err != nil {
+		log.Println("socket: eviction failed:", err)
+	}
+}
+
+// Queue a broadcast for this instance's clients in its rooms
+func (h *Hub) deliver(msg fanout.Message) {
+	if len(msg.EvictUserIDs) > 0 {
+		h.evict(msg)
+		return
+	}
+	for _, room := range msg.AllRooms() {
+		for _, client := range h.Clients(room) {
+			if msg.ExceptUserID != "" && client.User.ID.String() == msg.ExceptUserID {
+				continue
+			}
+			if !client.Send(msg.Data) {
+				h.Leave(client, room)
+			}
+		}
+	}
+}
+
+// Remove this instance's clients of the users from the rooms and close them.
+// A chat socket only listens in its chat's room, so it has nothing left to do.
+func (h *Hub) evict(msg fanout.Message) {
+	for _, room := range msg.AllRooms() {
+		for _, client := range h.Clients(room) {
+			if slices.Contains(msg.EvictUserIDs, client.User.ID.String()) {
+				h.Leave(client, room)
+				client.Send(SocketError(utils.ERR_NOT_ALLOWED, "You're no longer a member of this chat", 4001))
+				client.Close()
+			}
+		}
+	}
+}
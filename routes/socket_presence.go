@@ -0,0 +1,168 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/acatalepsy17/pigeon/fanout"
+	"github.com/acatalepsy17/pigeon/schemas"
+	"github.com/pborman/uuid"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+
+	presenceRoom = "presence" // no client joins it, instances share presence updates through it
+)
+
+var presenceRank = map[string]int{PresenceOffline: 0, PresenceAway: 1, PresenceOnline: 2}
+
+type presenceUpdate struct {
+	Instance string    `json:"instance"`
+	UserID   string    `json:"user_id"`
+	Status   string    `json:"status"`
+	At       time.Time `json:"at"`
+	Seq      uint64    `json:"seq"` // increases with each update of the user from the instance
+}
+
+// Keeps track of who is online from their socket connections, in memory only.
+// A user's status is the best among their connections: online, then away, otherwise offline.
+// Each instance shares the status of its own users with the others through the fanout backend,
+// so an instance started later only learns about users whose status changes after it started.
+type PresenceTracker struct {
+	instance string
+	backend  fanout.Backend
+
+	mu          sync.Mutex
+	connections map[string]map[*SocketClient]string // this instance's connections by user
+	instances   map[string]map[string]string        // status of each user on every instance
+	lastSeen    map[string]time.Time
+	seqs        map[string]uint64 // last update sequence by instance & user, so late updates are dropped
+}
+
+func NewPresenceTracker(backend fanout.Backend) *PresenceTracker {
+	t := &PresenceTracker{
+		instance:    uuid.New(),
+		backend:     backend,
+		connections: map[string]map[*SocketClient]string{},
+		instances:   map[string]map[string]string{},
+		lastSeen:    map[string]time.Time{},
+		seqs:        map[string]uint64{},
+	}
+	backend.Subscribe(t.receive)
+	return t
+}
+
+func (t *PresenceTracker) Connect(client *SocketClient) schemas.PresenceSchema {
+	return t.Set(client, PresenceOnline)
+}
+
+// Set the status of a connection and return the user's resulting presence
+func (t *PresenceTracker) Set(client *SocketClient, status string) schemas.PresenceSchema {
+	userID := client.User.ID.String()
+	t.mu.Lock()
+	if t.connections[userID] == nil {
+		t.connections[userID] = map[*SocketClient]string{}
+	}
+	t.connections[userID][client] = status
+	presence, update := t.update(userID)
+	t.mu.Unlock()
+	t.publish(update)
+	return presence
+}
+
+func (t *PresenceTracker) Disconnect(client *SocketClient) schemas.PresenceSchema {
+	userID := client.User.ID.String()
+	t.mu.Lock()
+	delete(t.connections[userID], client)
+	if len(t.connections[userID]) == 0 {
+		delete(t.connections, userID)
+	}
+	presence, update := t.update(userID)
+	t.mu.Unlock()
+	t.publish(update)
+	return presence
+}
+
+// Apply the user's status on this instance from their connections, returning the update to share
+// with the other instances. Must be called with the lock held. The update is numbered under it,
+// so the other instances can put a user's updates back in order whenever they're published.
+func (t *PresenceTracker) update(userID string) (schemas.PresenceSchema, presenceUpdate) {
+	status := PresenceOffline
+	for _, connStatus := range t.connections[userID] {
+		if presenceRank[connStatus] > presenceRank[status] {
+			status = connStatus
+		}
+	}
+	key := t.instance + ":" + userID
+	t.seqs[key]++
+	update := presenceUpdate{Instance: t.instance, UserID: userID, Status: status, At: time.Now().UTC(), Seq: t.seqs[key]}
+	t.apply(update)
+	return t.get(userID), update
+}
+
+// Share an update with the other instances. Called without the lock, as publishing may block.
+func (t *PresenceTracker) publish(update presenceUpdate) {
+	data, _ := json.Marshal(update)
+	if err := t.backend.Publish(fanout.Message{Room: presenceRoom, Data: data}); err != nil {
+		log.Println("socket: presence update failed:", err)
+	}
+}
+
+func (t *PresenceTracker) receive(msg fanout.Message) {
+	if msg.Room != presenceRoom {
+		return
+	}
+	update := presenceUpdate{}
+	if err := json.Unmarshal(msg.Data, &update); err != nil || update.Instance == t.instance {
+		return // our own updates are already applied
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := update.Instance + ":" + update.UserID
+	if update.Seq <= t.seqs[key] {
+		return // a newer update of the user from that instance arrived first
+	}
+	t.seqs[key] = update.Seq
+	t.apply(update)
+}
+
+func (t *PresenceTracker) apply(update presenceUpdate) {
+	if update.At.After(t.lastSeen[update.UserID]) {
+		t.lastSeen[update.UserID] = update.At
+	}
+	if update.Status == PresenceOffline {
+		delete(t.instances[update.UserID], update.Instance)
+		if len(t.instances[update.UserID]) == 0 {
+			delete(t.instances, update.UserID)
+		}
+		return
+	}
+	if t.instances[update.UserID] == nil {
+		t.instances[update.UserID] = map[string]string{}
+	}
+	t.instances[update.UserID][update.Instance] = update.Status
+}
+
+func (t *PresenceTracker) get(userID string) schemas.PresenceSchema {
+	presence := schemas.PresenceSchema{Status: PresenceOffline}
+	for _, status := range t.instances[userID] {
+		if presenceRank[status] > presenceRank[presence.Status] {
+			presence.Status = status
+		}
+	}
+	if lastSeen, ok := t.lastSeen[userID]; ok {
+		presence.LastSeen = &lastSeen
+	}
+	return presence
+}
+
+func (t *PresenceTracker) Get(userID string) schemas.PresenceSchema {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.get(userID)
+}
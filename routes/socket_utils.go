@@ -2,7 +2,7 @@ package routes
 
 import (
 	"encoding/json"
-	"sync"
+	"time"
 
 	"github.com/acatalepsy17/pigeon/models"
 	"github.com/acatalepsy17/pigeon/utils"
@@ -10,27 +10,6 @@ import (
 	"gorm.io/gorm"
 )
 
-// Maintain db & a list of connected clients
-var (
-	clients      = make(map[*websocket.Conn]bool)
-	clientsMutex = &sync.Mutex{}
-	validator    = utils.Validator()
-)
-
-// Function to add a client to the list
-func AddClient(c *websocket.Conn) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
-	clients[c] = true
-}
-
-// Function to remove a client from the list
-func RemoveClient(c *websocket.Conn) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
-	delete(clients, c)
-}
-
 type ErrorResp struct {
 	Status  string             `json:"status"`
 	Code    int                `json:"code"`
@@ -39,33 +18,62 @@ type ErrorResp struct {
 	Data    *map[string]string `json:"data,omitempty"`
 }
 
-func ReturnError(c *websocket.Conn, errType string, message string, code int, dataOpts ...*map[string]string) {
+func SocketError(errType string, message string, code int, dataOpts ...*map[string]string) []byte {
 	errorResponse := ErrorResp{Status: "failure", Code: code, Type: errType, Message: message}
 	if len(dataOpts) > 0 {
 		errorResponse.Data = dataOpts[0]
 	}
 	jsonResponse, _ := json.Marshal(errorResponse)
-	c.WriteMessage(websocket.TextMessage, jsonResponse)
+	return jsonResponse
 }
 
-func ValidateAuth(db *gorm.DB, token string) (*models.User, *string, *string) {
-	var (
-		errMsg *string
-		secret *string
-		user   *models.User
-	)
+// Write an error directly. Only for connections whose SocketClient isn't running yet.
+func ReturnError(c *websocket.Conn, errType string, message string, code int, dataOpts ...*map[string]string) {
+	c.WriteMessage(websocket.TextMessage, SocketError(errType, message, code, dataOpts...))
+}
+
+func ValidateAuth(db *gorm.DB, token string) (*models.User, *string) {
 	if len(token) < 1 {
-		err := "Auth bearer not set"
-		errMsg = &err
-	} else if token == cfg.SocketSecretKey {
-		secret = &token
+		errMsg := "Auth bearer not set"
+		return nil, &errMsg
+	}
+	user, _, errMsg := GetUser(token, db)
+	return user, errMsg
+}
+
+// Decode & validate an event sent by a client. Returns the error to send back, if any.
+func ValidateSocketEvent(data []byte, event interface{}) []byte {
+	if err := json.Unmarshal(data, event); err != nil {
+		return SocketError(utils.ERR_INVALID_ENTRY, "Invalid Json data", 4220)
+	}
+	if errData := utils.Validator().Validate(event); errData != nil {
+		return SocketError(utils.ERR_INVALID_ENTRY, "Invalid Entry", 4220, errData.Data)
+	}
+	return nil
+}
+
+const (
+	socketEventBurst      = 5 // events a client can send at once
+	socketEventsPerSecond = 1 // rate at which that allowance refills
+)
+
+// Token bucket limiting the events a single connection sends. Only used by its reader.
+type socketRateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *socketRateLimiter) Allow() bool {
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = socketEventBurst
 	} else {
-		// Get User
-		userObj, err := GetUser(token, db)
-		if err != nil {
-			errMsg = err
-		}
-		user = userObj
+		l.tokens = min(socketEventBurst, l.tokens+now.Sub(l.last).Seconds()*socketEventsPerSecond)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
 	}
-	return user, secret, errMsg
+	l.tokens--
+	return true
 }
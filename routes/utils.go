@@ -1,18 +1,11 @@
 package routes
 
 import (
-	"encoding/json"
-	"net/http"
-	"net/url"
-	"os"
-
 	"github.com/acatalepsy17/pigeon/models"
 	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/schemas"
 	"github.com/acatalepsy17/pigeon/utils"
-	"github.com/fasthttp/websocket"
 	"github.com/gofiber/fiber/v2"
-	"github.com/pborman/uuid"
 )
 
 func SuccessResponse(message string) schemas.ResponseSchema {
@@ -23,6 +16,10 @@ func RequestUser(c *fiber.Ctx) *models.User {
 	return c.Locals("user").(*models.User)
 }
 
+func RequestSession(c *fiber.Ctx) *models.Session {
+	return c.Locals("session").(*models.Session)
+}
+
 func ValidateReactionFocus(focus choices.FocusTypeChoice) *utils.ErrorResponse {
 	switch focus {
 	case "POST", "COMMENT", "REPLY":
@@ -31,103 +28,3 @@ func ValidateReactionFocus(focus choices.FocusTypeChoice) *utils.ErrorResponse {
 	err := utils.RequestErr(utils.ERR_INVALID_VALUE, "Invalid 'focus' value")
 	return &err
 }
-
-func SendNotificationInSocket(fiberCtx *fiber.Ctx, notification models.Notification, commentSlug *string, replySlug *string, statusOpts ...string) error {
-	if os.Getenv("ENVIRONMENT") == "TESTING" {
-		return nil
-	}
-
-	// Check if page size is provided as an argument
-	status := "CREATED"
-	if len(statusOpts) > 0 {
-		status = statusOpts[0]
-	}
-	webSocketScheme := "ws://"
-	if fiberCtx.Secure() {
-		webSocketScheme = "wss://"
-	}
-	uri := webSocketScheme + fiberCtx.Hostname() + "/api/v1/ws/notifications/"
-	notificationData := SocketNotificationSchema{
-		Notification: models.Notification{BaseModel: models.BaseModel{ID: notification.ID}, Ntype: notification.Ntype, CommentSlug: commentSlug, ReplySlug: replySlug},
-		Status:       status,
-	}
-	if status == "CREATED" {
-		notificationData = SocketNotificationSchema{
-			Notification: notification.Init(nil),
-			Status:       status,
-		}
-	}
-
-	// Connect to the WebSocket server
-	u, err := url.Parse(uri)
-	if err != nil {
-		return err
-	}
-
-	headers := make(http.Header)
-	headers.Add("Authorization", cfg.SocketSecretKey)
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), headers)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	// Marshal the notification data to JSON
-	data, err := json.Marshal(notificationData)
-	if err != nil {
-		return err
-	}
-
-	// Send the notification to the WebSocket server
-	err = conn.WriteMessage(websocket.TextMessage, data)
-	if err != nil {
-		return err
-	}
-
-	// Close the WebSocket connection
-	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-}
-
-func SendMessageDeletionInSocket(fiberCtx *fiber.Ctx, chatID uuid.UUID, messageID uuid.UUID) error {
-	if os.Getenv("ENVIRONMENT") == "TESTING" {
-		return nil
-	}
-	webSocketScheme := "ws://"
-	if fiberCtx.Secure() {
-		webSocketScheme = "wss://"
-	}
-	uri := webSocketScheme + fiberCtx.Hostname() + "/api/v1/ws/chats/" + chatID.String()
-	chatData := SocketMessageEntrySchema{
-		ID:     messageID,
-		Status: "DELETED",
-	}
-
-	// Connect to the WebSocket server
-	u, err := url.Parse(uri)
-	if err != nil {
-		return err
-	}
-
-	headers := make(http.Header)
-	headers.Add("Authorization", cfg.SocketSecretKey)
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), headers)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	// Marshal the notification data to JSON
-	data, err := json.Marshal(chatData)
-	if err != nil {
-		return err
-	}
-
-	// Send the message to the WebSocket server
-	err = conn.WriteMessage(websocket.TextMessage, data)
-	if err != nil {
-		return err
-	}
-
-	// Close the WebSocket connection
-	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-}
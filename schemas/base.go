@@ -2,6 +2,7 @@ package schemas
 
 import (
 	"github.com/acatalepsy17/pigeon/models"
+	"github.com/pborman/uuid"
 )
 
 type ResponseSchema struct {
@@ -9,10 +10,22 @@ type ResponseSchema struct {
 	Message string `json:"message" example:"Data fetched/created/updated/deleted"`
 }
 
+// Page based pagination. In keyset mode (with a cursor), current_page is 0 and there's no previous link.
 type PaginatedResponseDataSchema struct {
-	PerPage     uint `json:"per_page" example:"100"`
-	CurrentPage uint `json:"current_page" example:"1"`
-	LastPage    uint `json:"last_page" example:"100"`
+	PerPage     uint    `json:"per_page" example:"100"`
+	CurrentPage uint    `json:"current_page" example:"1"`
+	LastPage    uint    `json:"last_page" example:"100"`
+	TotalItems  int64   `json:"total_items" example:"1000"`
+	Next        *string `json:"next" example:"https://pigeon.com/api/v1/feed/posts?page=2"`
+	Previous    *string `json:"previous" example:"https://pigeon.com/api/v1/feed/posts?page=1"`
+}
+
+// Keyset pagination. Pass a cursor as `before` to get the older items or as `after` to get the newer ones.
+// A cursor is null when there's nothing more in that direction.
+type CursorPaginatedResponseDataSchema struct {
+	PerPage     uint       `json:"per_page" example:"50"`
+	OlderCursor *uuid.UUID `json:"older_cursor" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
+	NewerCursor *uuid.UUID `json:"newer_cursor" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
 }
 
 type UserDataSchema struct {
@@ -1,7 +1,10 @@
 package schemas
 
 import (
+	"time"
+
 	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/pborman/uuid"
 )
 
@@ -10,6 +13,11 @@ type MessageCreateSchema struct {
 	Username *string    `json:"username,omitempty" validate:"required_without=ChatID" example:"john-doe"`
 	Text     *string    `json:"text" validate:"required_without=FileType" example:"I am not in danger skyler, I am the danger"`
 	FileType *string    `json:"file_type" validate:"omitempty,file_type_validator" example:"image/jpeg"`
+	ParentID *uuid.UUID `json:"parent_id" validate:"omitempty" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
+}
+
+type ChatReadSchema struct {
+	MessageID uuid.UUID `json:"message_id" validate:"required" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
 }
 
 type MessageUpdateSchema struct {
@@ -18,7 +26,7 @@ type MessageUpdateSchema struct {
 }
 
 type MessagesResponseDataSchema struct {
-	PaginatedResponseDataSchema
+	CursorPaginatedResponseDataSchema
 	Items []models.Message `json:"items"`
 }
 
@@ -33,13 +41,17 @@ func (data MessagesResponseDataSchema) Init() MessagesResponseDataSchema {
 }
 
 type MessagesSchema struct {
-	Chat     models.Chat                `json:"chat"`
-	Messages MessagesResponseDataSchema `json:"messages"`
-	Users    []models.UserDataSchema    `json:"users"`
+	Chat        models.Chat                `json:"chat"`
+	Messages    MessagesResponseDataSchema `json:"messages"`
+	Users       []models.UserDataSchema    `json:"users"`
+	ReadCursors []models.ChatReadCursor    `json:"read_cursors"`
 }
 
 func (data MessagesSchema) Init() MessagesSchema {
 	// Set Initial Data
+	for i := range data.ReadCursors {
+		data.ReadCursors[i] = data.ReadCursors[i].Init()
+	}
 	chat := data.Chat.InitG()
 	// Set Users
 	data.Users = chat.Users
@@ -48,12 +60,22 @@ func (data MessagesSchema) Init() MessagesSchema {
 	return data
 }
 
+type MessageThreadSchema struct {
+	Message models.Message             `json:"message"`
+	Replies MessagesResponseDataSchema `json:"replies"`
+}
+
 type GroupChatInputSchema struct {
 	Name              *string   `json:"name" validate:"omitempty,max=100" example:"Dopest Group"`
 	Description       *string   `json:"description" validate:"omitempty,max=1000" example:"This is a group for bosses."`
 	UsernamesToAdd    *[]string `json:"usernames_to_add" validate:"omitempty,min=1,max=99" example:"john-doe"`
 	UsernamesToRemove *[]string `json:"usernames_to_remove" validate:"omitempty,min=1,max=99,usernames_to_update_validator" example:"john-doe"`
 	FileType          *string   `json:"file_type" validate:"omitempty,file_type_validator" example:"image/jpeg"`
+
+	// Settings, only changed by admins
+	OnlyAdminsCanPost     *bool `json:"only_admins_can_post" example:"false"`
+	OnlyAdminsCanEditInfo *bool `json:"only_admins_can_edit_info" example:"true"`
+	JoinApprovalRequired  *bool `json:"join_approval_required" example:"false"`
 }
 
 type GroupChatCreateSchema struct {
@@ -61,6 +83,32 @@ type GroupChatCreateSchema struct {
 	Description    *string  `json:"description" validate:"omitempty,max=1000" example:"This is a group for bosses."`
 	UsernamesToAdd []string `json:"usernames_to_add" validate:"required,min=1,max=99" example:"john-doe"`
 	FileType       *string  `json:"file_type" validate:"omitempty,file_type_validator" example:"image/jpeg"`
+
+	OnlyAdminsCanPost     bool  `json:"only_admins_can_post" example:"false"`
+	OnlyAdminsCanEditInfo *bool `json:"only_admins_can_edit_info" example:"true"` // defaults to true, like before roles existed
+	JoinApprovalRequired  bool  `json:"join_approval_required" example:"false"`
+}
+
+type GroupMemberRoleSchema struct {
+	Role choices.ChatRoleChoice `json:"role" validate:"required,oneof=ADMIN MEMBER" example:"ADMIN"`
+}
+
+type GroupOwnershipTransferSchema struct {
+	Username string `json:"username" validate:"required" example:"john-doe"`
+}
+
+type GroupInviteCreateSchema struct {
+	ExpiresAt *time.Time `json:"expires_at" validate:"omitempty" example:"2024-06-05T02:32:34.462196+01:00"` // never expires if null
+	MaxUses   *int       `json:"max_uses" validate:"omitempty,min=1" example:"10"`                           // unlimited if null
+}
+
+type GroupJoinRequestActionSchema struct {
+	Accepted bool `json:"accepted" example:"true"`
+}
+
+type GroupJoinSchema struct {
+	Chat    *models.Chat            `json:"chat"`    // the group joined, null while the request is pending
+	Request *models.ChatJoinRequest `json:"request"` // the pending request, if the group requires approval
 }
 
 // RESPONSE SCHEMAS
@@ -95,7 +143,52 @@ type ChatResponseSchema struct {
 	Data MessagesSchema `json:"data"`
 }
 
+type MessageThreadResponseSchema struct {
+	ResponseSchema
+	Data MessageThreadSchema `json:"data"`
+}
+
+type ChatReadResponseSchema struct {
+	ResponseSchema
+	Data models.ChatReadCursor `json:"data"`
+}
+
 type GroupChatInputResponseSchema struct {
 	ResponseSchema
 	Data models.Chat `json:"data"`
 }
+
+type GroupInviteResponseSchema struct {
+	ResponseSchema
+	Data models.ChatInvite `json:"data"`
+}
+
+type GroupInvitesResponseSchema struct {
+	ResponseSchema
+	Data []models.ChatInvite `json:"data"`
+}
+
+type GroupJoinRequestsResponseDataSchema struct {
+	PaginatedResponseDataSchema
+	Items []models.ChatJoinRequest `json:"requests"`
+}
+
+func (data GroupJoinRequestsResponseDataSchema) Init() GroupJoinRequestsResponseDataSchema {
+	// Set Initial Data
+	items := data.Items
+	for i := range items {
+		items[i] = items[i].Init()
+	}
+	data.Items = items
+	return data
+}
+
+type GroupJoinRequestsResponseSchema struct {
+	ResponseSchema
+	Data GroupJoinRequestsResponseDataSchema `json:"data"`
+}
+
+type GroupJoinResponseSchema struct {
+	ResponseSchema
+	Data GroupJoinSchema `json:"data"`
+}
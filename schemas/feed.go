@@ -6,8 +6,10 @@ import (
 )
 
 type PostInputSchema struct {
-	Text     string  `json:"text" validate:"required" example:"God is good"`
-	FileType *string `json:"file_type" example:"image/jpeg" validate:"omitempty,file_type_validator"`
+	Text              string                      `json:"text" validate:"required" example:"God is good"`
+	FileType          *string                     `json:"file_type" example:"image/jpeg" validate:"omitempty,file_type_validator"`
+	Audience          *choices.PostAudienceChoice `json:"audience" validate:"omitempty,oneof=PUBLIC FRIENDS ONLY_ME CUSTOM" example:"PUBLIC"` // the author's default audience if not set on creation, unchanged if not set on update
+	AudienceUsernames []string                    `json:"audience_usernames" example:"john-doe"`                                              // required for a CUSTOM audience, and only allowed with one. On update, they change the users of a CUSTOM post even without the audience
 }
 
 // // REACTION SCHEMA
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/acatalepsy17/pigeon/models"
+	"github.com/acatalepsy17/pigeon/models/choices"
 	"github.com/acatalepsy17/pigeon/utils"
 	"github.com/pborman/uuid"
 )
@@ -15,6 +16,9 @@ type ProfileUpdateSchema struct {
 	Dob       *time.Time `json:"dob" validate:"omitempty" example:"2001-01-16T00:00:00.106416+01:00"`
 	CityID    *uuid.UUID `json:"city_id" validate:"omitempty" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
 	FileType  *string    `json:"file_type" example:"image/jpeg" validate:"omitempty,file_type_validator"`
+
+	ApproveFollowers    *bool                       `json:"approve_followers" example:"false"` // turning it off accepts the pending follow requests
+	DefaultPostAudience *choices.PostAudienceChoice `json:"default_post_audience" validate:"omitempty,oneof=PUBLIC FRIENDS ONLY_ME" example:"FRIENDS"`
 }
 
 func (p ProfileUpdateSchema) SetValues(user *models.User) *models.User {
@@ -26,11 +30,26 @@ func (p ProfileUpdateSchema) SetValues(user *models.User) *models.User {
 	}
 	user.Bio = p.Bio
 	user.Dob = p.Dob
+	if p.ApproveFollowers != nil {
+		user.ApproveFollowers = *p.ApproveFollowers
+	}
+	if p.DefaultPostAudience != nil {
+		user.DefaultPostAudience = *p.DefaultPostAudience
+	}
 	return user
 }
 
 type DeleteUserSchema struct {
-	Password string `json:"password" validate:"required" example:"password"`
+	Password string `json:"password" example:"password"` // empty for accounts without a password (social login)
+}
+
+type EmailChangeSchema struct {
+	Email    string `json:"email" validate:"required,min=5,email" example:"donaldtrump47th@gmail.com"`
+	Password string `json:"password" example:"password"` // empty for accounts without a password (social login)
+}
+
+type EmailChangeConfirmSchema struct {
+	Otp uint32 `json:"otp" validate:"required" example:"123456"`
 }
 
 type SendFriendRequestSchema struct {
@@ -42,6 +61,11 @@ type AcceptFriendRequestSchema struct {
 	Accepted bool `json:"accepted" example:"true"`
 }
 
+type AcceptFollowRequestSchema struct {
+	Username string `json:"username" validate:"required" example:"john-doe"`
+	Accepted bool   `json:"accepted" example:"true"`
+}
+
 type ReadNotificationSchema struct {
 	MarkAllAsRead bool       `json:"mark_all_as_read" example:"false"`
 	ID            *uuid.UUID `json:"id" validate:"required_if=MarkAllAsRead false,omitempty" example:"d10dde64-a242-4ed0-bd75-4c759644b3a6"`
@@ -101,7 +125,7 @@ func (profileData ProfileUpdateResponseDataSchema) Init(fileType *string) Profil
 		fuData := utils.GenerateFileSignature(image.ID.String(), "avatars")
 		profileData.FileUploadData = &fuData
 	}
-	profileData.User = profileData.User.Init()
+	profileData.User = profileData.User.InitOwn()
 	return profileData
 }
 
@@ -130,3 +154,19 @@ type NotificationsResponseSchema struct {
 	ResponseSchema
 	Data NotificationsResponseDataSchema `json:"data"`
 }
+
+// PRESENCE
+type PresenceSchema struct {
+	Status   string     `json:"status" example:"online"`
+	LastSeen *time.Time `json:"last_seen" example:"2024-06-05T02:32:34.462196+01:00"`
+}
+
+type UserPresenceSchema struct {
+	User models.UserDataSchema `json:"user"`
+	PresenceSchema
+}
+
+type PresenceResponseSchema struct {
+	ResponseSchema
+	Data []UserPresenceSchema `json:"data"`
+}
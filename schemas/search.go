@@ -0,0 +1,35 @@
+package schemas
+
+import (
+	"github.com/acatalepsy17/pigeon/models"
+)
+
+// Messages found in the user's chats
+type SearchMessagesResponseDataSchema struct {
+	PaginatedResponseDataSchema
+	Items []models.Message `json:"messages"`
+}
+
+func (data SearchMessagesResponseDataSchema) Init() SearchMessagesResponseDataSchema {
+	// Set Initial Data
+	items := data.Items
+	for i := range items {
+		items[i] = items[i].Init()
+	}
+	data.Items = items
+	return data
+}
+
+// A page of results for each type searched, most relevant first
+type SearchResultsSchema struct {
+	Posts    *PostsResponseDataSchema              `json:"posts,omitempty"`
+	Comments *CommentsResponseDataSchema           `json:"comments,omitempty"`
+	Replies  *CommentWithRepliesResponseDataSchema `json:"replies,omitempty"`
+	Users    *ProfilesResponseDataSchema           `json:"users,omitempty"`
+	Messages *SearchMessagesResponseDataSchema     `json:"messages,omitempty"`
+}
+
+type SearchResponseSchema struct {
+	ResponseSchema
+	Data SearchResultsSchema `json:"data"`
+}
@@ -41,16 +41,46 @@ func sortEmail(user *models.User, emailType string, code *uint32) map[string]int
 		subject = "Password reset successfully"
 		data["template_file"] = templateFile
 		data["subject"] = subject
+
+	} else if emailType == "password-changed" {
+		templateFile = "templates/password-changed.html"
+		subject = "Your password was changed"
+		data["template_file"] = templateFile
+		data["subject"] = subject
+
+	} else if emailType == "account-locked" {
+		templateFile = "templates/account-locked.html"
+		subject = "Your account was temporarily locked"
+		data["template_file"] = templateFile
+		data["subject"] = subject
+
+	} else if emailType == "email-change" {
+		templateFile = "templates/email-change.html"
+		subject = "Confirm your new email address"
+		data["template_file"] = templateFile
+		data["subject"] = subject
+		data["otp"] = code
+
+	} else if emailType == "email-change-notice" {
+		templateFile = "templates/email-change-notice.html"
+		subject = "Email change requested"
+		data["template_file"] = templateFile
+		data["subject"] = subject
 	}
 	return data
 }
 
 type EmailContext struct {
-	Name string
-	Otp  *uint32
+	Name     string
+	Otp      *uint32
+	Email    string
+	Link     string
+	NewEmail string
 }
 
-func SendEmail(user *models.User, emailType string, code *uint32) {
+// Extra data (optional) can contain an "email" to send to instead of the user's,
+// and a "link" or "new_email" to render in the template.
+func SendEmail(user *models.User, emailType string, code *uint32, extraOpts ...map[string]string) {
 	if os.Getenv("ENVIRONMENT") == "TESTING" {
 		return
 	}
@@ -61,8 +91,19 @@ func SendEmail(user *models.User, emailType string, code *uint32) {
 	subject := emailData["subject"]
 
 	// Create a context with dynamic data
+	recipient := user.Email
 	data := EmailContext{
-		Name: user.FirstName,
+		Name:  user.FirstName,
+		Email: user.Email,
+	}
+	if len(extraOpts) > 0 {
+		extra := extraOpts[0]
+		if email, ok := extra["email"]; ok {
+			recipient = email
+			data.Email = email
+		}
+		data.Link = extra["link"]
+		data.NewEmail = extra["new_email"]
 	}
 	if otp, ok := emailData["otp"]; ok {
 		code := otp.(*uint32)
@@ -97,7 +138,7 @@ func SendEmail(user *models.User, emailType string, code *uint32) {
 	// Create a new message
 	m := gomail.NewMessage()
 	m.SetHeader("From", cfg.MailSenderEmail)
-	m.SetHeader("To", user.Email)
+	m.SetHeader("To", recipient)
 	m.SetHeader("Subject", subject.(string))
 	m.SetBody("text/html", bodyContent.String())
 
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/acatalepsy17/pigeon/config"
+)
+
+var breachedPasswords map[string]bool
+var breachedPasswordsOnce sync.Once
+
+// Loads the breached password list (one password per line) the first time it is needed
+func loadBreachedPasswords(path string) map[string]bool {
+	breachedPasswordsOnce.Do(func() {
+		breachedPasswords = map[string]bool{}
+		if path == "" {
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			log.Println("Unable to load breached passwords list:", err)
+			return
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if password := strings.TrimSpace(scanner.Text()); password != "" {
+				breachedPasswords[strings.ToLower(password)] = true
+			}
+		}
+	})
+	return breachedPasswords
+}
+
+// Checks a new password against the configured policy and returns the reason it is rejected (if any).
+// Reuse of previous passwords is checked separately as it needs the user's history.
+func CheckPasswordPolicy(password string) *string {
+	cfg := config.GetConfig()
+	var errMsg string
+	if len(password) < cfg.PasswordMinLength {
+		errMsg = fmt.Sprintf("Password must be at least %d characters", cfg.PasswordMinLength)
+	} else if loadBreachedPasswords(cfg.PasswordBreachedListFile)[strings.ToLower(password)] {
+		errMsg = "This password has appeared in a data breach. Choose another one"
+	}
+	if errMsg == "" {
+		return nil
+	}
+	return &errMsg
+}
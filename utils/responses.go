@@ -22,7 +22,10 @@ var ERR_INVALID_REQUEST = "invalid_request"
 var ERR_INVALID_ENTRY = "invalid_entry"
 var ERR_INCORRECT_EMAIL = "incorrect_email"
 var ERR_INCORRECT_OTP = "incorrect_otp"
+var ERR_INCORRECT_MFA_CODE = "incorrect_mfa_code"
 var ERR_EXPIRED_OTP = "expired_otp"
+var ERR_TOO_MANY_ATTEMPTS = "too_many_attempts"
+var ERR_ACCOUNT_LOCKED = "account_locked"
 var ERR_INVALID_AUTH = "invalid_auth"
 var ERR_INVALID_TOKEN = "invalid_token"
 var ERR_INVALID_CREDENTIALS = "invalid_credentials"
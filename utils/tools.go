@@ -1,11 +1,15 @@
 package utils
 
 import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"log"
+	"math/big"
 	"math/rand"
 	"reflect"
-	"time"
 
 	"github.com/pborman/uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -32,7 +36,16 @@ func GetRandomString(length int) string {
 	return string(randomStr)
 }
 
-// Generates a random integer with a specified number of digits
+// Generates a cryptographically secure, url safe random token from the given number of bytes
+func GetSecureToken(size int) string {
+	raw := make([]byte, size)
+	if _, err := crand.Read(raw); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Generates a cryptographically secure random integer with a specified number of digits
 func GetRandomInt(size int) uint32 {
 	if size <= 0 {
 		return 0
@@ -42,11 +55,12 @@ func GetRandomInt(size int) uint32 {
 	min := intPow(10, size-1)
 	max := intPow(10, size) - 1
 
-	// Initialize the random number generator
-	rand.New(rand.NewSource(time.Now().UnixNano()))
-
 	// Generate a random integer within the range [min, max]
-	return uint32(rand.Intn(max-min+1) + min)
+	n, err := crand.Int(crand.Reader, big.NewInt(int64(max-min+1)))
+	if err != nil {
+		panic(err)
+	}
+	return uint32(int(n.Int64()) + min)
 }
 
 // intPow calculates the power of base^exponent for integers
@@ -70,6 +84,13 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
+// TOKEN HASHING
+// Tokens are random and long enough that a fast hash is sufficient
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 // UUID PARSER
 func ParseUUID(input string) (*uuid.UUID, *ErrorResponse) {
 	uuidVal := uuid.Parse(input)
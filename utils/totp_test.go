@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238 (appendix B), truncated to our 6 digits
+var totpTestVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+const totpTestSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890" in base32
+
+func TestGenerateTotpCode(t *testing.T) {
+	for _, vector := range totpTestVectors {
+		code, err := GenerateTotpCode(totpTestSecret, time.Unix(vector.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != vector.code {
+			t.Errorf("code at %d = %s, want %s", vector.unix, code, vector.code)
+		}
+	}
+}
+
+func TestValidateTotpCode(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := TotpStep(now)
+	previousCode, _ := GenerateTotpCode(totpTestSecret, now.Add(-TotpPeriod*time.Second))
+	tooOldCode, _ := GenerateTotpCode(totpTestSecret, now.Add(-2*TotpPeriod*time.Second))
+
+	if matched, valid := ValidateTotpCode(totpTestSecret, "050471", now, 0); !valid || matched != step {
+		t.Errorf("current code: got step %d valid %v, want step %d", matched, valid, step)
+	}
+	if _, valid := ValidateTotpCode(totpTestSecret, previousCode, now, 0); !valid {
+		t.Error("the previous period's code should be accepted")
+	}
+	if _, valid := ValidateTotpCode(totpTestSecret, tooOldCode, now, 0); valid {
+		t.Error("a code two periods old should be rejected")
+	}
+	if _, valid := ValidateTotpCode(totpTestSecret, "050471", now, step); valid {
+		t.Error("a used step should be rejected")
+	}
+	if _, valid := ValidateTotpCode(totpTestSecret, "000000", now, 0); valid {
+		t.Error("a wrong code should be rejected")
+	}
+	if _, valid := ValidateTotpCode(totpTestSecret, "0504", now, 0); valid {
+		t.Error("a short code should be rejected")
+	}
+}
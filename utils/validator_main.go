@@ -67,8 +67,13 @@ func registerTranslations(param string) {
 	maxErrMsg := fmt.Sprintf("%s characters max", param)
 	registerTranslation("max", maxErrMsg, translator)
 	registerTranslation("email", "Invalid Email", translator)
+	registerTranslation("numeric", "Must contain digits only", translator)
+	lenErrMsg := fmt.Sprintf("Must be %s characters", param)
+	registerTranslation("len", lenErrMsg, translator)
 	eqErrMsg := fmt.Sprintf("Must be %s", param)
 	registerTranslation("eq", eqErrMsg, translator)
+	oneofErrMsg := fmt.Sprintf("Must be one of: %s", param)
+	registerTranslation("oneof", oneofErrMsg, translator)
 }
 
 // CustomValidator is a custom validator that uses "github.com/go-playground/validator/v10"